@@ -0,0 +1,140 @@
+package endpoint
+
+import (
+	"context"
+	"targetad/pkg/admin"
+	"targetad/pkg/admin/model"
+	"targetad/pkg/auth"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/google/uuid"
+)
+
+// the admin endpoints expect the transport to have authenticated the caller already,
+// the principal in the context is used for the created_by/updated_by columns
+
+func MakeListCampaignsEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.ListCampaignsRequest)
+		principal, ok := auth.FromContext(ctx)
+		if !ok {
+			return nil, auth.ErrUnauthenticated
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return admin.ListCampaignsService(ctx, principal, &req)
+	}
+}
+
+func MakeCreateCampaignEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.CreateCampaignRequest)
+		principal, ok := auth.FromContext(ctx)
+		if !ok {
+			return nil, auth.ErrUnauthenticated
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return admin.CreateCampaignService(ctx, principal, &req)
+	}
+}
+
+func MakeDeleteCampaignEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.DeleteCampaignRequest)
+		principal, ok := auth.FromContext(ctx)
+		if !ok {
+			return nil, auth.ErrUnauthenticated
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		id := uuid.MustParse(req.ID) // already validated as uuid
+		if err := admin.DeleteCampaignService(ctx, principal, id); err != nil {
+			return nil, err
+		}
+		return map[string]string{"id": req.ID, "status": "deleted"}, nil
+	}
+}
+
+func MakeCreateTargetingRuleEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.CreateTargetingRuleRequest)
+		principal, ok := auth.FromContext(ctx)
+		if !ok {
+			return nil, auth.ErrUnauthenticated
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return admin.CreateTargetingRuleService(ctx, principal, &req)
+	}
+}
+
+func MakeListAdvertisersEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		principal, ok := auth.FromContext(ctx)
+		if !ok {
+			return nil, auth.ErrUnauthenticated
+		}
+		return admin.ListAdvertisersService(ctx, principal)
+	}
+}
+
+func MakeCreateAdvertiserEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.CreateAdvertiserRequest)
+		principal, ok := auth.FromContext(ctx)
+		if !ok {
+			return nil, auth.ErrUnauthenticated
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return admin.CreateAdvertiserService(ctx, principal, &req)
+	}
+}
+
+func MakeUpdateAdvertiserControlsEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.UpdateAdvertiserControlsRequest)
+		principal, ok := auth.FromContext(ctx)
+		if !ok {
+			return nil, auth.ErrUnauthenticated
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return admin.UpdateAdvertiserControlsService(ctx, principal, &req)
+	}
+}
+
+func MakeTransitionCampaignStatusEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.TransitionCampaignStatusRequest)
+		principal, ok := auth.FromContext(ctx)
+		if !ok {
+			return nil, auth.ErrUnauthenticated
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return admin.TransitionCampaignStatusService(ctx, principal, &req)
+	}
+}
+
+func MakeListCampaignTransitionsEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.ListCampaignTransitionsRequest)
+		principal, ok := auth.FromContext(ctx)
+		if !ok {
+			return nil, auth.ErrUnauthenticated
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return admin.ListCampaignTransitionsService(ctx, principal, &req)
+	}
+}
@@ -0,0 +1,69 @@
+package endpoint
+
+import (
+	"context"
+	"targetad/pkg/admin/model"
+	"targetad/pkg/auth"
+	"targetad/pkg/target"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/google/uuid"
+)
+
+// the cache endpoints show the cache of the instance which answers the request, it holds every advertiser
+// so they are limited to platform operators
+
+func platformPrincipal(ctx context.Context) error {
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return auth.ErrUnauthenticated
+	}
+	if !principal.IsPlatform() {
+		return auth.ErrForbidden
+	}
+	return nil
+}
+
+func MakeCacheStateEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		if err := platformPrincipal(ctx); err != nil {
+			return nil, err
+		}
+		return target.CacheStateService(ctx)
+	}
+}
+
+func MakeCacheIndexEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.CacheIndexRequest)
+		if err := platformPrincipal(ctx); err != nil {
+			return nil, err
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return target.CacheIndexService(ctx, req.Index, req.Key)
+	}
+}
+
+func MakeCachedCampaignEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.CachedCampaignRequest)
+		if err := platformPrincipal(ctx); err != nil {
+			return nil, err
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return target.CachedCampaignService(ctx, uuid.MustParse(req.ID)) // already validated as uuid
+	}
+}
+
+func MakeReconcileCacheEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		if err := platformPrincipal(ctx); err != nil {
+			return nil, err
+		}
+		return target.ReconcileService(ctx)
+	}
+}
@@ -0,0 +1,70 @@
+package endpoint
+
+import (
+	"context"
+	"targetad/pkg/admin/model"
+	"targetad/pkg/redisstream"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// the dead-letter stream is shared by all the advertisers, like the cache endpoints these are for platform operators only
+
+func MakeListDeadLettersEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.ListDeadLettersRequest)
+		if err := platformPrincipal(ctx); err != nil {
+			return nil, err
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return redisstream.ListDeadLetters(ctx, req.After, req.Limit)
+	}
+}
+
+func MakeGetDeadLetterEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.DeadLetterRequest)
+		if err := platformPrincipal(ctx); err != nil {
+			return nil, err
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		return redisstream.GetDeadLetter(ctx, req.ID)
+	}
+}
+
+func MakeReplayDeadLetterEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.DeadLetterRequest)
+		if err := platformPrincipal(ctx); err != nil {
+			return nil, err
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		messageID, err := redisstream.ReplayDeadLetter(ctx, req.ID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"id": req.ID, "status": "replayed", "message_id": messageID}, nil
+	}
+}
+
+func MakeDiscardDeadLetterEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.DeadLetterRequest)
+		if err := platformPrincipal(ctx); err != nil {
+			return nil, err
+		}
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		if err := redisstream.DiscardDeadLetter(ctx, req.ID); err != nil {
+			return nil, err
+		}
+		return map[string]string{"id": req.ID, "status": "discarded"}, nil
+	}
+}
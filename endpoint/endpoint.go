@@ -2,21 +2,21 @@ package endpoint
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"targetad/pkg/apperr"
 	"targetad/pkg/target"
 	"targetad/pkg/target/model"
 
 	"github.com/go-kit/kit/endpoint"
-	validator "github.com/go-playground/validator/v10"
+	"github.com/spf13/viper"
 )
 
 func MakeDeliveryServiceEndpoint() endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(model.DeliveryServiceRequest)
-		validate := validator.New(validator.WithRequiredStructEnabled())
-
-		// returns nil or ValidationErrors ( []FieldError )
-		err := validate.Struct(req)
-		if err != nil {
+		// returns nil or a validation error listing every failed field
+		if err := validateRequest(req); err != nil {
 			return nil, err
 		}
 		v, err := target.DeliveryService(ctx, &req)
@@ -26,3 +26,42 @@ func MakeDeliveryServiceEndpoint() endpoint.Endpoint {
 		return v, nil
 	}
 }
+
+// MakeBatchDeliveryServiceEndpoint validates every item on its own, so one bad item does not fail the whole batch.
+// the valid items are evaluated against one cache snapshot and the results come back in the order of the request
+func MakeBatchDeliveryServiceEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.BatchDeliveryServiceRequest)
+		if len(req.Items) == 0 {
+			return nil, &apperr.Error{Code: apperr.CodeValidation, Message: "batch has no items",
+				Fields: []apperr.FieldError{{Field: "items", Rule: "required"}}}
+		}
+		if maxItems := viper.GetInt("delivery.maxBatchSize"); maxItems > 0 && len(req.Items) > maxItems {
+			return nil, &apperr.Error{Code: apperr.CodeValidation, Message: fmt.Sprintf("batch has %d items, the maximum is %d", len(req.Items), maxItems),
+				Fields: []apperr.FieldError{{Field: "items", Rule: "max", Param: strconv.Itoa(maxItems)}}}
+		}
+
+		res := &model.BatchDeliveryServiceResponse{Items: make([]*model.BatchDeliveryItemResponse, len(req.Items))}
+		reqs := make([]*model.DeliveryServiceRequest, len(req.Items))
+		for i := range req.Items {
+			item := &req.Items[i]
+			res.Items[i] = &model.BatchDeliveryItemResponse{CorrelationID: item.CorrelationID}
+			if err := validateRequest(item); err != nil {
+				res.Items[i].Error = err.(*apperr.Error)
+				continue
+			}
+			reqs[i] = &item.DeliveryServiceRequest
+		}
+
+		campaigns, err := target.BatchDeliveryService(ctx, reqs)
+		if err != nil {
+			return nil, err
+		}
+		for i, c := range campaigns {
+			if reqs[i] != nil {
+				res.Items[i].Campaigns = c
+			}
+		}
+		return res, nil
+	}
+}
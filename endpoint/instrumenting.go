@@ -0,0 +1,132 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"targetad/pkg/apperr"
+	"targetad/pkg/openrtb"
+	"targetad/pkg/target/model"
+	"targetad/pkg/vast"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the delivery metrics, every one of them is labelled with the endpoint name given to InstrumentingMiddleware.
+// fill rate = rate(targetad_delivery_filled_total) / rate(targetad_delivery_responses_total)
+var (
+	requestCount = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "delivery", Name: "requests_total",
+		Help: "Number of delivery requests by outcome, ok or the error code.",
+	}, []string{"endpoint", "outcome"})
+	requestLatency = kitprometheus.NewHistogramFrom(prometheus.HistogramOpts{
+		Namespace: "targetad", Subsystem: "delivery", Name: "request_duration_seconds",
+		Help:    "Time spent in the delivery endpoint.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"endpoint", "outcome"})
+	validationFailures = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "delivery", Name: "validation_failures_total",
+		Help: "Number of invalid fields in delivery requests.",
+	}, []string{"endpoint", "field"})
+	responseCount = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "delivery", Name: "responses_total",
+		Help: "Number of answered delivery requests, batch items count one by one.",
+	}, []string{"endpoint"})
+	filledCount = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "delivery", Name: "filled_total",
+		Help: "Number of answered delivery requests with at least one campaign.",
+	}, []string{"endpoint"})
+	campaignsReturned = kitprometheus.NewHistogramFrom(prometheus.HistogramOpts{
+		Namespace: "targetad", Subsystem: "delivery", Name: "campaigns_returned",
+		Help:    "Number of campaigns in a delivery response.",
+		Buckets: []float64{0, 1, 2, 3, 5, 10, 20, 50},
+	}, []string{"endpoint"})
+)
+
+// Instrument wraps a delivery endpoint with the logging and the instrumenting middleware
+func Instrument(l log.Logger, name string, e endpoint.Endpoint) endpoint.Endpoint {
+	return InstrumentingMiddleware(name)(LoggingMiddleware(l, name)(e))
+}
+
+// InstrumentingMiddleware records the rate, latency, validation failures, fill and number of campaigns of a delivery endpoint.
+// name becomes the endpoint label so http, grpc, batch, vast and openrtb can be told apart
+func InstrumentingMiddleware(name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			defer func(begin time.Time) {
+				observeRequest(name, err, time.Since(begin))
+				if err == nil {
+					observeResponse(name, response)
+				}
+			}(time.Now())
+			return next(ctx, request)
+		}
+	}
+}
+
+// ObserveDecodeFailure records a request which the transport rejected before it reached the endpoint, e.g. an
+// unsupported Content-Type or a malformed body, so that the request rate and the validation failures include it
+func ObserveDecodeFailure(name string, err error, took time.Duration) {
+	observeRequest(name, err, took)
+}
+
+// observeRequest records the outcome and the latency of a request and the fields which failed its validation
+func observeRequest(name string, err error, took time.Duration) {
+	outcome := "ok"
+	var appErr *apperr.Error
+	if errors.As(err, &appErr) {
+		outcome = string(appErr.Code)
+		countValidationFailures(validationFailures.With("endpoint", name), appErr)
+	} else if err != nil {
+		outcome = string(apperr.CodeInternal)
+	}
+	requestCount.With("endpoint", name, "outcome", outcome).Add(1)
+	requestLatency.With("endpoint", name, "outcome", outcome).Observe(took.Seconds())
+}
+
+// observeResponse records the fill and the number of campaigns of every answered request
+func observeResponse(name string, response interface{}) {
+	observe := func(n int) {
+		responseCount.With("endpoint", name).Add(1)
+		if n > 0 {
+			filledCount.With("endpoint", name).Add(1)
+		}
+		campaignsReturned.With("endpoint", name).Observe(float64(n))
+	}
+	switch res := response.(type) {
+	case []*model.DeliveryServiceResponse:
+		observe(len(res))
+	case *vast.VAST:
+		observe(len(res.Ads))
+	case *openrtb.BidResponse:
+		n := 0
+		if res != nil {
+			for _, seat := range res.SeatBid {
+				n += len(seat.Bid)
+			}
+		}
+		observe(n)
+	case *model.BatchDeliveryServiceResponse:
+		for _, item := range res.Items {
+			if item.Error != nil {
+				countValidationFailures(validationFailures.With("endpoint", name), item.Error)
+				continue
+			}
+			observe(len(item.Campaigns))
+		}
+	}
+}
+
+func countValidationFailures(c metrics.Counter, err *apperr.Error) {
+	if err.Code != apperr.CodeValidation {
+		return
+	}
+	for _, f := range err.Fields {
+		c.With("field", f.Field).Add(1)
+	}
+}
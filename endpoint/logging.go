@@ -0,0 +1,34 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"targetad/pkg/apperr"
+	"targetad/pkg/logger"
+	"targetad/pkg/tracing"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// LoggingMiddleware writes one line per request with the outcome and the time it took. the lines go through the
+// request logger derived from l, so they carry the request id and are sampled. errors caused by the server are
+// logged as warnings, which are never sampled away
+func LoggingMiddleware(l log.Logger, name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			defer func(begin time.Time) {
+				line := level.Info(logger.FromContext(ctx, l))
+				var appErr *apperr.Error
+				if err != nil && (!errors.As(err, &appErr) || appErr.StatusCode() >= 500) {
+					line = level.Warn(logger.FromContext(ctx, l))
+				}
+				line.Log("msg", "request served", "endpoint", name, "took", time.Since(begin), "trace_id", tracing.TraceID(ctx), "err", err)
+			}(time.Now())
+			return next(ctx, request)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package endpoint
+
+import (
+	"context"
+	"targetad/pkg/openrtb"
+	"targetad/pkg/target"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/spf13/viper"
+)
+
+// MakeOpenRTBEndpoint runs the normal targeting for an openrtb bid request. a nil *openrtb.BidResponse means no bid.
+// a bid request without app bundle, os or country can not match any campaign so it is a no bid and not an error
+func MakeOpenRTBEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		bidReq := request.(openrtb.BidRequest)
+		if err := validateRequest(bidReq); err != nil {
+			return nil, err
+		}
+
+		req := openrtb.ToDeliveryRequest(&bidReq)
+		if err := validate.Struct(req); err != nil {
+			return (*openrtb.BidResponse)(nil), nil
+		}
+		campaigns, err := target.DeliveryService(ctx, &req)
+		if err != nil {
+			return nil, err
+		}
+		return openrtb.NewBidResponse(&bidReq, campaigns, openrtb.BidConfig{
+			Seat:     viper.GetString("openrtb.seat"),
+			Price:    viper.GetFloat64("openrtb.bidPrice"),
+			Currency: viper.GetString("openrtb.currency"),
+		}), nil
+	}
+}
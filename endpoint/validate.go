@@ -0,0 +1,61 @@
+package endpoint
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"targetad/pkg/apperr"
+	"targetad/pkg/vast"
+
+	validator "github.com/go-playground/validator/v10"
+)
+
+// validate is shared by all the endpoints, the validator caches the struct metadata and is safe for concurrent use
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	// report the json names of the fields so that the errors match what the client sent
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return f.Name
+		}
+		return name
+	})
+	// the id of a redis stream entry, <milliseconds>-<sequence>
+	v.RegisterValidation("stream_id", func(fl validator.FieldLevel) bool {
+		return streamIDPattern.MatchString(fl.Field().String())
+	})
+	// the linear events of the vast tracking urls
+	v.RegisterValidation("vast_event", func(fl validator.FieldLevel) bool {
+		return vast.IsTrackingEvent(fl.Field().String())
+	})
+	return v
+}
+
+var streamIDPattern = regexp.MustCompile(`^[0-9]+-[0-9]+$`)
+
+// validateRequest validates the request and turns the validator errors into a typed validation error listing every field and rule
+func validateRequest(req interface{}) error {
+	err := validate.Struct(req)
+	if err == nil {
+		return nil
+	}
+	return newValidationError(err)
+}
+
+func newValidationError(err error) *apperr.Error {
+	appErr := apperr.Wrap(apperr.CodeValidation, "request validation failed", err)
+	var fieldErrs validator.ValidationErrors
+	if errors.As(err, &fieldErrs) {
+		for _, fe := range fieldErrs {
+			appErr.Fields = append(appErr.Fields, apperr.FieldError{Field: fe.Field(), Rule: fe.Tag(), Param: fe.Param()})
+		}
+	}
+	return appErr
+}
@@ -0,0 +1,53 @@
+package endpoint
+
+import (
+	"context"
+	"targetad/pkg/target"
+	"targetad/pkg/target/model"
+	"targetad/pkg/vast"
+
+	"github.com/go-kit/kit/endpoint"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// trackingCount counts the calls to the tracking urls of our vast documents, event is impression or the linear event
+var trackingCount = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+	Namespace: "targetad", Subsystem: "vast", Name: "tracking_events_total",
+	Help: "Number of impression and linear event calls from video players.",
+}, []string{"event"})
+
+// MakeVideoDeliveryEndpoint runs the targeting for video players and answers with a VAST document of the matched video campaigns
+func MakeVideoDeliveryEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.DeliveryServiceRequest)
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		campaigns, err := target.VideoDeliveryService(ctx, &req)
+		if err != nil {
+			return nil, err
+		}
+		return vast.New(campaigns, vast.Config{
+			AdSystem:        viper.GetString("vast.adSystem"),
+			TrackingBaseURL: viper.GetString("vast.trackingBaseUrl"),
+		}), nil
+	}
+}
+
+// MakeVASTTrackingEndpoint records an impression or a linear event reported by a video player
+func MakeVASTTrackingEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(vast.TrackingRequest)
+		if err := validateRequest(req); err != nil {
+			return nil, err
+		}
+		event := req.Event
+		if req.Kind == "impression" {
+			event = req.Kind
+		}
+		trackingCount.With("event", event).Add(1)
+		return nil, nil
+	}
+}
@@ -2,15 +2,29 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"net"
 	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"targetad/pb"
+	"targetad/pkg/auth"
 	dbpkg "targetad/pkg/db"
+	"targetad/pkg/health"
+	"targetad/pkg/leader"
+	"targetad/pkg/logger"
 	"targetad/pkg/redisstream"
 	"targetad/pkg/target"
+	"targetad/pkg/tracing"
 	"targetad/transport"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
+	"google.golang.org/grpc"
 )
 
 func main() {
@@ -22,47 +36,223 @@ func main() {
 	err := viper.ReadInConfig()
 	if err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			log.Println("there is a error in the path of config file", err)
+			level.Error(logger.Get()).Log("msg", "there is a error in the path of config file", "err", err)
 		} else {
-			log.Println("error laoding config file from viper", err)
+			level.Error(logger.Get()).Log("msg", "error loading config file from viper", "err", err)
 		}
 	}
 
+	viper.SetDefault("log.sampleRate", 1)
+	var logCfg logger.Config
+	if err := viper.UnmarshalKey("log", &logCfg); err != nil {
+		level.Error(logger.Get()).Log("msg", "error reading log config", "err", err)
+		return
+	}
+	l, err := logger.New(logCfg)
+	if err != nil {
+		level.Error(logger.Get()).Log("msg", "error initializing logger", "err", err)
+		return
+	}
+
+	viper.SetDefault("tracing.sampleRatio", 1)
+	var traceCfg tracing.Config
+	if err := viper.UnmarshalKey("tracing", &traceCfg); err != nil {
+		level.Error(l).Log("msg", "error reading tracing config", "err", err)
+		return
+	}
+	shutdownTracing, err := tracing.Init(context.Background(), traceCfg)
+	if err != nil {
+		level.Error(l).Log("msg", "error initializing tracing", "err", err)
+		return
+	}
+
 	err = godotenv.Load(viper.GetString("app.env"))
 	if err != nil {
-		log.Println("there is a error loading environment variables", err)
+		level.Error(l).Log("msg", "there is a error loading environment variables", "err", err)
 		return
 	}
 
-	conn, err := dbpkg.InitDB()
+	conn, err := dbpkg.InitDB(l)
 	if err != nil {
-		log.Println("error initializing database connection", err)
+		level.Error(l).Log("msg", "error initializing database connection", "err", err)
 		return
 	}
 
 	if conn == nil {
-		log.Println("database connection is nil")
+		level.Error(l).Log("msg", "database connection is nil")
 		return
 	}
 
-	ctx := context.Background()
+	err = auth.InitAuth(l)
+	if err != nil {
+		level.Error(l).Log("msg", "error initializing admin api authentication", "err", err)
+		return
+	}
 
-	target.InitCache(ctx)
-	err = redisstream.InitRedis(viper.GetString("redis.address"))
+	// ctx is cancelled on SIGTERM/SIGINT, stop() restores the default behaviour so a second signal kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	// workerCtx is cancelled only after the servers are drained, the stream consumers keep the cache fresh until then
+	workerCtx, cancelWorkers := context.WithCancel(context.Background())
+	defer cancelWorkers()
+
+	viper.SetDefault("leader.lockKey", 7412)
+	viper.SetDefault("leader.retryInterval", 2)
+	viper.SetDefault("leader.checkTimeout", 5)
+	viper.SetDefault("reconcile.interval", 300)
+	viper.SetDefault("reconcile.mode", target.ReconcileModeRebuild)
+	viper.SetDefault("outbox.pollInterval", 5)
+	viper.SetDefault("outbox.batchSize", 100)
+	viper.SetDefault("outbox.retryBackoff", 1)
+	viper.SetDefault("outbox.retryBackoffMax", 30)
+	viper.SetDefault("redis.mode", redisstream.RedisModeStandalone)
+	viper.SetDefault("redis.redisStream.groupCleanupInterval", 60)
+	viper.SetDefault("redis.redisStream.groupIdleTimeout", 600)
+	viper.SetDefault("redis.redisStream.recovery.interval", 30)
+	viper.SetDefault("redis.redisStream.recovery.claimMinIdle", 60)
+	viper.SetDefault("redis.redisStream.recovery.retryBackoff", 5)
+	viper.SetDefault("redis.redisStream.recovery.retryBackoffMax", 60)
+	viper.SetDefault("redis.redisStream.recovery.batchSize", 100)
+	viper.SetDefault("redis.redisStream.deadLetter.streamName", "targeted_ads_dead_letter")
+	viper.SetDefault("redis.redisStream.deadLetter.maxAttempts", 5)
+	err = redisstream.InitRedis(l)
 	if err != nil {
-		log.Println("error initializing redis connection", err)
+		level.Error(l).Log("msg", "error initializing redis connection", "err", err)
+		dbpkg.CloseDB()
 		return
 	}
-	// not all microservices need to listen for new data in pgsql and push it to redis stream
-	// the others will just listen to the redis stream for new data and update its cache
+
+	// the stream position is taken before the snapshot, every change the snapshot may miss comes after it
+	// and is replayed by the consumer group. see InitConsumerGroup
+	offset, err := redisstream.StreamOffset(ctx)
+	if err != nil {
+		level.Error(l).Log("msg", "error reading the stream offset", "err", err)
+		dbpkg.CloseDB()
+		redisstream.CloseRedis()
+		return
+	}
+	// serving with an empty cache would answer every request with no campaigns, so a failed load stops the instance
+	if _, err := target.InitCache(ctx, l, offset); err != nil {
+		level.Error(l).Log("msg", "error loading the targeting cache", "err", err)
+		dbpkg.CloseDB()
+		redisstream.CloseRedis()
+		return
+	}
+	if err := redisstream.InitConsumerGroup(ctx, offset); err != nil {
+		level.Error(l).Log("msg", "error initializing the stream consumer group", "err", err)
+		dbpkg.CloseDB()
+		redisstream.CloseRedis()
+		return
+	}
+
+	health.Register("cache", target.CheckCache)
+	health.Register("postgres", dbpkg.Ping)
+	health.Register("redis", redisstream.Ping)
+	health.Register("stream_consumer", redisstream.CheckConsumer)
+	health.Register("stream_lag", redisstream.CheckLag)
+
+	// the grpc transport serves the same delivery endpoint next to the http one on its own port. the port is taken
+	// before the workers start, a failure only has the connections to close like the other startup failures
+	lis, err := net.Listen("tcp", viper.GetString("grpc.address"))
+	if err != nil {
+		level.Error(l).Log("msg", "error listening on the grpc address", "err", err)
+		dbpkg.CloseDB()
+		redisstream.CloseRedis()
+		return
+	}
+
+	var workers sync.WaitGroup
+	// one instance listens for new data in pgsql and pushes it to the redis stream, it is elected among the
+	// instances with app.isNotifyableMicroservice. the others just listen to the redis stream and update their cache
 	if viper.GetBool("app.isNotifyableMicroservice") {
-		log.Println("this is a notifyable microservice, listening for new data in pgsql")
-		go redisstream.ListenForNewDataInPgsql(ctx)
+		level.Info(l).Log("msg", "this is a notifyable microservice, campaigning for the pgsql listener")
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			leader.Run(workerCtx, l, redisstream.InstanceID(), redisstream.ListenForNewDataInPgsql)
+		}()
+	}
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		redisstream.StartRedisStreamListener(workerCtx)
+	}()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		target.StartReconciler(workerCtx)
+	}()
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterDeliveryServiceServer(grpcServer, transport.NewGRPCServer(l))
+	go func() {
+		level.Info(l).Log("msg", "grpc server listening", "addr", lis.Addr())
+		if err := grpcServer.Serve(lis); err != nil {
+			level.Error(l).Log("msg", "grpc server stopped", "err", err)
+		}
+	}()
+
+	httpServer := &http.Server{Addr: viper.GetString("http.address"), Handler: transport.NewHTTPHandler(l)}
+	go func() {
+		level.Info(l).Log("msg", "http server listening", "addr", httpServer.Addr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			level.Error(l).Log("msg", "http server stopped", "err", err)
+			stop() // nothing left to serve, shut the rest down as well
+		}
+	}()
+	health.SetReady(true)
+
+	<-ctx.Done()
+	stop()
+	shutdown(l, httpServer, grpcServer, &workers, cancelWorkers, shutdownTracing)
+}
+
+// shutdown stops the instance in order: flip readiness so the load balancer stops sending traffic, drain the
+// in flight http and grpc requests, stop the pgsql listener and the stream consumers (the message being processed
+// is still acked) and finally close redis and the pgsql pool. everything after the readiness flip shares one deadline
+func shutdown(l log.Logger, httpServer *http.Server, grpcServer *grpc.Server, workers *sync.WaitGroup, cancelWorkers context.CancelFunc, shutdownTracing func(context.Context) error) {
+	level.Info(l).Log("msg", "shutdown signal received, marking the instance as not ready")
+	health.SetReady(false)
+	time.Sleep(time.Duration(viper.GetInt("shutdown.readinessGracePeriod")) * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(viper.GetInt("shutdown.timeout"))*time.Second)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		level.Error(l).Log("msg", "error draining http requests", "err", err)
+	}
+	grpcStopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(grpcStopped)
+	}()
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		level.Warn(l).Log("msg", "deadline reached while draining grpc requests, closing the remaining streams")
+		grpcServer.Stop()
 	}
 
-	go redisstream.StartRedisStreamListener(ctx)
-	handler := transport.NewHTTPHandler()
-	log.Fatal(http.ListenAndServe(":9090", handler))
+	cancelWorkers()
+	workersStopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(workersStopped)
+	}()
+	select {
+	case <-workersStopped:
+	case <-ctx.Done():
+		level.Warn(l).Log("msg", "deadline reached while waiting for the stream consumers")
+	}
 
-	// select {}
+	if err := redisstream.CloseRedis(); err != nil {
+		level.Error(l).Log("msg", "error closing redis client", "err", err)
+	}
+	dbpkg.CloseDB()
+	// last, so the spans of the drained requests and stream messages are flushed as well
+	if err := shutdownTracing(ctx); err != nil {
+		level.Error(l).Log("msg", "error flushing traces", "err", err)
+	}
+	level.Info(l).Log("msg", "shutdown complete")
 }
@@ -0,0 +1,45 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the admin api soft deletes campaigns (is_deleted = true) instead of deleting the row, so the notification
+-- has to carry the is_deleted flag of the row itself otherwise the workers would never drop it from their cache
+CREATE OR REPLACE FUNCTION notify_change_with_id() RETURNS TRIGGER AS $$
+DECLARE
+    row_id TEXT;
+    is_deleted BOOLEAN;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_id := OLD.id::TEXT;
+        is_deleted := TRUE;
+    ELSE
+        row_id := NEW.id::TEXT;
+        is_deleted := NEW.is_deleted;
+    END IF;
+
+    PERFORM pg_notify('table_changes', TG_TABLE_NAME || ':' || row_id || ':' || is_deleted::TEXT);
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_change_with_id() RETURNS TRIGGER AS $$
+DECLARE
+    row_id TEXT;
+    is_deleted BOOLEAN;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_id := OLD.id::TEXT;
+        is_deleted := TRUE;
+    ELSE
+        row_id := NEW.id::TEXT;
+        is_deleted := FALSE;
+    END IF;
+
+    PERFORM pg_notify('table_changes', TG_TABLE_NAME || ':' || row_id || ':' || is_deleted::TEXT);
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
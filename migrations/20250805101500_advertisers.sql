@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS advertisers (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    is_paused BOOLEAN NOT NULL DEFAULT FALSE, -- true pauses every campaign of the advertiser at once
+    max_campaigns_per_response INTEGER NOT NULL DEFAULT 0, -- max campaigns of this advertiser in one delivery response, 0 for no cap
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_by TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_by TEXT NOT NULL,
+    is_deleted BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+-- every existing campaign is moved under a default advertiser so that advertiser_id can be NOT NULL
+INSERT INTO advertisers (id, name, created_by, updated_by) VALUES
+('d3ef0122-f304-4b66-8c77-9ee2ef313d44', 'default', 'admin', 'admin');
+
+ALTER TABLE campaigns ADD COLUMN advertiser_id uuid REFERENCES advertisers(id);
+UPDATE campaigns SET advertiser_id = 'd3ef0122-f304-4b66-8c77-9ee2ef313d44';
+ALTER TABLE campaigns ALTER COLUMN advertiser_id SET NOT NULL;
+CREATE INDEX IF NOT EXISTS campaigns_advertiser_id_idx ON campaigns (advertiser_id);
+
+CREATE TRIGGER advertisers_change_notify
+AFTER INSERT OR UPDATE OR DELETE ON advertisers
+FOR EACH ROW
+EXECUTE FUNCTION notify_change_with_id();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop trigger if exists advertisers_change_notify on advertisers;
+drop index if exists campaigns_advertiser_id_idx;
+alter table campaigns drop column if exists advertiser_id;
+drop table if exists advertisers;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+-- activity_status could not tell a draft from a paused or a completed campaign, so it is replaced by a status
+-- draft -> pending_review -> active <-> paused -> completed/archived. the allowed transitions are enforced by the admin api
+ALTER TABLE campaigns ADD COLUMN status TEXT NOT NULL DEFAULT 'draft'
+    CHECK (status IN ('draft', 'pending_review', 'active', 'paused', 'completed', 'archived'));
+UPDATE campaigns SET status = CASE WHEN activity_status THEN 'active' ELSE 'paused' END;
+ALTER TABLE campaigns DROP COLUMN activity_status;
+
+CREATE TABLE IF NOT EXISTS campaign_status_transitions (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    campaigns_id uuid NOT NULL REFERENCES campaigns(id),
+    from_status TEXT NOT NULL,
+    to_status TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_by TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS campaign_status_transitions_campaigns_id_idx ON campaign_status_transitions (campaigns_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists campaign_status_transitions;
+alter table campaigns add column activity_status BOOLEAN NOT NULL DEFAULT TRUE;
+update campaigns set activity_status = (status = 'active');
+alter table campaigns drop column if exists status;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- video campaigns carry their assets as json: {"duration": 15, "click_through": "...", "media_files": [{"url": "...", "mime_type": "video/mp4", "width": 1280, "height": 720}]}
+-- the assets live on the campaign row so the existing campaigns trigger keeps the cache up to date
+ALTER TABLE campaigns
+    ADD COLUMN media_type TEXT NOT NULL DEFAULT 'banner' CHECK (media_type IN ('banner', 'video')),
+    ADD COLUMN video JSONB,
+    ADD CONSTRAINT campaigns_video_assets_check CHECK (media_type <> 'video' OR video IS NOT NULL);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table campaigns drop constraint if exists campaigns_video_assets_check;
+alter table campaigns drop column if exists video;
+alter table campaigns drop column if exists media_type;
+-- +goose StatementEnd
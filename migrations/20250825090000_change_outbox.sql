@@ -0,0 +1,59 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTIFY is fire and forget, a change which could not be pushed to the redis stream (redis down, no listener
+-- connected) was lost for good. the trigger now also writes every change into the outbox in the same transaction,
+-- the notification only wakes the listener up. the listener pushes the outbox rows to the stream in id order and
+-- deletes a row only once it is in the stream
+CREATE TABLE IF NOT EXISTS change_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    table_name TEXT NOT NULL,
+    row_id TEXT NOT NULL,
+    is_deleted BOOLEAN NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    attempts INTEGER NOT NULL DEFAULT 0, -- failed pushes to the stream
+    last_error TEXT
+);
+
+CREATE OR REPLACE FUNCTION notify_change_with_id() RETURNS TRIGGER AS $$
+DECLARE
+    row_id TEXT;
+    is_deleted BOOLEAN;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_id := OLD.id::TEXT;
+        is_deleted := TRUE;
+    ELSE
+        row_id := NEW.id::TEXT;
+        is_deleted := NEW.is_deleted;
+    END IF;
+
+    INSERT INTO change_outbox (table_name, row_id, is_deleted) VALUES (TG_TABLE_NAME, row_id, is_deleted);
+    PERFORM pg_notify('table_changes', TG_TABLE_NAME || ':' || row_id || ':' || is_deleted::TEXT);
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_change_with_id() RETURNS TRIGGER AS $$
+DECLARE
+    row_id TEXT;
+    is_deleted BOOLEAN;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_id := OLD.id::TEXT;
+        is_deleted := TRUE;
+    ELSE
+        row_id := NEW.id::TEXT;
+        is_deleted := NEW.is_deleted;
+    END IF;
+
+    PERFORM pg_notify('table_changes', TG_TABLE_NAME || ':' || row_id || ':' || is_deleted::TEXT);
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+drop table if exists change_outbox;
+-- +goose StatementEnd
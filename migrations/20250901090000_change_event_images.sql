@@ -0,0 +1,70 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the outbox carried only table, id and is_deleted, so every worker had to read the row back from pgsql and a hard
+-- deleted row could not be cleaned out of the indexes. the trigger now also keeps the operation, the row images
+-- before and after the change and where the change comes from: the transaction id and the wal position at the time
+-- the row was written (not the commit lsn, it is not known inside the transaction). rows written before this
+-- migration have no images and go out as version 1 messages
+ALTER TABLE change_outbox
+    ADD COLUMN operation TEXT CHECK (operation IN ('insert', 'update', 'delete')),
+    ADD COLUMN old_row JSONB,
+    ADD COLUMN new_row JSONB,
+    ADD COLUMN txid BIGINT,
+    ADD COLUMN lsn PG_LSN;
+
+CREATE OR REPLACE FUNCTION notify_change_with_id() RETURNS TRIGGER AS $$
+DECLARE
+    row_id TEXT;
+    is_deleted BOOLEAN;
+    old_row JSONB;
+    new_row JSONB;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_id := OLD.id::TEXT;
+        is_deleted := TRUE;
+    ELSE
+        row_id := NEW.id::TEXT;
+        is_deleted := NEW.is_deleted;
+        new_row := to_jsonb(NEW);
+    END IF;
+    IF TG_OP <> 'INSERT' THEN
+        old_row := to_jsonb(OLD);
+    END IF;
+
+    INSERT INTO change_outbox (table_name, row_id, is_deleted, operation, old_row, new_row, txid, lsn)
+    VALUES (TG_TABLE_NAME, row_id, is_deleted, lower(TG_OP), old_row, new_row, txid_current(), pg_current_wal_lsn());
+    PERFORM pg_notify('table_changes', TG_TABLE_NAME || ':' || row_id || ':' || is_deleted::TEXT);
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_change_with_id() RETURNS TRIGGER AS $$
+DECLARE
+    row_id TEXT;
+    is_deleted BOOLEAN;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_id := OLD.id::TEXT;
+        is_deleted := TRUE;
+    ELSE
+        row_id := NEW.id::TEXT;
+        is_deleted := NEW.is_deleted;
+    END IF;
+
+    INSERT INTO change_outbox (table_name, row_id, is_deleted) VALUES (TG_TABLE_NAME, row_id, is_deleted);
+    PERFORM pg_notify('table_changes', TG_TABLE_NAME || ':' || row_id || ':' || is_deleted::TEXT);
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+alter table change_outbox
+    drop column if exists lsn,
+    drop column if exists txid,
+    drop column if exists new_row,
+    drop column if exists old_row,
+    drop column if exists operation;
+-- +goose StatementEnd
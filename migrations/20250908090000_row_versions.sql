@@ -0,0 +1,43 @@
+-- +goose Up
+-- +goose StatementBegin
+-- every row carries a version which is incremented by each update, the workers keep it in the cache and drop a
+-- change which is not newer than what they have. updated_at is not used for this, it is set by the writer and two
+-- updates can share a timestamp. the before trigger runs ahead of the notify trigger, so the row image in the
+-- outbox carries the new version
+ALTER TABLE campaigns ADD COLUMN row_version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE targeting_rules ADD COLUMN row_version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE advertisers ADD COLUMN row_version BIGINT NOT NULL DEFAULT 1;
+
+CREATE OR REPLACE FUNCTION bump_row_version() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.row_version := OLD.row_version + 1;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER campaigns_bump_row_version
+BEFORE UPDATE ON campaigns
+FOR EACH ROW
+EXECUTE FUNCTION bump_row_version();
+
+CREATE TRIGGER targeting_rules_bump_row_version
+BEFORE UPDATE ON targeting_rules
+FOR EACH ROW
+EXECUTE FUNCTION bump_row_version();
+
+CREATE TRIGGER advertisers_bump_row_version
+BEFORE UPDATE ON advertisers
+FOR EACH ROW
+EXECUTE FUNCTION bump_row_version();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop trigger if exists advertisers_bump_row_version on advertisers;
+drop trigger if exists targeting_rules_bump_row_version on targeting_rules;
+drop trigger if exists campaigns_bump_row_version on campaigns;
+drop function if exists bump_row_version;
+alter table advertisers drop column if exists row_version;
+alter table targeting_rules drop column if exists row_version;
+alter table campaigns drop column if exists row_version;
+-- +goose StatementEnd
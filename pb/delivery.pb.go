@@ -0,0 +1,260 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: pb/delivery.proto
+
+// delivery.proto is the grpc/protobuf contract of the delivery service.
+// the fields mirror the json api of /v1/delivery so both transports serve the same targeting logic.
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type DeliveryRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	App           string                 `protobuf:"bytes,1,opt,name=app,proto3" json:"app,omitempty"`
+	Os            string                 `protobuf:"bytes,2,opt,name=os,proto3" json:"os,omitempty"`
+	Country       string                 `protobuf:"bytes,3,opt,name=country,proto3" json:"country,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeliveryRequest) Reset() {
+	*x = DeliveryRequest{}
+	mi := &file_pb_delivery_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeliveryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeliveryRequest) ProtoMessage() {}
+
+func (x *DeliveryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_delivery_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeliveryRequest.ProtoReflect.Descriptor instead.
+func (*DeliveryRequest) Descriptor() ([]byte, []int) {
+	return file_pb_delivery_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *DeliveryRequest) GetApp() string {
+	if x != nil {
+		return x.App
+	}
+	return ""
+}
+
+func (x *DeliveryRequest) GetOs() string {
+	if x != nil {
+		return x.Os
+	}
+	return ""
+}
+
+func (x *DeliveryRequest) GetCountry() string {
+	if x != nil {
+		return x.Country
+	}
+	return ""
+}
+
+type Campaign struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Cid           string                 `protobuf:"bytes,1,opt,name=cid,proto3" json:"cid,omitempty"`
+	Img           string                 `protobuf:"bytes,2,opt,name=img,proto3" json:"img,omitempty"`
+	Cta           string                 `protobuf:"bytes,3,opt,name=cta,proto3" json:"cta,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Campaign) Reset() {
+	*x = Campaign{}
+	mi := &file_pb_delivery_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Campaign) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Campaign) ProtoMessage() {}
+
+func (x *Campaign) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_delivery_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Campaign.ProtoReflect.Descriptor instead.
+func (*Campaign) Descriptor() ([]byte, []int) {
+	return file_pb_delivery_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Campaign) GetCid() string {
+	if x != nil {
+		return x.Cid
+	}
+	return ""
+}
+
+func (x *Campaign) GetImg() string {
+	if x != nil {
+		return x.Img
+	}
+	return ""
+}
+
+func (x *Campaign) GetCta() string {
+	if x != nil {
+		return x.Cta
+	}
+	return ""
+}
+
+type DeliveryResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Campaigns     []*Campaign            `protobuf:"bytes,1,rep,name=campaigns,proto3" json:"campaigns,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeliveryResponse) Reset() {
+	*x = DeliveryResponse{}
+	mi := &file_pb_delivery_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeliveryResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeliveryResponse) ProtoMessage() {}
+
+func (x *DeliveryResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_delivery_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeliveryResponse.ProtoReflect.Descriptor instead.
+func (*DeliveryResponse) Descriptor() ([]byte, []int) {
+	return file_pb_delivery_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DeliveryResponse) GetCampaigns() []*Campaign {
+	if x != nil {
+		return x.Campaigns
+	}
+	return nil
+}
+
+var File_pb_delivery_proto protoreflect.FileDescriptor
+
+const file_pb_delivery_proto_rawDesc = "" +
+	"\n" +
+	"\x11pb/delivery.proto\x12\vtargetad.v1\"M\n" +
+	"\x0fDeliveryRequest\x12\x10\n" +
+	"\x03app\x18\x01 \x01(\tR\x03app\x12\x0e\n" +
+	"\x02os\x18\x02 \x01(\tR\x02os\x12\x18\n" +
+	"\acountry\x18\x03 \x01(\tR\acountry\"@\n" +
+	"\bCampaign\x12\x10\n" +
+	"\x03cid\x18\x01 \x01(\tR\x03cid\x12\x10\n" +
+	"\x03img\x18\x02 \x01(\tR\x03img\x12\x10\n" +
+	"\x03cta\x18\x03 \x01(\tR\x03cta\"G\n" +
+	"\x10DeliveryResponse\x123\n" +
+	"\tcampaigns\x18\x01 \x03(\v2\x15.targetad.v1.CampaignR\tcampaigns2Z\n" +
+	"\x0fDeliveryService\x12G\n" +
+	"\bDelivery\x12\x1c.targetad.v1.DeliveryRequest\x1a\x1d.targetad.v1.DeliveryResponseB\rZ\vtargetad/pbb\x06proto3"
+
+var (
+	file_pb_delivery_proto_rawDescOnce sync.Once
+	file_pb_delivery_proto_rawDescData []byte
+)
+
+func file_pb_delivery_proto_rawDescGZIP() []byte {
+	file_pb_delivery_proto_rawDescOnce.Do(func() {
+		file_pb_delivery_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_pb_delivery_proto_rawDesc), len(file_pb_delivery_proto_rawDesc)))
+	})
+	return file_pb_delivery_proto_rawDescData
+}
+
+var file_pb_delivery_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_pb_delivery_proto_goTypes = []any{
+	(*DeliveryRequest)(nil),  // 0: targetad.v1.DeliveryRequest
+	(*Campaign)(nil),         // 1: targetad.v1.Campaign
+	(*DeliveryResponse)(nil), // 2: targetad.v1.DeliveryResponse
+}
+var file_pb_delivery_proto_depIdxs = []int32{
+	1, // 0: targetad.v1.DeliveryResponse.campaigns:type_name -> targetad.v1.Campaign
+	0, // 1: targetad.v1.DeliveryService.Delivery:input_type -> targetad.v1.DeliveryRequest
+	2, // 2: targetad.v1.DeliveryService.Delivery:output_type -> targetad.v1.DeliveryResponse
+	2, // [2:3] is the sub-list for method output_type
+	1, // [1:2] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_pb_delivery_proto_init() }
+func file_pb_delivery_proto_init() {
+	if File_pb_delivery_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pb_delivery_proto_rawDesc), len(file_pb_delivery_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_pb_delivery_proto_goTypes,
+		DependencyIndexes: file_pb_delivery_proto_depIdxs,
+		MessageInfos:      file_pb_delivery_proto_msgTypes,
+	}.Build()
+	File_pb_delivery_proto = out.File
+	file_pb_delivery_proto_goTypes = nil
+	file_pb_delivery_proto_depIdxs = nil
+}
@@ -0,0 +1,185 @@
+package admin
+
+// admin.go contains the campaign management logic used by the admin apis. every write goes straight to pgsql,
+// the pgsql trigger + redis stream then takes care of updating the cache of all the workers.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"targetad/pkg/admin/model"
+	"targetad/pkg/apperr"
+	"targetad/pkg/auth"
+	dbpkg "targetad/pkg/db"
+	targetmodel "targetad/pkg/target/model"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrCampaignNotFound = apperr.New(apperr.CodeNotFound, "campaign not found")
+
+// ListCampaignsService returns the campaigns which are not deleted. callers bound to an advertiser only see their own campaigns,
+// platform operators see everything unless they filter by advertiser
+func ListCampaignsService(ctx context.Context, principal *auth.Principal, req *model.ListCampaignsRequest) ([]*model.CampaignResponse, error) {
+	conn := dbpkg.GetConn()
+	if conn == nil {
+		return nil, errors.New("database connection is nil")
+	}
+
+	advertiserID, err := resolveAdvertiser(principal, req.AdvertiserID)
+	if err != nil {
+		return nil, err
+	}
+	var campaigns []dbpkg.Campaign
+	if advertiserID == uuid.Nil {
+		campaigns, err = conn.ListAllValidCampaigns(ctx)
+	} else {
+		campaigns, err = conn.ListValidCampaignsByAdvertiser(ctx, advertiserID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*model.CampaignResponse, 0, len(campaigns))
+	for _, campaign := range campaigns {
+		res = append(res, toCampaignResponse(campaign))
+	}
+	return res, nil
+}
+
+// CreateCampaignService creates a new draft campaign under the callers advertiser. the caller becomes the created_by and updated_by of the row
+func CreateCampaignService(ctx context.Context, principal *auth.Principal, req *model.CreateCampaignRequest) (*model.CampaignResponse, error) {
+	conn := dbpkg.GetConn()
+	if conn == nil {
+		return nil, errors.New("database connection is nil")
+	}
+
+	advertiserID, err := resolveAdvertiser(principal, req.AdvertiserID)
+	if err != nil {
+		return nil, err
+	}
+	if advertiserID == uuid.Nil {
+		return nil, ErrAdvertiserRequired
+	}
+	if _, err := conn.GetAdvertiserByID(ctx, advertiserID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrAdvertiserNotFound
+		}
+		return nil, err
+	}
+
+	mediaType := req.MediaType
+	if mediaType == "" {
+		mediaType = string(targetmodel.MediaTypeBanner)
+	}
+	var video []byte
+	if req.Video != nil {
+		if video, err = json.Marshal(req.Video); err != nil {
+			return nil, err
+		}
+	}
+
+	campaign, err := conn.CreateCampaign(ctx, dbpkg.CreateCampaignParams{
+		CampaignStringID: req.CampaignStringID,
+		Name:             req.Name,
+		ImageUrl:         req.ImageUrl,
+		Cta:              req.CTA,
+		CreatedBy:        principal.Subject,
+		AdvertiserID:     advertiserID,
+		MediaType:        mediaType,
+		Video:            video,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toCampaignResponse(campaign), nil
+}
+
+// DeleteCampaignService soft deletes the campaign, the caller is recorded as updated_by
+func DeleteCampaignService(ctx context.Context, principal *auth.Principal, id uuid.UUID) error {
+	conn := dbpkg.GetConn()
+	if conn == nil {
+		return errors.New("database connection is nil")
+	}
+
+	if _, err := getCampaignForPrincipal(ctx, conn, principal, id); err != nil {
+		return err
+	}
+
+	n, err := conn.SoftDeleteCampaign(ctx, id, principal.Subject)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCampaignNotFound
+	}
+	return nil
+}
+
+// CreateTargetingRuleService adds a new targeting rule to an existing campaign
+func CreateTargetingRuleService(ctx context.Context, principal *auth.Principal, req *model.CreateTargetingRuleRequest) (*model.TargetingRuleResponse, error) {
+	conn := dbpkg.GetConn()
+	if conn == nil {
+		return nil, errors.New("database connection is nil")
+	}
+
+	campaignID := uuid.MustParse(req.CampaignID) // already validated as uuid by the endpoint
+	// there is no foreign key between the 2 tables so I am checking it here
+	if _, err := getCampaignForPrincipal(ctx, conn, principal, campaignID); err != nil {
+		return nil, err
+	}
+
+	rule, err := conn.CreateTargetingRule(ctx, dbpkg.CreateTargetingRuleParams{
+		CampaignsID: campaignID,
+		IsIncluded:  req.IsIncluded,
+		Category:    req.Category,
+		Value:       req.Value,
+		CreatedBy:   principal.Subject,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &model.TargetingRuleResponse{
+		ID:         uuid.UUID(rule.ID.Bytes).String(),
+		CampaignID: uuid.UUID(rule.CampaignsID.Bytes).String(),
+		IsIncluded: rule.IsIncluded,
+		Category:   rule.Category,
+		Value:      rule.Value,
+		CreatedAt:  rule.CreatedAt.Time,
+		CreatedBy:  rule.CreatedBy,
+	}, nil
+}
+
+// getCampaignForPrincipal fetches the campaign and makes sure it belongs to the callers advertiser.
+// campaigns of other advertisers are reported as not found so that their ids do not leak
+func getCampaignForPrincipal(ctx context.Context, conn *dbpkg.Dbconn, principal *auth.Principal, id uuid.UUID) (dbpkg.Campaign, error) {
+	campaign, err := conn.GetCampaignByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return campaign, ErrCampaignNotFound
+		}
+		return campaign, err
+	}
+	if !canAccess(principal, campaign.AdvertiserID.Bytes) {
+		return campaign, ErrCampaignNotFound
+	}
+	return campaign, nil
+}
+
+func toCampaignResponse(campaign dbpkg.Campaign) *model.CampaignResponse {
+	return &model.CampaignResponse{
+		ID:               uuid.UUID(campaign.ID.Bytes).String(),
+		AdvertiserID:     uuid.UUID(campaign.AdvertiserID.Bytes).String(),
+		CampaignStringID: campaign.CampaignStringID,
+		Name:             campaign.Name,
+		Image:            campaign.ImageUrl,
+		Cta:              campaign.Cta,
+		Status:           campaign.Status,
+		MediaType:        campaign.MediaType,
+		Video:            campaign.Video,
+		CreatedAt:        campaign.CreatedAt.Time,
+		CreatedBy:        campaign.CreatedBy,
+		UpdatedAt:        campaign.UpdatedAt.Time,
+		UpdatedBy:        campaign.UpdatedBy,
+	}
+}
@@ -0,0 +1,135 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"targetad/pkg/admin/model"
+	"targetad/pkg/apperr"
+	"targetad/pkg/auth"
+	dbpkg "targetad/pkg/db"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrAdvertiserNotFound = apperr.New(apperr.CodeNotFound, "advertiser not found")
+	ErrAdvertiserRequired = &apperr.Error{Code: apperr.CodeValidation, Message: "advertiser_id is required",
+		Fields: []apperr.FieldError{{Field: "advertiser_id", Rule: "required"}}}
+)
+
+// ListAdvertisersService returns every advertiser for platform operators and only the callers own advertiser otherwise
+func ListAdvertisersService(ctx context.Context, principal *auth.Principal) ([]*model.AdvertiserResponse, error) {
+	conn := dbpkg.GetConn()
+	if conn == nil {
+		return nil, errors.New("database connection is nil")
+	}
+
+	if !principal.IsPlatform() {
+		advertiser, err := conn.GetAdvertiserByID(ctx, principal.AdvertiserID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return []*model.AdvertiserResponse{}, nil
+			}
+			return nil, err
+		}
+		return []*model.AdvertiserResponse{toAdvertiserResponse(advertiser)}, nil
+	}
+
+	advertisers, err := conn.ListAllValidAdvertisers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*model.AdvertiserResponse, 0, len(advertisers))
+	for _, advertiser := range advertisers {
+		res = append(res, toAdvertiserResponse(advertiser))
+	}
+	return res, nil
+}
+
+// CreateAdvertiserService creates a new advertiser. only platform operators can onboard advertisers
+func CreateAdvertiserService(ctx context.Context, principal *auth.Principal, req *model.CreateAdvertiserRequest) (*model.AdvertiserResponse, error) {
+	if !principal.IsPlatform() {
+		return nil, auth.ErrForbidden
+	}
+	conn := dbpkg.GetConn()
+	if conn == nil {
+		return nil, errors.New("database connection is nil")
+	}
+
+	advertiser, err := conn.CreateAdvertiser(ctx, dbpkg.CreateAdvertiserParams{
+		Name:                    req.Name,
+		IsPaused:                req.IsPaused,
+		MaxCampaignsPerResponse: req.MaxCampaignsPerResponse,
+		CreatedBy:               principal.Subject,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toAdvertiserResponse(advertiser), nil
+}
+
+// UpdateAdvertiserControlsService pauses/resumes all the campaigns of an advertiser and sets the per response cap.
+// the change reaches the workers through the advertisers trigger like any other row change
+func UpdateAdvertiserControlsService(ctx context.Context, principal *auth.Principal, req *model.UpdateAdvertiserControlsRequest) (*model.AdvertiserResponse, error) {
+	conn := dbpkg.GetConn()
+	if conn == nil {
+		return nil, errors.New("database connection is nil")
+	}
+
+	id := uuid.MustParse(req.ID) // already validated as uuid by the endpoint
+	if !canAccess(principal, id) {
+		return nil, ErrAdvertiserNotFound
+	}
+	advertiser, err := conn.UpdateAdvertiserControls(ctx, dbpkg.UpdateAdvertiserControlsParams{
+		ID:                      id,
+		IsPaused:                req.IsPaused,
+		MaxCampaignsPerResponse: req.MaxCampaignsPerResponse,
+		UpdatedBy:               principal.Subject,
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrAdvertiserNotFound
+		}
+		return nil, err
+	}
+	return toAdvertiserResponse(advertiser), nil
+}
+
+// resolveAdvertiser returns the advertiser a request acts on. callers bound to an advertiser can only act on their own one,
+// platform operators can pick any advertiser and get uuid.Nil back when they did not ask for one
+func resolveAdvertiser(principal *auth.Principal, requested string) (uuid.UUID, error) {
+	var id uuid.UUID
+	if requested != "" {
+		var err error
+		if id, err = uuid.Parse(requested); err != nil {
+			return uuid.Nil, &apperr.Error{Code: apperr.CodeValidation, Message: "invalid advertiser_id",
+				Fields: []apperr.FieldError{{Field: "advertiser_id", Rule: "uuid"}}}
+		}
+	}
+	if principal.IsPlatform() {
+		return id, nil
+	}
+	if id != uuid.Nil && id != principal.AdvertiserID {
+		return uuid.Nil, auth.ErrForbidden
+	}
+	return principal.AdvertiserID, nil
+}
+
+// canAccess reports whether the principal is allowed to see rows of the given advertiser
+func canAccess(principal *auth.Principal, advertiserID uuid.UUID) bool {
+	return principal.IsPlatform() || principal.AdvertiserID == advertiserID
+}
+
+func toAdvertiserResponse(advertiser dbpkg.Advertiser) *model.AdvertiserResponse {
+	return &model.AdvertiserResponse{
+		ID:                      uuid.UUID(advertiser.ID.Bytes).String(),
+		Name:                    advertiser.Name,
+		IsPaused:                advertiser.IsPaused,
+		MaxCampaignsPerResponse: advertiser.MaxCampaignsPerResponse,
+		CreatedAt:               advertiser.CreatedAt.Time,
+		CreatedBy:               advertiser.CreatedBy,
+		UpdatedAt:               advertiser.UpdatedAt.Time,
+		UpdatedBy:               advertiser.UpdatedBy,
+	}
+}
@@ -0,0 +1,114 @@
+package admin
+
+// lifecycle.go contains the campaign status state machine.
+// draft -> pending_review -> active <-> paused -> completed/archived
+// a campaign under review can also be sent back to draft and a completed campaign can still be archived.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"targetad/pkg/admin/model"
+	"targetad/pkg/apperr"
+	"targetad/pkg/auth"
+	dbpkg "targetad/pkg/db"
+	targetmodel "targetad/pkg/target/model"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var campaignTransitions = map[targetmodel.CampaignStatus][]targetmodel.CampaignStatus{
+	targetmodel.CampaignStatusDraft:         {targetmodel.CampaignStatusPendingReview},
+	targetmodel.CampaignStatusPendingReview: {targetmodel.CampaignStatusActive, targetmodel.CampaignStatusDraft},
+	targetmodel.CampaignStatusActive:        {targetmodel.CampaignStatusPaused, targetmodel.CampaignStatusCompleted, targetmodel.CampaignStatusArchived},
+	targetmodel.CampaignStatusPaused:        {targetmodel.CampaignStatusActive, targetmodel.CampaignStatusCompleted, targetmodel.CampaignStatusArchived},
+	targetmodel.CampaignStatusCompleted:     {targetmodel.CampaignStatusArchived},
+	targetmodel.CampaignStatusArchived:      {},
+}
+
+// ErrStatusConflict is returned when the campaign status changed between reading it and applying the transition
+var ErrStatusConflict = apperr.New(apperr.CodeConflict, "campaign status was changed concurrently, retry the transition")
+
+// transitionError is returned when the requested transition is not allowed by the state machine
+func transitionError(from, to targetmodel.CampaignStatus) *apperr.Error {
+	return apperr.New(apperr.CodeConflict, fmt.Sprintf("campaign status cannot change from %s to %s", from, to))
+}
+
+// CanTransition reports whether a campaign can move from one status to another
+func CanTransition(from, to targetmodel.CampaignStatus) bool {
+	for _, next := range campaignTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionCampaignStatusService validates the transition against the state machine and applies it.
+// the update and the transition record are written in one statement so the history never misses a change
+func TransitionCampaignStatusService(ctx context.Context, principal *auth.Principal, req *model.TransitionCampaignStatusRequest) (*model.CampaignTransitionResponse, error) {
+	conn := dbpkg.GetConn()
+	if conn == nil {
+		return nil, errors.New("database connection is nil")
+	}
+
+	id := uuid.MustParse(req.ID) // already validated as uuid by the endpoint
+	campaign, err := getCampaignForPrincipal(ctx, conn, principal, id)
+	if err != nil {
+		return nil, err
+	}
+	from, to := targetmodel.CampaignStatus(campaign.Status), targetmodel.CampaignStatus(req.Status)
+	if !CanTransition(from, to) {
+		return nil, transitionError(from, to)
+	}
+
+	transition, err := conn.TransitionCampaignStatus(ctx, dbpkg.TransitionCampaignStatusParams{
+		CampaignsID: id,
+		FromStatus:  string(from),
+		ToStatus:    string(to),
+		Reason:      req.Reason,
+		CreatedBy:   principal.Subject,
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrStatusConflict
+		}
+		return nil, err
+	}
+	return toTransitionResponse(transition), nil
+}
+
+// ListCampaignTransitionsService returns the status history of a campaign, oldest first
+func ListCampaignTransitionsService(ctx context.Context, principal *auth.Principal, req *model.ListCampaignTransitionsRequest) ([]*model.CampaignTransitionResponse, error) {
+	conn := dbpkg.GetConn()
+	if conn == nil {
+		return nil, errors.New("database connection is nil")
+	}
+
+	id := uuid.MustParse(req.ID) // already validated as uuid by the endpoint
+	if _, err := getCampaignForPrincipal(ctx, conn, principal, id); err != nil {
+		return nil, err
+	}
+	transitions, err := conn.ListCampaignStatusTransitions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*model.CampaignTransitionResponse, 0, len(transitions))
+	for _, transition := range transitions {
+		res = append(res, toTransitionResponse(transition))
+	}
+	return res, nil
+}
+
+func toTransitionResponse(transition dbpkg.CampaignStatusTransition) *model.CampaignTransitionResponse {
+	return &model.CampaignTransitionResponse{
+		ID:         uuid.UUID(transition.ID.Bytes).String(),
+		CampaignID: uuid.UUID(transition.CampaignsID.Bytes).String(),
+		FromStatus: transition.FromStatus,
+		ToStatus:   transition.ToStatus,
+		Reason:     transition.Reason,
+		CreatedAt:  transition.CreatedAt.Time,
+		CreatedBy:  transition.CreatedBy,
+	}
+}
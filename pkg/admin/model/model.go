@@ -0,0 +1,126 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	targetmodel "targetad/pkg/target/model"
+)
+
+type ListCampaignsRequest struct {
+	AdvertiserID string `json:"advertiser_id" validate:"omitempty,uuid"`
+}
+
+type CreateCampaignRequest struct {
+	// callers scoped to an advertiser can leave it out, platform operators have to set it
+	AdvertiserID     string `json:"advertiser_id" validate:"omitempty,uuid"`
+	CampaignStringID string `json:"cid" validate:"required"`
+	Name             string `json:"name" validate:"required"`
+	ImageUrl         string `json:"img" validate:"required,url"`
+	CTA              string `json:"cta" validate:"required"`
+	MediaType        string `json:"media_type" validate:"omitempty,oneof=banner video"` // banner when left out
+	// required for video campaigns, not allowed for banners
+	Video *targetmodel.VideoAsset `json:"video,omitempty" validate:"required_if=MediaType video,excluded_unless=MediaType video"`
+}
+
+type DeleteCampaignRequest struct {
+	ID string `json:"id" validate:"required,uuid"`
+}
+
+// TransitionCampaignStatusRequest moves a campaign to a new lifecycle status, the reason is stored with the transition
+type TransitionCampaignStatusRequest struct {
+	ID     string `json:"id" validate:"required,uuid"`
+	Status string `json:"status" validate:"required,oneof=draft pending_review active paused completed archived"`
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+type ListCampaignTransitionsRequest struct {
+	ID string `json:"id" validate:"required,uuid"`
+}
+
+type CampaignTransitionResponse struct {
+	ID         string    `json:"id"`
+	CampaignID string    `json:"campaign_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+	CreatedBy  string    `json:"created_by"`
+}
+
+type CreateTargetingRuleRequest struct {
+	CampaignID string `json:"campaign_id" validate:"required,uuid"`
+	IsIncluded bool   `json:"is_included"`
+	Category   int32  `json:"category" validate:"required,oneof=1 2 3"` // 1 for appID, 2 for Country, 3 for OS
+	Value      string `json:"value" validate:"required"`
+}
+
+type CampaignResponse struct {
+	ID               string          `json:"id"`
+	AdvertiserID     string          `json:"advertiser_id"`
+	CampaignStringID string          `json:"cid"`
+	Name             string          `json:"name"`
+	Image            string          `json:"img"`
+	Cta              string          `json:"cta"`
+	Status           string          `json:"status"`
+	MediaType        string          `json:"media_type"`
+	Video            json.RawMessage `json:"video,omitempty"` // raw so the stored json goes out as it is
+	CreatedAt        time.Time       `json:"created_at"`
+	CreatedBy        string          `json:"created_by"`
+	UpdatedAt        time.Time       `json:"updated_at"`
+	UpdatedBy        string          `json:"updated_by"`
+}
+
+type TargetingRuleResponse struct {
+	ID         string    `json:"id"`
+	CampaignID string    `json:"campaign_id"`
+	IsIncluded bool      `json:"is_included"`
+	Category   int32     `json:"category"`
+	Value      string    `json:"value"`
+	CreatedAt  time.Time `json:"created_at"`
+	CreatedBy  string    `json:"created_by"`
+}
+
+type CreateAdvertiserRequest struct {
+	Name                    string `json:"name" validate:"required"`
+	IsPaused                bool   `json:"is_paused"`
+	MaxCampaignsPerResponse int32  `json:"max_campaigns_per_response" validate:"min=0"` // 0 for no cap
+}
+
+type UpdateAdvertiserControlsRequest struct {
+	ID                      string `json:"id" validate:"required,uuid"`
+	IsPaused                bool   `json:"is_paused"`
+	MaxCampaignsPerResponse int32  `json:"max_campaigns_per_response" validate:"min=0"` // 0 for no cap
+}
+
+type AdvertiserResponse struct {
+	ID                      string    `json:"id"`
+	Name                    string    `json:"name"`
+	IsPaused                bool      `json:"is_paused"`
+	MaxCampaignsPerResponse int32     `json:"max_campaigns_per_response"`
+	CreatedAt               time.Time `json:"created_at"`
+	CreatedBy               string    `json:"created_by"`
+	UpdatedAt               time.Time `json:"updated_at"`
+	UpdatedBy               string    `json:"updated_by"`
+}
+
+// CacheIndexRequest selects one key of a cache index, e.g. include_country/US
+type CacheIndexRequest struct {
+	Index string `json:"index" validate:"required,oneof=include_app include_os include_country exclude_country"`
+	Key   string `json:"key" validate:"required"`
+}
+
+type CachedCampaignRequest struct {
+	ID string `json:"id" validate:"required,uuid"`
+}
+
+// ListDeadLettersRequest pages through the dead-letter stream, after is the next of the previous page
+type ListDeadLettersRequest struct {
+	After string `json:"after" validate:"omitempty,stream_id"`
+	Limit int64  `json:"limit" validate:"min=1,max=1000"`
+}
+
+// DeadLetterRequest selects one dead letter by its id in the dead-letter stream
+type DeadLetterRequest struct {
+	ID string `json:"id" validate:"required,stream_id"`
+}
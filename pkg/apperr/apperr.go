@@ -0,0 +1,74 @@
+package apperr
+
+// apperr.go contains the typed errors shared by the endpoints and the services. every error carries a stable
+// code which clients can switch on, the transports turn the code into the http status or the grpc status code.
+
+import "net/http"
+
+type Code string
+
+const (
+	CodeValidation           Code = "validation_failed"      // the request decoded fine but some fields are invalid
+	CodeMalformedRequest     Code = "malformed_request"      // the body could not be decoded
+	CodeUnsupportedMediaType Code = "unsupported_media_type" // the Content-Type is not supported by the endpoint
+	CodeNotAcceptable        Code = "not_acceptable"         // none of the Accept media types can be produced
+	CodeUnauthenticated      Code = "unauthenticated"
+	CodeForbidden            Code = "forbidden"
+	CodeNotFound             Code = "not_found"
+	CodeConflict             Code = "conflict"
+	CodeInternal             Code = "internal_error"
+	CodeUnavailable          Code = "service_unavailable"
+)
+
+var statusCodes = map[Code]int{
+	CodeValidation:           http.StatusBadRequest,
+	CodeMalformedRequest:     http.StatusBadRequest,
+	CodeUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	CodeNotAcceptable:        http.StatusNotAcceptable,
+	CodeUnauthenticated:      http.StatusUnauthorized,
+	CodeForbidden:            http.StatusForbidden,
+	CodeNotFound:             http.StatusNotFound,
+	CodeConflict:             http.StatusConflict,
+	CodeInternal:             http.StatusInternalServerError,
+	CodeUnavailable:          http.StatusServiceUnavailable,
+}
+
+// FieldError describes one failed validation rule, Field is the json name of the field
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
+}
+
+type Error struct {
+	Code    Code         `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+	cause   error
+}
+
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Wrap keeps the underlying error for logging, it is never sent to the client
+func Wrap(code Code, message string, cause error) *Error {
+	return &Error{Code: code, Message: message, cause: cause}
+}
+
+func (e *Error) Error() string {
+	if e.cause != nil {
+		return e.Message + ": " + e.cause.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error { return e.cause }
+
+// StatusCode returns the http status for the error code, unknown codes are internal errors
+func (e *Error) StatusCode() int {
+	if code, ok := statusCodes[e.Code]; ok {
+		return code
+	}
+	return http.StatusInternalServerError
+}
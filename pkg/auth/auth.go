@@ -0,0 +1,260 @@
+package auth
+
+// auth.go contains the authentication and role based authorization logic for the admin apis.
+// callers can authenticate either with a static api key or with a HMAC signed JWT. Both of them are
+// verified against keys which are configured locally (config.json + .env), no external identity provider is involved.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"targetad/pkg/apperr"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+type Role int
+
+const (
+	RoleViewer Role = iota + 1 // read only access to the admin and reporting apis
+	RoleEditor                 // can create and update campaigns and targeting rules
+	RoleAdmin                  // can do everything including deletes
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleEditor:
+		return "editor"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+// ParseRole converts the role name used in the config and in the jwt claims into a Role
+func ParseRole(s string) (Role, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "viewer":
+		return RoleViewer, nil
+	case "editor":
+		return RoleEditor, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return 0, fmt.Errorf("unknown role: %q", s)
+}
+
+// Principal is the authenticated caller. Subject is what we write into created_by/updated_by columns.
+// AdvertiserID scopes the caller to a single advertiser, uuid.Nil means a platform operator who can see every advertiser
+type Principal struct {
+	Subject      string
+	Role         Role
+	AdvertiserID uuid.UUID
+}
+
+// IsPlatform reports whether the principal is not bound to an advertiser
+func (p *Principal) IsPlatform() bool {
+	return p.AdvertiserID == uuid.Nil
+}
+
+// Can reports whether the principal has at least the required role. roles are ordered viewer < editor < admin
+func (p *Principal) Can(required Role) bool {
+	return p != nil && p.Role >= required
+}
+
+// Credentials are the raw values extracted from the incoming request before they are verified
+type Credentials struct {
+	APIKey      string
+	BearerToken string
+}
+
+// Claims are the jwt claims we expect. role is mandatory, the subject comes from the standard sub claim.
+// adv is the advertiser the token is scoped to, it is left out for platform operators
+type Claims struct {
+	Role         string `json:"role"`
+	AdvertiserID string `json:"adv,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type APIKeyConfig struct {
+	Subject string `mapstructure:"subject"`
+	Role    string `mapstructure:"role"`
+	KeyEnv  string `mapstructure:"keyEnv"` // name of the env variable holding the actual key
+	// advertiser the key is scoped to, empty for platform operators
+	AdvertiserID string `mapstructure:"advertiserId"`
+}
+
+type JWTKeyConfig struct {
+	Kid       string `mapstructure:"kid"`
+	SecretEnv string `mapstructure:"secretEnv"` // name of the env variable holding the hmac secret
+}
+
+type Config struct {
+	APIKeys []APIKeyConfig `mapstructure:"apiKeys"`
+	JWT     struct {
+		Issuer string         `mapstructure:"issuer"`
+		Keys   []JWTKeyConfig `mapstructure:"keys"`
+	} `mapstructure:"jwt"`
+}
+
+type keyStore struct {
+	apiKeys   map[string]Principal // sha256(api key) -> principal, so the raw keys are not kept in memory
+	jwtKeys   map[string][]byte    // kid -> hmac secret
+	jwtIssuer string
+}
+
+var (
+	storeMutex sync.RWMutex
+	store      = &keyStore{apiKeys: map[string]Principal{}, jwtKeys: map[string][]byte{}}
+)
+
+// InitAuth loads the api keys and the jwt hmac secrets. the config only holds the names of the env variables
+// so that the secrets themselves never land in config.json
+func InitAuth(l log.Logger) error {
+	l = log.With(l, "component", "auth")
+	var cfg Config
+	if err := viper.UnmarshalKey("auth", &cfg); err != nil {
+		return fmt.Errorf("error reading auth config: %w", err)
+	}
+
+	s := &keyStore{apiKeys: map[string]Principal{}, jwtKeys: map[string][]byte{}, jwtIssuer: cfg.JWT.Issuer}
+	for _, k := range cfg.APIKeys {
+		role, err := ParseRole(k.Role)
+		if err != nil {
+			return fmt.Errorf("api key for %s: %w", k.Subject, err)
+		}
+		advertiserID, err := parseAdvertiserID(k.AdvertiserID)
+		if err != nil {
+			return fmt.Errorf("api key for %s: %w", k.Subject, err)
+		}
+		key := os.Getenv(k.KeyEnv)
+		if key == "" {
+			level.Warn(l).Log("msg", "api key env is not set, skipping it", "env", k.KeyEnv, "subject", k.Subject)
+			continue
+		}
+		s.apiKeys[hashKey(key)] = Principal{Subject: k.Subject, Role: role, AdvertiserID: advertiserID}
+	}
+	for _, k := range cfg.JWT.Keys {
+		secret := os.Getenv(k.SecretEnv)
+		if secret == "" {
+			level.Warn(l).Log("msg", "jwt secret env is not set, skipping it", "env", k.SecretEnv, "kid", k.Kid)
+			continue
+		}
+		s.jwtKeys[k.Kid] = []byte(secret)
+	}
+
+	storeMutex.Lock()
+	store = s
+	storeMutex.Unlock()
+	return nil
+}
+
+// Authenticate verifies the credentials and returns the principal behind them. api key wins if both are present
+func Authenticate(creds Credentials) (*Principal, error) {
+	storeMutex.RLock()
+	s := store
+	storeMutex.RUnlock()
+
+	if creds.APIKey != "" {
+		p, ok := s.apiKeys[hashKey(creds.APIKey)]
+		if !ok {
+			return nil, ErrUnauthenticated
+		}
+		return &p, nil
+	}
+	if creds.BearerToken != "" {
+		return s.verifyJWT(creds.BearerToken)
+	}
+	return nil, ErrUnauthenticated
+}
+
+func (s *keyStore) verifyJWT(token string) (*Principal, error) {
+	opts := []jwt.ParserOption{jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}), jwt.WithExpirationRequired()}
+	if s.jwtIssuer != "" {
+		opts = append(opts, jwt.WithIssuer(s.jwtIssuer))
+	}
+
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if secret, ok := s.jwtKeys[kid]; ok {
+			return secret, nil
+		}
+		// tokens without a kid are fine as long as we only have one key configured
+		if kid == "" && len(s.jwtKeys) == 1 {
+			for _, secret := range s.jwtKeys {
+				return secret, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}, opts...)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	role, err := ParseRole(claims.Role)
+	if err != nil || claims.Subject == "" {
+		return nil, ErrUnauthenticated
+	}
+	advertiserID, err := parseAdvertiserID(claims.AdvertiserID)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	return &Principal{Subject: claims.Subject, Role: role, AdvertiserID: advertiserID}, nil
+}
+
+func parseAdvertiserID(s string) (uuid.UUID, error) {
+	if s == "" {
+		return uuid.Nil, nil
+	}
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid advertiser id %q: %w", s, err)
+	}
+	return id, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type principalCtxKey struct{}
+type credentialsCtxKey struct{}
+
+// NewContext returns a copy of ctx carrying the authenticated principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalCtxKey{}, p)
+}
+
+// FromContext returns the authenticated principal, if any
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalCtxKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// WithCredentials stores the unverified credentials in the context so that they can be verified by the endpoint middleware
+func WithCredentials(ctx context.Context, creds Credentials) context.Context {
+	return context.WithValue(ctx, credentialsCtxKey{}, creds)
+}
+
+func CredentialsFromContext(ctx context.Context) Credentials {
+	creds, _ := ctx.Value(credentialsCtxKey{}).(Credentials)
+	return creds
+}
+
+// the transport answers these with 401/403, a 401 also gets the WWW-Authenticate header
+var (
+	ErrUnauthenticated = apperr.New(apperr.CodeUnauthenticated, "missing or invalid credentials")
+	ErrForbidden       = apperr.New(apperr.CodeForbidden, "insufficient role for this operation")
+)
@@ -8,12 +8,39 @@ type Campaign struct {
 	Name             string
 	ImageUrl         string
 	Cta              string
-	ActivityStatus   bool
+	Status           string
 	CreatedAt        pgtype.Timestamp
 	CreatedBy        string
 	UpdatedAt        pgtype.Timestamp
 	UpdatedBy        string
 	IsDeleted        bool
+	AdvertiserID     pgtype.UUID
+	MediaType        string
+	Video            []byte // jsonb, nil for banner campaigns
+	RowVersion       int64  // incremented by every update of the row
+}
+
+type Advertiser struct {
+	ID                      pgtype.UUID
+	Name                    string
+	IsPaused                bool
+	MaxCampaignsPerResponse int32
+	CreatedAt               pgtype.Timestamp
+	CreatedBy               string
+	UpdatedAt               pgtype.Timestamp
+	UpdatedBy               string
+	IsDeleted               bool
+	RowVersion              int64
+}
+
+type CampaignStatusTransition struct {
+	ID          pgtype.UUID
+	CampaignsID pgtype.UUID
+	FromStatus  string
+	ToStatus    string
+	Reason      string
+	CreatedAt   pgtype.Timestamp
+	CreatedBy   string
 }
 
 type TargetingRule struct {
@@ -27,13 +54,33 @@ type TargetingRule struct {
 	UpdatedAt   pgtype.Timestamp
 	UpdatedBy   string
 	IsDeleted   bool
+	RowVersion  int64
 }
 
 type ListValidTargetingRulesRow struct {
+	ID          pgtype.UUID
 	CampaignsID pgtype.UUID
 	IsIncluded  bool
 	Category    int32
 	Value       string
+	RowVersion  int64
+}
+
+// ChangeOutbox is a change written by the notify trigger which was not pushed to the redis stream yet
+type ChangeOutbox struct {
+	ID        int64
+	TableName string
+	RowID     string
+	IsDeleted bool
+	CreatedAt pgtype.Timestamp
+	Attempts  int32
+	LastError *string
+	// set by the trigger since the change_event_images migration, nil on older rows
+	Operation *string
+	OldRow    []byte // jsonb image of the row before the change, nil on insert
+	NewRow    []byte // jsonb image of the row after the change, nil on delete
+	TxID      *int64
+	LSN       *string
 }
 
 type PgsqlTableName string
@@ -41,4 +88,5 @@ type PgsqlTableName string
 const (
 	CampaignsTable      PgsqlTableName = "campaigns"
 	TargetingRulesTable PgsqlTableName = "targeting_rules"
+	AdvertisersTable    PgsqlTableName = "advertisers"
 )
@@ -5,13 +5,14 @@ package dbpkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-
 	"os"
 	"sync"
 	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
@@ -59,8 +60,9 @@ func LoadEnv() DBConfig {
 
 // InitDB initializes the database connection. using sync.Once to ensure it is only called once every other call will return the same instance
 // and will not reinitialize the connection.
-func InitDB() (*Dbconn, error) {
+func InitDB(l log.Logger) (*Dbconn, error) {
 	dbOnce.Do(func() {
+		l := log.With(l, "component", "db")
 		config := LoadEnv()
 
 		defaultDSN := fmt.Sprintf("postgres://%s:%s@%s:%s/postgres?sslmode=%s",
@@ -86,14 +88,12 @@ func InitDB() (*Dbconn, error) {
 		}
 
 		if !exists {
-			log.Printf("Database %s does not exist. Creating it...", config.Name)
+			level.Info(l).Log("msg", "database does not exist, creating it", "database", config.Name)
 			if err := createDatabase(ctx, conn, config.Name); err != nil {
-
 				dbErr = fmt.Errorf("failed to create database: %v", err)
-				log.Fatalf("Error creating database: %v", dbErr)
 				return
 			}
-			log.Println("Database created successfully!")
+			level.Info(l).Log("msg", "database created", "database", config.Name)
 		}
 
 		// Setup connection pool
@@ -115,7 +115,7 @@ func InitDB() (*Dbconn, error) {
 			return
 		}
 
-		log.Println("Connected to PostgreSQL database successfully.")
+		level.Info(l).Log("msg", "connected to postgres", "host", config.Host, "database", config.Name)
 		dbConn = &Dbconn{Db: pool, Config: config}
 	})
 
@@ -126,6 +126,21 @@ func GetConn() *Dbconn {
 	return dbConn
 }
 
+// Ping is the readiness check of the database, it acquires a pooled connection and pings the server
+func Ping(ctx context.Context) error {
+	if dbConn == nil || dbConn.Db == nil {
+		return errors.New("database connection is not initialized")
+	}
+	return dbConn.Db.Ping(ctx)
+}
+
+// CloseDB closes the connection pool, it waits for the acquired connections to be released
+func CloseDB() {
+	if dbConn != nil && dbConn.Db != nil {
+		dbConn.Db.Close()
+	}
+}
+
 func databaseExists(ctx context.Context, conn *pgx.Conn, name string) (bool, error) {
 	var exists bool
 	err := conn.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname=$1)", name).Scan(&exists)
@@ -4,10 +4,11 @@ import (
 	"context"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/pgtype"
 )
 
 const getCampaignByID = `-- name: GetCampaignByID :one
-SELECT id, campaign_string_id, name, image_url, cta, activity_status, created_at, created_by, updated_at, updated_by, is_deleted
+SELECT id, campaign_string_id, name, image_url, cta, status, created_at, created_by, updated_at, updated_by, is_deleted, advertiser_id, media_type, video, row_version
 FROM campaigns
 WHERE id= $1 AND is_deleted = false
 `
@@ -21,18 +22,22 @@ func (conn *Dbconn) GetCampaignByID(ctx context.Context, id uuid.UUID) (Campaign
 		&i.Name,
 		&i.ImageUrl,
 		&i.Cta,
-		&i.ActivityStatus,
+		&i.Status,
 		&i.CreatedAt,
 		&i.CreatedBy,
 		&i.UpdatedAt,
 		&i.UpdatedBy,
 		&i.IsDeleted,
+		&i.AdvertiserID,
+		&i.MediaType,
+		&i.Video,
+		&i.RowVersion,
 	)
 	return i, err
 }
 
 const getTargetRulesByID = `-- name: GetTargetRulesByID :one
-SELECT id, campaigns_id, is_included, category, value, created_at, created_by, updated_at, updated_by, is_deleted
+SELECT id, campaigns_id, is_included, category, value, created_at, created_by, updated_at, updated_by, is_deleted, row_version
 FROM targeting_rules
 WHERE id= $1 AND is_deleted = false
 `
@@ -51,12 +56,13 @@ func (conn *Dbconn) GetTargetRulesByID(ctx context.Context, id uuid.UUID) (Targe
 		&i.UpdatedAt,
 		&i.UpdatedBy,
 		&i.IsDeleted,
+		&i.RowVersion,
 	)
 	return i, err
 }
 
 const listAllValidCampaigns = `-- name: ListAllValidCampaigns :many
-SELECT id, campaign_string_id, name, image_url, cta, activity_status, created_at, created_by, updated_at, updated_by, is_deleted
+SELECT id, campaign_string_id, name, image_url, cta, status, created_at, created_by, updated_at, updated_by, is_deleted, advertiser_id, media_type, video, row_version
 FROM campaigns
 WHERE is_deleted = false
 `
@@ -76,12 +82,16 @@ func (conn *Dbconn) ListAllValidCampaigns(ctx context.Context) ([]Campaign, erro
 			&i.Name,
 			&i.ImageUrl,
 			&i.Cta,
-			&i.ActivityStatus,
+			&i.Status,
 			&i.CreatedAt,
 			&i.CreatedBy,
 			&i.UpdatedAt,
 			&i.UpdatedBy,
 			&i.IsDeleted,
+			&i.AdvertiserID,
+			&i.MediaType,
+			&i.Video,
+			&i.RowVersion,
 		); err != nil {
 			return nil, err
 		}
@@ -94,7 +104,7 @@ func (conn *Dbconn) ListAllValidCampaigns(ctx context.Context) ([]Campaign, erro
 }
 
 const listValidTargetingRules = `-- name: ListValidTargetingRules :many
-SELECT campaigns_id, is_included, category, value
+SELECT id, campaigns_id, is_included, category, value, row_version
 FROM targeting_rules
 WHERE is_deleted = false
 `
@@ -109,10 +119,414 @@ func (conn *Dbconn) ListValidTargetingRules(ctx context.Context) ([]ListValidTar
 	for rows.Next() {
 		var i ListValidTargetingRulesRow
 		if err := rows.Scan(
+			&i.ID,
+			&i.CampaignsID,
+			&i.IsIncluded,
+			&i.Category,
+			&i.Value,
+			&i.RowVersion,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getTargetRuleCampaignID = `-- name: GetTargetRuleCampaignID :one
+SELECT campaigns_id
+FROM targeting_rules
+WHERE id = $1
+`
+
+// GetTargetRuleCampaignID returns the campaign of a targeting rule, soft deleted rules included
+func (conn *Dbconn) GetTargetRuleCampaignID(ctx context.Context, id uuid.UUID) (pgtype.UUID, error) {
+	var campaignsID pgtype.UUID
+	err := conn.Db.QueryRow(ctx, getTargetRuleCampaignID, id).Scan(&campaignsID)
+	return campaignsID, err
+}
+
+const listValidTargetingRulesByCampaign = `-- name: ListValidTargetingRulesByCampaign :many
+SELECT id, campaigns_id, is_included, category, value, row_version
+FROM targeting_rules
+WHERE campaigns_id = $1 AND is_deleted = false
+`
+
+func (conn *Dbconn) ListValidTargetingRulesByCampaign(ctx context.Context, campaignsID uuid.UUID) ([]ListValidTargetingRulesRow, error) {
+	rows, err := conn.Db.Query(ctx, listValidTargetingRulesByCampaign, campaignsID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListValidTargetingRulesRow
+	for rows.Next() {
+		var i ListValidTargetingRulesRow
+		if err := rows.Scan(
+			&i.ID,
 			&i.CampaignsID,
 			&i.IsIncluded,
 			&i.Category,
 			&i.Value,
+			&i.RowVersion,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const createCampaign = `-- name: CreateCampaign :one
+INSERT INTO campaigns (campaign_string_id, name, image_url, cta, created_by, updated_by, advertiser_id, media_type, video)
+VALUES ($1, $2, $3, $4, $5, $5, $6, $7, $8)
+RETURNING id, campaign_string_id, name, image_url, cta, status, created_at, created_by, updated_at, updated_by, is_deleted, advertiser_id, media_type, video, row_version
+`
+
+type CreateCampaignParams struct {
+	CampaignStringID string
+	Name             string
+	ImageUrl         string
+	Cta              string
+	CreatedBy        string
+	AdvertiserID     uuid.UUID
+	MediaType        string
+	Video            []byte
+}
+
+func (conn *Dbconn) CreateCampaign(ctx context.Context, arg CreateCampaignParams) (Campaign, error) {
+	row := conn.Db.QueryRow(ctx, createCampaign,
+		arg.CampaignStringID,
+		arg.Name,
+		arg.ImageUrl,
+		arg.Cta,
+		arg.CreatedBy,
+		arg.AdvertiserID,
+		arg.MediaType,
+		arg.Video,
+	)
+	var i Campaign
+	err := row.Scan(
+		&i.ID,
+		&i.CampaignStringID,
+		&i.Name,
+		&i.ImageUrl,
+		&i.Cta,
+		&i.Status,
+		&i.CreatedAt,
+		&i.CreatedBy,
+		&i.UpdatedAt,
+		&i.UpdatedBy,
+		&i.IsDeleted,
+		&i.AdvertiserID,
+		&i.MediaType,
+		&i.Video,
+		&i.RowVersion,
+	)
+	return i, err
+}
+
+const softDeleteCampaign = `-- name: SoftDeleteCampaign :execrows
+UPDATE campaigns
+SET is_deleted = true, updated_by = $2, updated_at = CURRENT_TIMESTAMP
+WHERE id = $1 AND is_deleted = false
+`
+
+func (conn *Dbconn) SoftDeleteCampaign(ctx context.Context, id uuid.UUID, updatedBy string) (int64, error) {
+	result, err := conn.Db.Exec(ctx, softDeleteCampaign, id, updatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const createTargetingRule = `-- name: CreateTargetingRule :one
+INSERT INTO targeting_rules (campaigns_id, is_included, category, value, created_by, updated_by)
+VALUES ($1, $2, $3, $4, $5, $5)
+RETURNING id, campaigns_id, is_included, category, value, created_at, created_by, updated_at, updated_by, is_deleted, row_version
+`
+
+type CreateTargetingRuleParams struct {
+	CampaignsID uuid.UUID
+	IsIncluded  bool
+	Category    int32
+	Value       string
+	CreatedBy   string
+}
+
+func (conn *Dbconn) CreateTargetingRule(ctx context.Context, arg CreateTargetingRuleParams) (TargetingRule, error) {
+	row := conn.Db.QueryRow(ctx, createTargetingRule,
+		arg.CampaignsID,
+		arg.IsIncluded,
+		arg.Category,
+		arg.Value,
+		arg.CreatedBy,
+	)
+	var i TargetingRule
+	err := row.Scan(
+		&i.ID,
+		&i.CampaignsID,
+		&i.IsIncluded,
+		&i.Category,
+		&i.Value,
+		&i.CreatedAt,
+		&i.CreatedBy,
+		&i.UpdatedAt,
+		&i.UpdatedBy,
+		&i.IsDeleted,
+		&i.RowVersion,
+	)
+	return i, err
+}
+
+const listValidCampaignsByAdvertiser = `-- name: ListValidCampaignsByAdvertiser :many
+SELECT id, campaign_string_id, name, image_url, cta, status, created_at, created_by, updated_at, updated_by, is_deleted, advertiser_id, media_type, video, row_version
+FROM campaigns
+WHERE advertiser_id = $1 AND is_deleted = false
+`
+
+func (conn *Dbconn) ListValidCampaignsByAdvertiser(ctx context.Context, advertiserID uuid.UUID) ([]Campaign, error) {
+	rows, err := conn.Db.Query(ctx, listValidCampaignsByAdvertiser, advertiserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Campaign
+	for rows.Next() {
+		var i Campaign
+		if err := rows.Scan(
+			&i.ID,
+			&i.CampaignStringID,
+			&i.Name,
+			&i.ImageUrl,
+			&i.Cta,
+			&i.Status,
+			&i.CreatedAt,
+			&i.CreatedBy,
+			&i.UpdatedAt,
+			&i.UpdatedBy,
+			&i.IsDeleted,
+			&i.AdvertiserID,
+			&i.MediaType,
+			&i.Video,
+			&i.RowVersion,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getAdvertiserByID = `-- name: GetAdvertiserByID :one
+SELECT id, name, is_paused, max_campaigns_per_response, created_at, created_by, updated_at, updated_by, is_deleted, row_version
+FROM advertisers
+WHERE id = $1 AND is_deleted = false
+`
+
+func (conn *Dbconn) GetAdvertiserByID(ctx context.Context, id uuid.UUID) (Advertiser, error) {
+	row := conn.Db.QueryRow(ctx, getAdvertiserByID, id)
+	var i Advertiser
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.IsPaused,
+		&i.MaxCampaignsPerResponse,
+		&i.CreatedAt,
+		&i.CreatedBy,
+		&i.UpdatedAt,
+		&i.UpdatedBy,
+		&i.IsDeleted,
+		&i.RowVersion,
+	)
+	return i, err
+}
+
+const listAllValidAdvertisers = `-- name: ListAllValidAdvertisers :many
+SELECT id, name, is_paused, max_campaigns_per_response, created_at, created_by, updated_at, updated_by, is_deleted, row_version
+FROM advertisers
+WHERE is_deleted = false
+`
+
+func (conn *Dbconn) ListAllValidAdvertisers(ctx context.Context) ([]Advertiser, error) {
+	rows, err := conn.Db.Query(ctx, listAllValidAdvertisers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Advertiser
+	for rows.Next() {
+		var i Advertiser
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.IsPaused,
+			&i.MaxCampaignsPerResponse,
+			&i.CreatedAt,
+			&i.CreatedBy,
+			&i.UpdatedAt,
+			&i.UpdatedBy,
+			&i.IsDeleted,
+			&i.RowVersion,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const createAdvertiser = `-- name: CreateAdvertiser :one
+INSERT INTO advertisers (name, is_paused, max_campaigns_per_response, created_by, updated_by)
+VALUES ($1, $2, $3, $4, $4)
+RETURNING id, name, is_paused, max_campaigns_per_response, created_at, created_by, updated_at, updated_by, is_deleted, row_version
+`
+
+type CreateAdvertiserParams struct {
+	Name                    string
+	IsPaused                bool
+	MaxCampaignsPerResponse int32
+	CreatedBy               string
+}
+
+func (conn *Dbconn) CreateAdvertiser(ctx context.Context, arg CreateAdvertiserParams) (Advertiser, error) {
+	row := conn.Db.QueryRow(ctx, createAdvertiser,
+		arg.Name,
+		arg.IsPaused,
+		arg.MaxCampaignsPerResponse,
+		arg.CreatedBy,
+	)
+	var i Advertiser
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.IsPaused,
+		&i.MaxCampaignsPerResponse,
+		&i.CreatedAt,
+		&i.CreatedBy,
+		&i.UpdatedAt,
+		&i.UpdatedBy,
+		&i.IsDeleted,
+		&i.RowVersion,
+	)
+	return i, err
+}
+
+const updateAdvertiserControls = `-- name: UpdateAdvertiserControls :one
+UPDATE advertisers
+SET is_paused = $2, max_campaigns_per_response = $3, updated_by = $4, updated_at = CURRENT_TIMESTAMP
+WHERE id = $1 AND is_deleted = false
+RETURNING id, name, is_paused, max_campaigns_per_response, created_at, created_by, updated_at, updated_by, is_deleted, row_version
+`
+
+type UpdateAdvertiserControlsParams struct {
+	ID                      uuid.UUID
+	IsPaused                bool
+	MaxCampaignsPerResponse int32
+	UpdatedBy               string
+}
+
+func (conn *Dbconn) UpdateAdvertiserControls(ctx context.Context, arg UpdateAdvertiserControlsParams) (Advertiser, error) {
+	row := conn.Db.QueryRow(ctx, updateAdvertiserControls,
+		arg.ID,
+		arg.IsPaused,
+		arg.MaxCampaignsPerResponse,
+		arg.UpdatedBy,
+	)
+	var i Advertiser
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.IsPaused,
+		&i.MaxCampaignsPerResponse,
+		&i.CreatedAt,
+		&i.CreatedBy,
+		&i.UpdatedAt,
+		&i.UpdatedBy,
+		&i.IsDeleted,
+		&i.RowVersion,
+	)
+	return i, err
+}
+
+const transitionCampaignStatus = `-- name: TransitionCampaignStatus :one
+WITH updated AS (
+    UPDATE campaigns
+    SET status = $3, updated_by = $5, updated_at = CURRENT_TIMESTAMP
+    WHERE id = $1 AND status = $2 AND is_deleted = false
+    RETURNING id
+)
+INSERT INTO campaign_status_transitions (campaigns_id, from_status, to_status, reason, created_by)
+SELECT id, $2, $3, $4, $5 FROM updated
+RETURNING id, campaigns_id, from_status, to_status, reason, created_at, created_by
+`
+
+type TransitionCampaignStatusParams struct {
+	CampaignsID uuid.UUID
+	FromStatus  string
+	ToStatus    string
+	Reason      string
+	CreatedBy   string
+}
+
+// TransitionCampaignStatus moves the campaign from FromStatus to ToStatus and records the transition in one statement.
+// it returns pgx.ErrNoRows when the campaign is not in FromStatus anymore
+func (conn *Dbconn) TransitionCampaignStatus(ctx context.Context, arg TransitionCampaignStatusParams) (CampaignStatusTransition, error) {
+	row := conn.Db.QueryRow(ctx, transitionCampaignStatus,
+		arg.CampaignsID,
+		arg.FromStatus,
+		arg.ToStatus,
+		arg.Reason,
+		arg.CreatedBy,
+	)
+	var i CampaignStatusTransition
+	err := row.Scan(
+		&i.ID,
+		&i.CampaignsID,
+		&i.FromStatus,
+		&i.ToStatus,
+		&i.Reason,
+		&i.CreatedAt,
+		&i.CreatedBy,
+	)
+	return i, err
+}
+
+const listCampaignStatusTransitions = `-- name: ListCampaignStatusTransitions :many
+SELECT id, campaigns_id, from_status, to_status, reason, created_at, created_by
+FROM campaign_status_transitions
+WHERE campaigns_id = $1
+ORDER BY created_at, id
+`
+
+func (conn *Dbconn) ListCampaignStatusTransitions(ctx context.Context, campaignsID uuid.UUID) ([]CampaignStatusTransition, error) {
+	rows, err := conn.Db.Query(ctx, listCampaignStatusTransitions, campaignsID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CampaignStatusTransition
+	for rows.Next() {
+		var i CampaignStatusTransition
+		if err := rows.Scan(
+			&i.ID,
+			&i.CampaignsID,
+			&i.FromStatus,
+			&i.ToStatus,
+			&i.Reason,
+			&i.CreatedAt,
+			&i.CreatedBy,
 		); err != nil {
 			return nil, err
 		}
@@ -123,3 +537,75 @@ func (conn *Dbconn) ListValidTargetingRules(ctx context.Context) ([]ListValidTar
 	}
 	return items, nil
 }
+
+const listChangeOutbox = `-- name: ListChangeOutbox :many
+SELECT id, table_name, row_id, is_deleted, created_at, attempts, last_error, operation, old_row, new_row, txid, lsn::text
+FROM change_outbox
+ORDER BY id
+LIMIT $1
+`
+
+// ListChangeOutbox returns the oldest changes which were not pushed to the stream yet
+func (conn *Dbconn) ListChangeOutbox(ctx context.Context, limit int32) ([]ChangeOutbox, error) {
+	rows, err := conn.Db.Query(ctx, listChangeOutbox, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ChangeOutbox
+	for rows.Next() {
+		var i ChangeOutbox
+		if err := rows.Scan(
+			&i.ID,
+			&i.TableName,
+			&i.RowID,
+			&i.IsDeleted,
+			&i.CreatedAt,
+			&i.Attempts,
+			&i.LastError,
+			&i.Operation,
+			&i.OldRow,
+			&i.NewRow,
+			&i.TxID,
+			&i.LSN,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const deleteChangeOutbox = `-- name: DeleteChangeOutbox :exec
+DELETE FROM change_outbox
+WHERE id = $1
+`
+
+func (conn *Dbconn) DeleteChangeOutbox(ctx context.Context, id int64) error {
+	_, err := conn.Db.Exec(ctx, deleteChangeOutbox, id)
+	return err
+}
+
+const recordChangeOutboxFailure = `-- name: RecordChangeOutboxFailure :exec
+UPDATE change_outbox
+SET attempts = attempts + 1, last_error = $2
+WHERE id = $1
+`
+
+func (conn *Dbconn) RecordChangeOutboxFailure(ctx context.Context, id int64, lastError string) error {
+	_, err := conn.Db.Exec(ctx, recordChangeOutboxFailure, id, lastError)
+	return err
+}
+
+const countChangeOutbox = `-- name: CountChangeOutbox :one
+SELECT count(*) FROM change_outbox
+`
+
+func (conn *Dbconn) CountChangeOutbox(ctx context.Context) (int64, error) {
+	var count int64
+	err := conn.Db.QueryRow(ctx, countChangeOutbox).Scan(&count)
+	return count, err
+}
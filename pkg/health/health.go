@@ -0,0 +1,144 @@
+package health
+
+// health.go holds the liveness and readiness state of this instance. the load balancer polls /readyz and stops sending
+// traffic as soon as we flip to not ready, that is the first thing main does when it receives SIGTERM.
+// besides that flag every dependency registers a check (cache, postgres, redis, the stream consumer ...) and the
+// instance is only ready when all of them pass.
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ready atomic.Bool
+
+// SetReady marks the instance as ready (or not ready) to receive traffic
+func SetReady(v bool) {
+	ready.Store(v)
+}
+
+func IsReady() bool {
+	return ready.Load()
+}
+
+// CheckFunc reports whether one dependency is usable, a nil error means it is
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+var (
+	checksMutex sync.RWMutex
+	checks      []check
+)
+
+// Register adds a readiness check, registering a name again replaces the earlier check
+func Register(name string, fn CheckFunc) {
+	checksMutex.Lock()
+	defer checksMutex.Unlock()
+	for i := range checks {
+		if checks[i].name == name {
+			checks[i].fn = fn
+			return
+		}
+	}
+	checks = append(checks, check{name: name, fn: fn})
+}
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+type CheckResult struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+	Info   map[string]string      `json:"info,omitempty"` // facts about the instance which are not checks, e.g. the current leader
+}
+
+var (
+	infoMutex sync.RWMutex
+	info      = map[string]string{}
+)
+
+// SetInfo sets a fact shown in the readiness report, an empty value removes it
+func SetInfo(key, value string) {
+	infoMutex.Lock()
+	defer infoMutex.Unlock()
+	if value == "" {
+		delete(info, key)
+		return
+	}
+	info[key] = value
+}
+
+func snapshotInfo() map[string]string {
+	infoMutex.RLock()
+	defer infoMutex.RUnlock()
+	if len(info) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(info))
+	for k, v := range info {
+		res[k] = v
+	}
+	return res
+}
+
+// OK reports whether every check passed
+func (r *Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+var errNotServing = errors.New("instance is starting or shutting down")
+
+// Readiness runs every registered check in parallel, each one gets at most timeout.
+// the serving check reflects SetReady, so a draining instance is never reported ready
+func Readiness(ctx context.Context, timeout time.Duration) *Report {
+	checksMutex.RLock()
+	all := append([]check{{name: "serving", fn: func(context.Context) error {
+		if !IsReady() {
+			return errNotServing
+		}
+		return nil
+	}}}, checks...)
+	checksMutex.RUnlock()
+
+	results := make([]CheckResult, len(all))
+	var wg sync.WaitGroup
+	for i, c := range all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			begin := time.Now()
+			err := c.fn(ctx)
+			results[i] = CheckResult{Status: StatusOK, DurationMs: float64(time.Since(begin).Microseconds()) / 1000}
+			if err != nil {
+				results[i].Status, results[i].Error = StatusFail, err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := &Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(all)), Info: snapshotInfo()}
+	for i, c := range all {
+		report.Checks[c.name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
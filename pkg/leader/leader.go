@@ -0,0 +1,229 @@
+package leader
+
+// leader.go elects the one instance which listens for pgsql notifications and drains the change outbox. with none the
+// changes stop, with two every change is published twice. the election is a session level pgsql advisory lock taken
+// on the same connection the leader then uses for LISTEN: the lock lives exactly as long as that session, so when the
+// leader dies or loses its connection pgsql releases the lock and the next instance takes over within
+// leader.retryInterval seconds. the instance id is put into the application_name of the session, that is how the
+// other instances tell who the leader is.
+//
+// a half open connection does not fail on its own, the leader would go on publishing after pgsql released the lock
+// and another instance took over. the leader therefore checks its Lease before every drain: the session must answer
+// within leader.checkTimeout seconds and still hold the lock, otherwise the leadership is given up.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	dbpkg "targetad/pkg/db"
+	"targetad/pkg/health"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+const applicationNamePrefix = "targetad:"
+
+// ErrLeaseLost is returned by Lease.Check once the session no longer holds the leader lock
+var ErrLeaseLost = errors.New("leader lock lost")
+
+var isLeaderGauge = kitprometheus.NewGaugeFrom(prometheus.GaugeOpts{
+	Namespace: "targetad", Subsystem: "leader", Name: "is_leader",
+	Help: "1 while this instance holds the leader lock.",
+}, nil)
+
+var state struct {
+	sync.Mutex
+	isLeader bool
+	leader   string
+}
+
+// IsLeader reports whether this instance holds the leader lock
+func IsLeader() bool {
+	state.Lock()
+	defer state.Unlock()
+	return state.isLeader
+}
+
+// Leader returns the instance id of the current leader as last seen by this instance, empty when unknown
+func Leader() string {
+	state.Lock()
+	defer state.Unlock()
+	return state.leader
+}
+
+func setState(isLeader bool, leader string) {
+	state.Lock()
+	state.isLeader, state.leader = isLeader, leader
+	state.Unlock()
+	role := "follower"
+	if isLeader {
+		role = "leader"
+		isLeaderGauge.Set(1)
+	} else {
+		isLeaderGauge.Set(0)
+	}
+	health.SetInfo("role", role)
+	health.SetInfo("leader", leader)
+}
+
+// session is the pgsql session the leader lock is taken on
+type session interface {
+	tryLock(ctx context.Context, key int32) (bool, error)
+	holdsLock(ctx context.Context, key int32) (bool, error)
+	currentLeader(ctx context.Context, key int32) (string, error)
+	conn() *pgx.Conn
+	close()
+}
+
+// connect opens the session of a candidate, replaced in the tests
+var connect = func(ctx context.Context, instanceID string) (session, error) {
+	config := dbpkg.LoadEnv()
+	dsn := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s&application_name=%s",
+		config.User, config.Password, config.Host, config.Port, config.Name, config.SSLMode, url.QueryEscape(applicationNamePrefix+instanceID))
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	return pgSession{conn}, nil
+}
+
+// Lease is the leadership of this instance, it is valid as long as the session holding the lock is
+type Lease struct {
+	session session
+	key     int32
+}
+
+// Conn returns the connection of the session holding the lock. it is not safe for concurrent use, Check runs on it too
+func (l *Lease) Conn() *pgx.Conn {
+	return l.session.conn()
+}
+
+// Check verifies that the session still holds the leader lock. an error wraps ErrLeaseLost, the leader must stop
+// publishing and give up the leadership
+func (l *Lease) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(viper.GetInt("leader.checkTimeout"))*time.Second)
+	defer cancel()
+	held, err := l.session.holdsLock(ctx, l.key)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLeaseLost, err)
+	}
+	if !held {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Run campaigns for the leader lock until ctx is cancelled. once this instance is elected lead runs with the lease
+// of the lock, the lock is given up when lead returns. lead must return when ctx is cancelled or the lease is lost
+func Run(ctx context.Context, l log.Logger, instanceID string, lead func(ctx context.Context, lease *Lease) error) {
+	l = log.With(l, "component", "leader")
+	setState(false, "")
+	defer setState(false, "")
+	retry := time.Duration(viper.GetInt("leader.retryInterval")) * time.Second
+	for {
+		err := campaign(ctx, l, instanceID, lead)
+		if ctx.Err() != nil {
+			level.Info(l).Log("msg", "leader election stopped, shutting down")
+			return
+		}
+		level.Error(l).Log("msg", "lost the leader lock or the connection, campaigning again", "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+func campaign(ctx context.Context, l log.Logger, instanceID string, lead func(ctx context.Context, lease *Lease) error) error {
+	sess, err := connect(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	// closing the session releases the lock
+	defer sess.close()
+
+	key := viper.GetInt32("leader.lockKey")
+	retry := time.Duration(viper.GetInt("leader.retryInterval")) * time.Second
+	for {
+		locked, err := sess.tryLock(ctx, key)
+		if err != nil {
+			return fmt.Errorf("error taking the leader lock: %w", err)
+		}
+		if locked {
+			break
+		}
+		current, err := sess.currentLeader(ctx, key)
+		if err != nil {
+			level.Warn(l).Log("msg", "error looking up the current leader", "err", err)
+		}
+		if current != Leader() {
+			level.Info(l).Log("msg", "following the current leader", "leader", current)
+		}
+		setState(false, current)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+
+	level.Info(l).Log("msg", "elected leader", "instance", instanceID)
+	setState(true, instanceID)
+	defer setState(false, "")
+	return lead(ctx, &Lease{session: sess, key: key})
+}
+
+// pgSession is a session on its own connection, outside the pool
+type pgSession struct {
+	c *pgx.Conn
+}
+
+func (s pgSession) tryLock(ctx context.Context, key int32) (bool, error) {
+	var locked bool
+	err := s.c.QueryRow(ctx, "SELECT pg_try_advisory_lock($1::bigint)", key).Scan(&locked)
+	return locked, err
+}
+
+// holdsLock asks pgsql whether this session holds the lock, a half open connection times out instead
+func (s pgSession) holdsLock(ctx context.Context, key int32) (bool, error) {
+	var held bool
+	err := s.c.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_locks
+WHERE locktype = 'advisory' AND granted AND pid = pg_backend_pid() AND classid = 0 AND objid = $1::int::oid AND objsubid = 1)`, key).Scan(&held)
+	return held, err
+}
+
+func (s pgSession) currentLeader(ctx context.Context, key int32) (string, error) {
+	return currentLeader(ctx, s.c, key)
+}
+
+func (s pgSession) conn() *pgx.Conn {
+	return s.c
+}
+
+func (s pgSession) close() {
+	s.c.Close(context.Background())
+}
+
+// currentLeader returns the instance id of the session holding the lock. pg_try_advisory_lock(bigint) stores a key
+// which fits into 32 bits as classid 0 and objid key
+func currentLeader(ctx context.Context, conn *pgx.Conn, key int32) (string, error) {
+	var name string
+	err := conn.QueryRow(ctx, `SELECT a.application_name
+FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+WHERE l.locktype = 'advisory' AND l.granted AND l.classid = 0 AND l.objid = $1::int::oid AND l.objsubid = 1`, key).Scan(&name)
+	if err == pgx.ErrNoRows {
+		return "", nil // released in the meantime
+	}
+	return strings.TrimPrefix(name, applicationNamePrefix), err
+}
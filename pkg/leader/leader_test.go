@@ -0,0 +1,145 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"targetad/pkg/health"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+// fakeLocks stands in for the advisory locks of pgsql, holder is the instance id holding the lock
+type fakeLocks struct {
+	sync.Mutex
+	holder string
+}
+
+func (l *fakeLocks) setHolder(holder string) {
+	l.Lock()
+	l.holder = holder
+	l.Unlock()
+}
+
+type fakeSession struct {
+	locks      *fakeLocks
+	instanceID string
+}
+
+func (s fakeSession) tryLock(ctx context.Context, key int32) (bool, error) {
+	s.locks.Lock()
+	defer s.locks.Unlock()
+	if s.locks.holder == "" {
+		s.locks.holder = s.instanceID
+	}
+	return s.locks.holder == s.instanceID, nil
+}
+
+func (s fakeSession) holdsLock(ctx context.Context, key int32) (bool, error) {
+	s.locks.Lock()
+	defer s.locks.Unlock()
+	return s.locks.holder == s.instanceID, nil
+}
+
+func (s fakeSession) currentLeader(ctx context.Context, key int32) (string, error) {
+	s.locks.Lock()
+	defer s.locks.Unlock()
+	return s.locks.holder, nil
+}
+
+func (s fakeSession) conn() *pgx.Conn {
+	return nil
+}
+
+func (s fakeSession) close() {
+	s.locks.Lock()
+	defer s.locks.Unlock()
+	if s.locks.holder == s.instanceID {
+		s.locks.holder = ""
+	}
+}
+
+// waitFor polls cond until it holds or a few retry intervals passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func healthInfo(key string) string {
+	return health.Readiness(context.Background(), time.Second).Info[key]
+}
+
+// TestElectionAndFailover tests that an instance follows the current leader, takes over once the lock is released and
+// gives up the leadership as soon as its lease check finds the lock held by another session
+func TestElectionAndFailover(t *testing.T) {
+	viper.Set("leader.retryInterval", 1)
+	viper.Set("leader.checkTimeout", 1)
+	locks := &fakeLocks{holder: "worker-2"}
+	connect = func(ctx context.Context, instanceID string) (session, error) {
+		return fakeSession{locks: locks, instanceID: instanceID}, nil
+	}
+
+	leaseErrs, leads := make(chan error, 1), 0 // leads is read once Run returned
+	lead := func(ctx context.Context, lease *Lease) error {
+		leads++
+		for {
+			if err := lease.Check(ctx); err != nil {
+				leaseErrs <- err
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Run(ctx, log.NewNopLogger(), "worker-1", lead)
+		close(done)
+	}()
+
+	waitFor(t, "following worker-2", func() bool { return Leader() == "worker-2" })
+	if IsLeader() || healthInfo("role") != "follower" || healthInfo("leader") != "worker-2" {
+		t.Fatalf("expected worker-1 to follow worker-2, got leader %v role %q", IsLeader(), healthInfo("role"))
+	}
+
+	locks.setHolder("") // worker-2 died, pgsql released its lock
+	waitFor(t, "the failover to worker-1", IsLeader)
+	if Leader() != "worker-1" || healthInfo("role") != "leader" || healthInfo("leader") != "worker-1" {
+		t.Fatalf("expected worker-1 to lead, got %q role %q", Leader(), healthInfo("role"))
+	}
+
+	// the session of worker-1 died silently and worker-2 took the lock over
+	locks.setHolder("worker-2")
+	select {
+	case err := <-leaseErrs:
+		if !errors.Is(err, ErrLeaseLost) {
+			t.Fatalf("expected the lease to be lost, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the lease check to fail")
+	}
+	waitFor(t, "worker-1 to follow worker-2 again", func() bool { return !IsLeader() && Leader() == "worker-2" })
+
+	cancel()
+	<-done
+	if IsLeader() || healthInfo("leader") != "" {
+		t.Fatalf("expected no leader after shutting down")
+	}
+	if leads != 1 {
+		t.Fatalf("expected worker-1 to lead once, led %d times", leads)
+	}
+}
@@ -0,0 +1,129 @@
+package logger
+
+// logger.go sets up the structured go-kit logger used across the service. main builds it from the log section of
+// config.json with New and hands it to the transports and the workers, request handlers get a copy of it through the
+// context which carries the request id. the process wide logger is only the default for the startup, before the
+// config is read.
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+type Config struct {
+	Level  string `mapstructure:"level"`  // debug, info, warn or error
+	Format string `mapstructure:"format"` // json or logfmt
+	// fraction of the requests whose debug and info lines are written, warnings and errors are always written
+	SampleRate float64 `mapstructure:"sampleRate"`
+}
+
+// requestIDKey is the key of the request id in the lines of a request, the sampling is decided on it
+const requestIDKey = "request_id"
+
+// out is the process wide logger, everything goes to stdout as json at info level
+var out = newLogger(Config{Level: "info", Format: "json", SampleRate: 1})
+
+// New builds the logger for the config, the lines go to stdout
+func New(cfg Config) (log.Logger, error) {
+	if cfg.Format != "" && cfg.Format != "json" && cfg.Format != "logfmt" {
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	if _, err := parseLevel(cfg.Level); err != nil {
+		return nil, err
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, fmt.Errorf("log sample rate %v must be between 0 and 1", cfg.SampleRate)
+	}
+	return newLogger(cfg), nil
+}
+
+// newLogger stacks the level filter and the sampling under the timestamp and the caller, so the caller depth is the
+// same for every logger derived from it with log.With
+func newLogger(cfg Config) log.Logger {
+	var l log.Logger
+	if cfg.Format == "logfmt" {
+		l = log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout))
+	} else {
+		l = log.NewJSONLogger(log.NewSyncWriter(os.Stdout))
+	}
+	if cfg.SampleRate < 1 {
+		l = sampled{next: l, rate: cfg.SampleRate}
+	}
+	lvl, _ := parseLevel(cfg.Level)
+	return log.With(level.NewFilter(l, lvl), "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+}
+
+func parseLevel(s string) (level.Option, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return level.AllowDebug(), nil
+	case "", "info":
+		return level.AllowInfo(), nil
+	case "warn":
+		return level.AllowWarn(), nil
+	case "error":
+		return level.AllowError(), nil
+	}
+	return nil, fmt.Errorf("unknown log level %q", s)
+}
+
+// Get returns the process wide logger, use it for the startup before the logger of the config is built
+func Get() log.Logger {
+	return out
+}
+
+type ctxKey struct{}
+
+// NewRequestContext returns a copy of ctx with a logger for one request derived from l. every line carries the
+// request id and the sampling is decided on it, so either all or none of the debug and info lines of a request are
+// written
+func NewRequestContext(ctx context.Context, l log.Logger, requestID string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, log.With(l, requestIDKey, requestID))
+}
+
+// FromContext returns the request logger, or l outside of a request
+func FromContext(ctx context.Context, l log.Logger) log.Logger {
+	if rl, ok := ctx.Value(ctxKey{}).(log.Logger); ok {
+		return rl
+	}
+	return l
+}
+
+// sampled drops the debug and info lines of the requests which are not picked by the sampling, lines without a
+// request id and warnings and errors are always written
+type sampled struct {
+	next log.Logger
+	rate float64
+}
+
+func (s sampled) Log(keyvals ...interface{}) error {
+	var requestID string
+	debugOrInfo := false
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		switch keyvals[i] {
+		case requestIDKey:
+			requestID, _ = keyvals[i+1].(string)
+		case level.Key():
+			v, ok := keyvals[i+1].(level.Value)
+			debugOrInfo = ok && (v == level.DebugValue() || v == level.InfoValue())
+		}
+	}
+	if debugOrInfo && requestID != "" && !s.picked(requestID) {
+		return nil
+	}
+	return s.next.Log(keyvals...)
+}
+
+// picked maps the request id to [0, 1) and compares it with the rate
+func (s sampled) picked(requestID string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(requestID))
+	return float64(h.Sum32())/(math.MaxUint32+1) < s.rate
+}
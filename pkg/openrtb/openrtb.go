@@ -0,0 +1,163 @@
+package openrtb
+
+// openrtb.go contains the subset of the OpenRTB 2.5/2.6 objects we need to answer exchanges and SSPs
+// and the mapping between a bid request and our own delivery request/response.
+// unknown fields are ignored while decoding, so the full 2.x spec can be sent to us.
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"targetad/pkg/target/model"
+)
+
+// Version is sent back in the x-openrtb-version header
+const Version = "2.6"
+
+type BidRequest struct {
+	ID     string   `json:"id" validate:"required"`
+	Imp    []Imp    `json:"imp" validate:"required,min=1,dive"`
+	App    *App     `json:"app,omitempty"`
+	Device *Device  `json:"device,omitempty"`
+	Test   int      `json:"test,omitempty"`
+	TMax   int      `json:"tmax,omitempty"`
+	Cur    []string `json:"cur,omitempty"`
+}
+
+type Imp struct {
+	ID          string  `json:"id" validate:"required"`
+	Banner      *Banner `json:"banner,omitempty"`
+	BidFloor    float64 `json:"bidfloor,omitempty"`
+	BidFloorCur string  `json:"bidfloorcur,omitempty"`
+}
+
+type Banner struct {
+	W int `json:"w,omitempty"`
+	H int `json:"h,omitempty"`
+}
+
+type App struct {
+	ID     string `json:"id,omitempty"`
+	Bundle string `json:"bundle,omitempty"`
+}
+
+type Device struct {
+	OS  string `json:"os,omitempty"`
+	Geo *Geo   `json:"geo,omitempty"`
+}
+
+type Geo struct {
+	Country string `json:"country,omitempty"` // ISO-3166-1 alpha-3
+}
+
+type BidResponse struct {
+	ID      string    `json:"id"`
+	SeatBid []SeatBid `json:"seatbid,omitempty"`
+	Cur     string    `json:"cur,omitempty"`
+}
+
+type SeatBid struct {
+	Bid  []Bid  `json:"bid"`
+	Seat string `json:"seat,omitempty"`
+}
+
+type Bid struct {
+	ID    string  `json:"id"`
+	ImpID string  `json:"impid"`
+	Price float64 `json:"price"`
+	AdID  string  `json:"adid,omitempty"`
+	AdM   string  `json:"adm,omitempty"`
+	IURL  string  `json:"iurl,omitempty"`
+	CID   string  `json:"cid,omitempty"`
+	CrID  string  `json:"crid,omitempty"`
+	W     int     `json:"w,omitempty"`
+	H     int     `json:"h,omitempty"`
+}
+
+// BidConfig holds the bidding settings, they come from the openrtb section of config.json
+type BidConfig struct {
+	Seat     string
+	Price    float64 // cpm we bid for every matched campaign
+	Currency string
+}
+
+// ToDeliveryRequest maps app.bundle, device.os and device.geo.country onto our delivery request.
+// the country is converted from alpha-3 to the alpha-2 codes our targeting rules use
+func ToDeliveryRequest(req *BidRequest) model.DeliveryServiceRequest {
+	var res model.DeliveryServiceRequest
+	if req.App != nil {
+		res.AppID = req.App.Bundle
+	}
+	if req.Device != nil {
+		res.OS = req.Device.OS
+		if req.Device.Geo != nil {
+			res.Country = countryCode(req.Device.Geo.Country)
+		}
+	}
+	return res
+}
+
+// NewBidResponse builds the bid response out of the matched campaigns. every banner impression gets one bid per campaign,
+// impressions with a floor above our price or a currency we do not bid in are skipped.
+// nil is returned when there is nothing to bid on, the transport answers that with 204 No Content
+func NewBidResponse(req *BidRequest, campaigns []*model.DeliveryServiceResponse, cfg BidConfig) *BidResponse {
+	if len(campaigns) == 0 || !acceptsCurrency(req.Cur, cfg.Currency) {
+		return nil
+	}
+
+	var bids []Bid
+	for _, imp := range req.Imp {
+		if imp.Banner == nil || imp.BidFloor > cfg.Price {
+			continue
+		}
+		if imp.BidFloorCur != "" && !strings.EqualFold(imp.BidFloorCur, cfg.Currency) {
+			continue
+		}
+		for _, campaign := range campaigns {
+			bids = append(bids, Bid{
+				ID:    fmt.Sprintf("%s-%s-%s", req.ID, imp.ID, campaign.CampaignStringID),
+				ImpID: imp.ID,
+				Price: cfg.Price,
+				AdID:  campaign.CampaignStringID,
+				AdM:   bannerMarkup(campaign),
+				IURL:  campaign.Image,
+				CID:   campaign.CampaignStringID,
+				CrID:  campaign.CampaignStringID,
+				W:     imp.Banner.W,
+				H:     imp.Banner.H,
+			})
+		}
+	}
+	if len(bids) == 0 {
+		return nil
+	}
+	return &BidResponse{
+		ID:      req.ID,
+		SeatBid: []SeatBid{{Bid: bids, Seat: cfg.Seat}},
+		Cur:     cfg.Currency,
+	}
+}
+
+func countryCode(country string) string {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if alpha2, ok := countryAlpha3[country]; ok {
+		return alpha2
+	}
+	return country // some exchanges already send alpha-2
+}
+
+func acceptsCurrency(allowed []string, currency string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, cur := range allowed {
+		if strings.EqualFold(cur, currency) {
+			return true
+		}
+	}
+	return false
+}
+
+func bannerMarkup(campaign *model.DeliveryServiceResponse) string {
+	return fmt.Sprintf(`<img src="%s" alt="%s">`, html.EscapeString(campaign.Image), html.EscapeString(campaign.Cta))
+}
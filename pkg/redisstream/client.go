@@ -0,0 +1,190 @@
+package redisstream
+
+// client.go builds the redis client from the config. redis.mode picks the deployment:
+//   - standalone talks to redis.address
+//   - sentinel asks the sentinels in redis.addresses for the master redis.sentinel.masterName and follows failovers
+//   - cluster discovers the nodes from the seed nodes in redis.addresses
+//
+// the credentials never land in config.json, the config names the env variable or the file (e.g. a mounted
+// kubernetes secret) holding them, a file wins over the env variable. TLS is enabled with redis.tls.enabled and
+// takes a custom CA and a client certificate. a config which can not work is an error at startup.
+//
+// in cluster mode the change stream and every key derived from it (instances, attempt histories) must live in
+// one slot, a stream name without a hash tag is therefore wrapped in one: targeted_ads_stream becomes
+// {targeted_ads_stream} and its instances hash {targeted_ads_stream}:instances
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
+// credentialsConfig names where a username and a password come from, not the secrets themselves
+type credentialsConfig struct {
+	UsernameEnv  string `mapstructure:"usernameEnv"`
+	UsernameFile string `mapstructure:"usernameFile"`
+	PasswordEnv  string `mapstructure:"passwordEnv"`
+	PasswordFile string `mapstructure:"passwordFile"`
+}
+
+type tlsConfig struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	CAFile     string `mapstructure:"caFile"`   // pem bundle trusted next to the system roots
+	CertFile   string `mapstructure:"certFile"` // client certificate, only for mutual TLS
+	KeyFile    string `mapstructure:"keyFile"`
+	ServerName string `mapstructure:"serverName"` // defaults to the host of the address
+}
+
+type sentinelConfig struct {
+	MasterName        string `mapstructure:"masterName"`
+	credentialsConfig `mapstructure:",squash"`
+}
+
+func redisMode() string {
+	return viper.GetString("redis.mode")
+}
+
+// newRedisClient builds the client for redis.mode, it does not connect yet
+func newRedisClient() (redis.UniversalClient, error) {
+	var auth credentialsConfig
+	if err := viper.UnmarshalKey("redis.auth", &auth); err != nil {
+		return nil, fmt.Errorf("error reading redis auth config: %w", err)
+	}
+	username, err := secret(auth.UsernameEnv, auth.UsernameFile)
+	if err != nil {
+		return nil, fmt.Errorf("redis username: %w", err)
+	}
+	password, err := secret(auth.PasswordEnv, auth.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("redis password: %w", err)
+	}
+	tlsConf, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	poolSize, minIdleConns := viper.GetInt("redis.poolSize"), viper.GetInt("redis.minIdleConns")
+	readTimeout := time.Duration(viper.GetInt("redis.readTimeout")) * time.Second
+	writeTimeout := time.Duration(viper.GetInt("redis.writeTimeout")) * time.Second
+	dialTimeout := time.Duration(viper.GetInt("redis.dialTimeout")) * time.Second // wait for 5 seconds to establish a dns connection
+	addresses := viper.GetStringSlice("redis.addresses")
+
+	switch redisMode() {
+	case RedisModeStandalone:
+		return redis.NewClient(&redis.Options{
+			Addr: viper.GetString("redis.address"), Username: username, Password: password, DB: viper.GetInt("redis.db"),
+			PoolSize: poolSize, MinIdleConns: minIdleConns, ReadTimeout: readTimeout, WriteTimeout: writeTimeout, DialTimeout: dialTimeout,
+			TLSConfig: tlsConf,
+		}), nil
+	case RedisModeSentinel:
+		var sentinel sentinelConfig
+		if err := viper.UnmarshalKey("redis.sentinel", &sentinel); err != nil {
+			return nil, fmt.Errorf("error reading redis sentinel config: %w", err)
+		}
+		if sentinel.MasterName == "" || len(addresses) == 0 {
+			return nil, errors.New("redis sentinel mode needs redis.sentinel.masterName and the sentinels in redis.addresses")
+		}
+		sentinelUsername, err := secret(sentinel.UsernameEnv, sentinel.UsernameFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis sentinel username: %w", err)
+		}
+		sentinelPassword, err := secret(sentinel.PasswordEnv, sentinel.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis sentinel password: %w", err)
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName: sentinel.MasterName, SentinelAddrs: addresses, SentinelUsername: sentinelUsername, SentinelPassword: sentinelPassword,
+			Username: username, Password: password, DB: viper.GetInt("redis.db"),
+			PoolSize: poolSize, MinIdleConns: minIdleConns, ReadTimeout: readTimeout, WriteTimeout: writeTimeout, DialTimeout: dialTimeout,
+			TLSConfig: tlsConf,
+		}), nil
+	case RedisModeCluster:
+		if len(addresses) == 0 {
+			return nil, errors.New("redis cluster mode needs the seed nodes in redis.addresses")
+		}
+		if viper.GetInt("redis.db") != 0 {
+			return nil, errors.New("redis cluster mode only has db 0")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs: addresses, Username: username, Password: password,
+			PoolSize: poolSize, MinIdleConns: minIdleConns, ReadTimeout: readTimeout, WriteTimeout: writeTimeout, DialTimeout: dialTimeout,
+			TLSConfig: tlsConf,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown redis.mode %q, expected %s, %s or %s", redisMode(), RedisModeStandalone, RedisModeSentinel, RedisModeCluster)
+	}
+}
+
+// secret reads a credential from file, or from the env variable env when no file is configured. both empty means
+// no credential. a configured file which can not be read is an error, falling back to no password would only fail later
+func secret(env, file string) (string, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	if env == "" {
+		return "", nil
+	}
+	return os.Getenv(env), nil
+}
+
+// newTLSConfig returns nil when TLS is disabled
+func newTLSConfig() (*tls.Config, error) {
+	var conf tlsConfig
+	if err := viper.UnmarshalKey("redis.tls", &conf); err != nil {
+		return nil, fmt.Errorf("error reading redis tls config: %w", err)
+	}
+	if !conf.Enabled {
+		return nil, nil
+	}
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: conf.ServerName}
+	if conf.CAFile != "" {
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis tls ca: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("redis tls ca: no certificate found in %s", conf.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis tls client certificate: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// clusterKey puts a stream name into its own hash slot in cluster mode, a name which has a hash tag already is kept
+func clusterKey(name string) string {
+	if redisMode() != RedisModeCluster {
+		return name
+	}
+	if open := strings.Index(name, "{"); open >= 0 && strings.Index(name[open:], "}") > 1 {
+		return name
+	}
+	return "{" + name + "}"
+}
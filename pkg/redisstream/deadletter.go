@@ -0,0 +1,260 @@
+package redisstream
+
+// deadletter.go moves poison messages out of the change stream. a message goes to the dead-letter stream when it is
+// malformed (unknown table, invalid id, missing fields) or when it failed redis.redisStream.deadLetter.maxAttempts
+// times (0 never dead-letters a failing message). the error of every attempt is kept in a short lived list next to the stream and attached to the dead letter.
+// dead letters stay until an operator replays or discards them through the admin api. every instance retries a
+// message with its own group, a message is dead-lettered once for all of them (see deadLetterMarkerKey) so replaying it
+// applies the change once more on every instance and not once per instance which gave up on it.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"targetad/pkg/apperr"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+const (
+	DeadLetterReasonMalformed   = "malformed"
+	DeadLetterReasonMaxAttempts = "max_attempts"
+
+	// the attempt history of a message which is never dead-lettered (e.g. it was acked by a consumer which did not
+	// clean up) expires after this
+	attemptHistoryTTL = 7 * 24 * time.Hour
+)
+
+// the fields added to the original fields of a dead-lettered message
+const (
+	dlqOriginalID = "dlq_original_id"
+	dlqReason     = "dlq_reason"
+	dlqError      = "dlq_error"
+	dlqAttempts   = "dlq_attempts"
+	dlqHistory    = "dlq_history"
+	dlqConsumer   = "dlq_consumer"
+	dlqAt         = "dlq_at"
+)
+
+var ErrDeadLetterNotFound = apperr.New(apperr.CodeNotFound, "dead letter not found")
+
+// Attempt is one failed try at applying a message
+type Attempt struct {
+	Attempt  int64     `json:"attempt"`
+	Consumer string    `json:"consumer"`
+	Error    string    `json:"error"`
+	At       time.Time `json:"at"`
+}
+
+type DeadLetter struct {
+	ID             string            `json:"id"`          // id in the dead-letter stream
+	OriginalID     string            `json:"original_id"` // id the message had in the change stream
+	Fields         map[string]string `json:"fields"`      // the fields of the original message
+	Reason         string            `json:"reason"`
+	Error          string            `json:"error"`
+	Attempts       int64             `json:"attempts"`
+	History        []Attempt         `json:"history"`
+	Consumer       string            `json:"consumer"`
+	DeadLetteredAt time.Time         `json:"dead_lettered_at"`
+}
+
+type DeadLetterList struct {
+	DeadLetters []*DeadLetter `json:"dead_letters"`
+	Next        string        `json:"next,omitempty"` // pass as after to get the next page, empty on the last page
+}
+
+func deadLetterStream() string {
+	return clusterKey(viper.GetString("redis.redisStream.deadLetter.streamName"))
+}
+
+func maxAttempts() int64 {
+	return viper.GetInt64("redis.redisStream.deadLetter.maxAttempts")
+}
+
+func attemptHistoryKey(messageID string) string {
+	return streamName() + ":attempts:" + consumerGroup() + ":" + messageID // every instance retries the message on its own
+}
+
+// recordAttempt appends a failed attempt to the history of the message
+func recordAttempt(ctx context.Context, messageID string, attempt int64, cause error) {
+	entry, _ := json.Marshal(Attempt{Attempt: attempt, Consumer: consumerName(), Error: cause.Error(), At: time.Now().UTC()})
+	key := attemptHistoryKey(messageID)
+	_, err := RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, entry)
+		pipe.Expire(ctx, key, attemptHistoryTTL)
+		return nil
+	})
+	if err != nil {
+		level.Warn(streamLogger()).Log("msg", "error recording stream message attempt", "message_id", messageID, "err", err)
+	}
+}
+
+// forgetAttempts drops the history of a message which was applied after failing before
+func forgetAttempts(ctx context.Context, messageID string) {
+	if err := RedisClient.Del(ctx, attemptHistoryKey(messageID)).Err(); err != nil {
+		level.Warn(streamLogger()).Log("msg", "error deleting stream message attempts", "message_id", messageID, "err", err)
+	}
+}
+
+// deadLetterMarkerKey marks a message of the change stream as dead-lettered. every instance reads every message with
+// its own group, so every instance hits the same poison message, the marker keeps it to one dead letter
+func deadLetterMarkerKey(messageID string) string {
+	return deadLetterStream() + ":original:" + messageID
+}
+
+// deadLetter copies the message to the dead-letter stream and acks it in the change stream. the first instance to
+// dead-letter a message adds the dead letter, the others only ack it. when the ack fails the message is dead-lettered
+// again on its next attempt, the marker keeps that from adding a second dead letter as well
+func deadLetter(ctx context.Context, message redis.XMessage, reason string, attempt int64, cause error) error {
+	key := attemptHistoryKey(message.ID)
+	marker := deadLetterMarkerKey(message.ID)
+	first, err := RedisClient.SetNX(ctx, marker, consumerName(), attemptHistoryTTL).Result()
+	if err != nil {
+		return fmt.Errorf("error marking the message as dead-lettered: %w", err)
+	}
+	if first {
+		history, err := RedisClient.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			level.Warn(streamLogger()).Log("msg", "error reading stream message attempts", "message_id", message.ID, "err", err)
+		}
+
+		values := make(map[string]interface{}, len(message.Values)+7)
+		for k, v := range message.Values {
+			values[k] = v
+		}
+		values[dlqOriginalID] = message.ID
+		values[dlqReason] = reason
+		values[dlqError] = cause.Error()
+		values[dlqAttempts] = attempt
+		values[dlqHistory] = "[" + strings.Join(history, ",") + "]"
+		values[dlqConsumer] = consumerName()
+		values[dlqAt] = time.Now().UnixMilli()
+		if err := RedisClient.XAdd(ctx, &redis.XAddArgs{Stream: deadLetterStream(), Values: values}).Err(); err != nil {
+			RedisClient.Del(ctx, marker) // the next attempt tries again
+			return fmt.Errorf("error adding to the dead-letter stream: %w", err)
+		}
+		messagesDeadLettered.With("reason", reason).Add(1)
+		level.Warn(streamLogger()).Log("msg", "moved stream message to the dead-letter stream", "message_id", message.ID, "reason", reason, "attempt", attempt, "err", cause)
+	} else {
+		level.Info(streamLogger()).Log("msg", "stream message was dead-lettered by another instance already, acking it", "message_id", message.ID, "reason", reason, "err", cause)
+	}
+
+	_, err = RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, streamName(), consumerGroup(), message.ID)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	return err
+}
+
+// ListDeadLetters returns up to limit dead letters, oldest first, starting after the given id (empty for the start)
+func ListDeadLetters(ctx context.Context, after string, limit int64) (*DeadLetterList, error) {
+	start := "-"
+	if after != "" {
+		start = "(" + after
+	}
+	messages, err := RedisClient.XRangeN(ctx, deadLetterStream(), start, "+", limit).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := &DeadLetterList{DeadLetters: make([]*DeadLetter, 0, len(messages))}
+	for _, message := range messages {
+		res.DeadLetters = append(res.DeadLetters, toDeadLetter(message))
+	}
+	if int64(len(messages)) == limit {
+		res.Next = messages[len(messages)-1].ID
+	}
+	return res, nil
+}
+
+// GetDeadLetter returns one dead letter
+func GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	message, err := getDeadLetterMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return toDeadLetter(message), nil
+}
+
+// ReplayDeadLetter puts the original message back on the change stream as a new message and removes the dead letter.
+// it returns the id of the new message
+func ReplayDeadLetter(ctx context.Context, id string) (string, error) {
+	message, err := getDeadLetterMessage(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	dl := toDeadLetter(message)
+	values := make(map[string]interface{}, len(dl.Fields))
+	for k, v := range dl.Fields {
+		values[k] = v
+	}
+	values["ts"] = time.Now().UnixMilli()
+	newID, err := RedisClient.XAdd(ctx, &redis.XAddArgs{Stream: streamName(), Values: values}).Result()
+	if err != nil {
+		return "", err
+	}
+	if err := RedisClient.XDel(ctx, deadLetterStream(), id).Err(); err != nil {
+		return "", fmt.Errorf("message was replayed as %s but the dead letter could not be removed: %w", newID, err)
+	}
+	level.Info(streamLogger()).Log("msg", "replayed dead letter", "dead_letter_id", id, "message_id", newID)
+	return newID, nil
+}
+
+// DiscardDeadLetter removes a dead letter for good
+func DiscardDeadLetter(ctx context.Context, id string) error {
+	n, err := RedisClient.XDel(ctx, deadLetterStream(), id).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDeadLetterNotFound
+	}
+	level.Info(streamLogger()).Log("msg", "discarded dead letter", "dead_letter_id", id)
+	return nil
+}
+
+func getDeadLetterMessage(ctx context.Context, id string) (redis.XMessage, error) {
+	messages, err := RedisClient.XRangeN(ctx, deadLetterStream(), id, id, 1).Result()
+	if err != nil {
+		return redis.XMessage{}, err
+	}
+	if len(messages) == 0 {
+		return redis.XMessage{}, ErrDeadLetterNotFound
+	}
+	return messages[0], nil
+}
+
+func toDeadLetter(message redis.XMessage) *DeadLetter {
+	dl := &DeadLetter{ID: message.ID, Fields: map[string]string{}, History: []Attempt{}}
+	for k, v := range message.Values {
+		s := fmt.Sprint(v)
+		switch k {
+		case dlqOriginalID:
+			dl.OriginalID = s
+		case dlqReason:
+			dl.Reason = s
+		case dlqError:
+			dl.Error = s
+		case dlqAttempts:
+			dl.Attempts, _ = strconv.ParseInt(s, 10, 64)
+		case dlqHistory:
+			if err := json.Unmarshal([]byte(s), &dl.History); err != nil {
+				level.Warn(streamLogger()).Log("msg", "invalid dead letter history", "dead_letter_id", message.ID, "err", err)
+			}
+		case dlqConsumer:
+			dl.Consumer = s
+		case dlqAt:
+			if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+				dl.DeadLetteredAt = time.UnixMilli(ms).UTC()
+			}
+		default:
+			dl.Fields[k] = s
+		}
+	}
+	return dl
+}
@@ -0,0 +1,654 @@
+package redisstream
+
+// fake_test.go is an in memory redis for the tests, it knows the commands this package sends and keeps streams,
+// consumer groups with their pending entries lists, hashes, lists and strings. a command it does not know panics on
+// the nil redis.UniversalClient it embeds
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+type fakeRedis struct {
+	redis.UniversalClient
+
+	mu      sync.Mutex
+	seq     int64
+	streams map[string]*fakeStream
+	hashes  map[string]map[string]string
+	lists   map[string][]string
+	strings map[string]string
+	errs    map[string]error // command name to the error it fails with
+	budget  map[string]int   // command name to the number of calls which still succeed before it fails
+}
+
+type fakeStream struct {
+	entries []redis.XMessage
+	lastID  string
+	groups  map[string]*fakeGroup
+}
+
+type fakeGroup struct {
+	lastDelivered string
+	pending       map[string]*fakePending
+	consumers     map[string]time.Time // last time the consumer read
+}
+
+type fakePending struct {
+	consumer    string
+	deliveries  int64
+	deliveredAt time.Time
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		streams: map[string]*fakeStream{},
+		hashes:  map[string]map[string]string{},
+		lists:   map[string][]string{},
+		strings: map[string]string{},
+		errs:    map[string]error{},
+		budget:  map[string]int{},
+	}
+}
+
+// useFakeRedis points RedisClient at a new fake redis for the test and configures the stream
+func useFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	for key, value := range map[string]interface{}{
+		"app.instanceId":                             "worker-1",
+		"redis.mode":                                 RedisModeStandalone,
+		"redis.redisStream.streamName":               "test_stream",
+		"redis.redisStream.consumerGroupPrefix":      "test_group",
+		"redis.redisStream.groupIdleTimeout":         600,
+		"redis.redisStream.deadLetter.streamName":    "test_dead_letter",
+		"redis.redisStream.deadLetter.maxAttempts":   3,
+		"redis.redisStream.recovery.batchSize":       10,
+		"redis.redisStream.recovery.claimMinIdle":    60,
+		"redis.redisStream.recovery.retryBackoff":    1,
+		"redis.redisStream.recovery.retryBackoffMax": 30,
+		"redis.redisStream.consumerCount":            10,
+		"redis.redisStream.consumerBlock":            1,
+		"redis.redisStream.recovery.interval":        30,
+		"redis.redisStream.groupCleanupInterval":     60,
+		"outbox.batchSize":                           2,
+		"outbox.retryBackoff":                        1,
+		"outbox.retryBackoffMax":                     30,
+	} {
+		viper.Set(key, value)
+	}
+	fake := newFakeRedis()
+	previous := RedisClient
+	RedisClient = fake
+	t.Cleanup(func() { RedisClient = previous })
+	return fake
+}
+
+// failWith makes every later call of the command fail with err, nil makes it work again
+func (f *fakeRedis) failWith(command string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[command] = err
+	delete(f.budget, command)
+}
+
+// failAfter lets n more calls of the command succeed, the later ones fail with err
+func (f *fakeRedis) failAfter(command string, n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[command], f.budget[command] = err, n
+}
+
+// age makes a pending entry of the group idle for d longer
+func (f *fakeRedis) age(stream, group, id string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streams[stream].groups[group].pending[id].deliveredAt = time.Now().Add(-d)
+}
+
+// entries returns the entries of a stream
+func (f *fakeRedis) entries(stream string) []redis.XMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.streams[stream]; ok {
+		return append([]redis.XMessage{}, s.entries...)
+	}
+	return nil
+}
+
+// pendingOf returns the delivery counter of the pending entries of the group by id
+func (f *fakeRedis) pendingOf(stream, group string) map[string]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := map[string]int64{}
+	if s, ok := f.streams[stream]; ok {
+		if g, ok := s.groups[group]; ok {
+			for id, p := range g.pending {
+				res[id] = p.deliveries
+			}
+		}
+	}
+	return res
+}
+
+func (f *fakeRedis) groupNames(stream string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.streams[stream].groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakeRedis) err(command string) error {
+	if n, ok := f.budget[command]; ok && n > 0 {
+		f.budget[command] = n - 1
+		return nil
+	}
+	return f.errs[command]
+}
+
+// parseID splits a stream id into its two parts, "-" and "+" are the smallest and the largest id
+func parseID(id string) [2]int64 {
+	switch id {
+	case "-":
+		return [2]int64{0, 0}
+	case "+":
+		return [2]int64{1<<63 - 1, 1<<63 - 1}
+	}
+	ms, seq, _ := strings.Cut(id, "-")
+	a, _ := strconv.ParseInt(ms, 10, 64)
+	b, _ := strconv.ParseInt(seq, 10, 64)
+	return [2]int64{a, b}
+}
+
+func compareIDs(a, b string) int {
+	x, y := parseID(a), parseID(b)
+	if x[0] != y[0] {
+		return cmp.Compare(x[0], y[0])
+	}
+	return cmp.Compare(x[1], y[1])
+}
+
+// inRange reports whether id is within start and end, a start of "(id" is exclusive
+func inRange(id, start, end string) bool {
+	if exclusive, ok := strings.CutPrefix(start, "("); ok {
+		if compareIDs(id, exclusive) <= 0 {
+			return false
+		}
+	} else if compareIDs(id, start) < 0 {
+		return false
+	}
+	return compareIDs(id, end) <= 0
+}
+
+func (f *fakeRedis) stream(name string) *fakeStream {
+	s, ok := f.streams[name]
+	if !ok {
+		s = &fakeStream{lastID: "0-0", groups: map[string]*fakeGroup{}}
+		f.streams[name] = s
+	}
+	return s
+}
+
+func (s *fakeStream) entry(id string) (redis.XMessage, bool) {
+	for _, e := range s.entries {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return redis.XMessage{}, false
+}
+
+func (s *fakeStream) group(name string) (*fakeGroup, error) {
+	g, ok := s.groups[name]
+	if !ok {
+		return nil, fmt.Errorf("NOGROUP No such consumer group '%s'", name)
+	}
+	return g, nil
+}
+
+// sortedPending returns the ids of the pending entries of the group in stream order
+func (g *fakeGroup) sortedPending() []string {
+	ids := make([]string, 0, len(g.pending))
+	for id := range g.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return compareIDs(ids[i], ids[j]) < 0 })
+	return ids
+}
+
+// claim hands a pending entry to consumer and counts the delivery like XCLAIM does
+func (g *fakeGroup) claim(id, consumer string) {
+	p := g.pending[id]
+	p.consumer, p.deliveries, p.deliveredAt = consumer, p.deliveries+1, time.Now()
+	g.consumers[consumer] = time.Now()
+}
+
+func (f *fakeRedis) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewStringCmd(ctx)
+	if err := f.err("xadd"); err != nil {
+		cmd.SetErr(err)
+		return cmd
+	}
+	values := map[string]interface{}{}
+	for k, v := range a.Values.(map[string]interface{}) {
+		switch v := v.(type) {
+		case bool: // go-redis writes a bool as 1 or 0
+			if v {
+				values[k] = "1"
+			} else {
+				values[k] = "0"
+			}
+		default:
+			values[k] = fmt.Sprint(v)
+		}
+	}
+	s := f.stream(a.Stream)
+	f.seq++
+	id := fmt.Sprintf("%d-0", f.seq)
+	s.entries = append(s.entries, redis.XMessage{ID: id, Values: values})
+	s.lastID = id
+	cmd.SetVal(id)
+	return cmd
+}
+
+func (f *fakeRedis) XDel(ctx context.Context, stream string, ids ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	s, ok := f.streams[stream]
+	if !ok {
+		return cmd
+	}
+	var n int64
+	for _, id := range ids {
+		for i, e := range s.entries {
+			if e.ID == id {
+				s.entries = append(s.entries[:i], s.entries[i+1:]...)
+				n++
+				break
+			}
+		}
+	}
+	cmd.SetVal(n)
+	return cmd
+}
+
+func (f *fakeRedis) XRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewXMessageSliceCmd(ctx)
+	var res []redis.XMessage
+	if s, ok := f.streams[stream]; ok {
+		for _, e := range s.entries {
+			if inRange(e.ID, start, stop) && int64(len(res)) < count {
+				res = append(res, e)
+			}
+		}
+	}
+	cmd.SetVal(res)
+	return cmd
+}
+
+func (f *fakeRedis) XInfoStream(ctx context.Context, stream string) *redis.XInfoStreamCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewXInfoStreamCmd(ctx, stream)
+	s, ok := f.streams[stream]
+	if !ok {
+		cmd.SetErr(errors.New("ERR no such key"))
+		return cmd
+	}
+	cmd.SetVal(&redis.XInfoStream{Length: int64(len(s.entries)), LastGeneratedID: s.lastID, Groups: int64(len(s.groups))})
+	return cmd
+}
+
+func (f *fakeRedis) XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewStatusCmd(ctx)
+	s := f.stream(stream)
+	if _, ok := s.groups[group]; ok {
+		cmd.SetErr(errors.New("BUSYGROUP Consumer Group name already exists"))
+		return cmd
+	}
+	if start == "$" {
+		start = s.lastID
+	}
+	s.groups[group] = &fakeGroup{lastDelivered: start, pending: map[string]*fakePending{}, consumers: map[string]time.Time{}}
+	cmd.SetVal("OK")
+	return cmd
+}
+
+func (f *fakeRedis) XGroupSetID(ctx context.Context, stream, group, start string) *redis.StatusCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewStatusCmd(ctx)
+	g, err := f.stream(stream).group(group)
+	if err != nil {
+		cmd.SetErr(err)
+		return cmd
+	}
+	g.lastDelivered = start
+	cmd.SetVal("OK")
+	return cmd
+}
+
+func (f *fakeRedis) XGroupDestroy(ctx context.Context, stream, group string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	if s, ok := f.streams[stream]; ok {
+		if _, ok := s.groups[group]; ok {
+			delete(s.groups, group)
+			cmd.SetVal(1)
+		}
+	}
+	return cmd
+}
+
+func (f *fakeRedis) XInfoGroups(ctx context.Context, stream string) *redis.XInfoGroupsCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewXInfoGroupsCmd(ctx, stream)
+	s, ok := f.streams[stream]
+	if !ok {
+		cmd.SetErr(errors.New("ERR no such key"))
+		return cmd
+	}
+	var res []redis.XInfoGroup
+	for name, g := range s.groups {
+		res = append(res, redis.XInfoGroup{Name: name, Consumers: int64(len(g.consumers)), Pending: int64(len(g.pending)), LastDeliveredID: g.lastDelivered})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	cmd.SetVal(res)
+	return cmd
+}
+
+func (f *fakeRedis) XInfoConsumers(ctx context.Context, stream, group string) *redis.XInfoConsumersCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewXInfoConsumersCmd(ctx, stream, group)
+	g, err := f.stream(stream).group(group)
+	if err != nil {
+		cmd.SetErr(err)
+		return cmd
+	}
+	var res []redis.XInfoConsumer
+	for name, seen := range g.consumers {
+		var pending int64
+		for _, p := range g.pending {
+			if p.consumer == name {
+				pending++
+			}
+		}
+		res = append(res, redis.XInfoConsumer{Name: name, Pending: pending, Idle: time.Since(seen), Inactive: time.Since(seen)})
+	}
+	cmd.SetVal(res)
+	return cmd
+}
+
+// addConsumer registers a consumer of the group which last read idle ago
+func (f *fakeRedis) addConsumer(stream, group, consumer string, idle time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streams[stream].groups[group].consumers[consumer] = time.Now().Add(-idle)
+}
+
+func (f *fakeRedis) XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewXStreamSliceCmd(ctx)
+	stream := a.Streams[0]
+	g, err := f.stream(stream).group(a.Group)
+	if err != nil {
+		cmd.SetErr(err)
+		return cmd
+	}
+	g.consumers[a.Consumer] = time.Now()
+	var messages []redis.XMessage
+	for _, e := range f.streams[stream].entries {
+		if compareIDs(e.ID, g.lastDelivered) <= 0 || (a.Count > 0 && int64(len(messages)) >= a.Count) {
+			continue
+		}
+		messages = append(messages, e)
+		g.lastDelivered = e.ID
+		g.pending[e.ID] = &fakePending{consumer: a.Consumer, deliveries: 1, deliveredAt: time.Now()}
+	}
+	if len(messages) == 0 {
+		cmd.SetErr(redis.Nil)
+		return cmd
+	}
+	cmd.SetVal([]redis.XStream{{Stream: stream, Messages: messages}})
+	return cmd
+}
+
+func (f *fakeRedis) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	g, err := f.stream(stream).group(group)
+	if err != nil {
+		cmd.SetErr(err)
+		return cmd
+	}
+	var n int64
+	for _, id := range ids {
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			n++
+		}
+	}
+	cmd.SetVal(n)
+	return cmd
+}
+
+func (f *fakeRedis) XPendingExt(ctx context.Context, a *redis.XPendingExtArgs) *redis.XPendingExtCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewXPendingExtCmd(ctx)
+	g, err := f.stream(a.Stream).group(a.Group)
+	if err != nil {
+		cmd.SetErr(err)
+		return cmd
+	}
+	var res []redis.XPendingExt
+	for _, id := range g.sortedPending() {
+		p := g.pending[id]
+		if !inRange(id, a.Start, a.End) || (a.Consumer != "" && p.consumer != a.Consumer) || int64(len(res)) >= a.Count {
+			continue
+		}
+		res = append(res, redis.XPendingExt{ID: id, Consumer: p.consumer, Idle: time.Since(p.deliveredAt), RetryCount: p.deliveries})
+	}
+	cmd.SetVal(res)
+	return cmd
+}
+
+func (f *fakeRedis) XClaim(ctx context.Context, a *redis.XClaimArgs) *redis.XMessageSliceCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewXMessageSliceCmd(ctx)
+	s := f.stream(a.Stream)
+	g, err := s.group(a.Group)
+	if err != nil {
+		cmd.SetErr(err)
+		return cmd
+	}
+	var res []redis.XMessage
+	for _, id := range a.Messages {
+		p, ok := g.pending[id]
+		if !ok || time.Since(p.deliveredAt) < a.MinIdle {
+			continue
+		}
+		g.claim(id, a.Consumer)
+		if e, ok := s.entry(id); ok {
+			res = append(res, e)
+		}
+	}
+	cmd.SetVal(res)
+	return cmd
+}
+
+func (f *fakeRedis) XAutoClaim(ctx context.Context, a *redis.XAutoClaimArgs) *redis.XAutoClaimCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewXAutoClaimCmd(ctx)
+	s := f.stream(a.Stream)
+	g, err := s.group(a.Group)
+	if err != nil {
+		cmd.SetErr(err)
+		return cmd
+	}
+	var (
+		res  []redis.XMessage
+		next = "0-0"
+	)
+	for _, id := range g.sortedPending() {
+		if compareIDs(id, a.Start) < 0 || time.Since(g.pending[id].deliveredAt) < a.MinIdle {
+			continue
+		}
+		if int64(len(res)) >= a.Count {
+			next = id
+			break
+		}
+		g.claim(id, a.Consumer)
+		if e, ok := s.entry(id); ok {
+			res = append(res, e)
+		}
+	}
+	cmd.SetVal(res, next)
+	return cmd
+}
+
+func (f *fakeRedis) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	h, ok := f.hashes[key]
+	if !ok {
+		h = map[string]string{}
+		f.hashes[key] = h
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		h[fmt.Sprint(values[i])] = fmt.Sprint(values[i+1])
+	}
+	cmd.SetVal(int64(len(values) / 2))
+	return cmd
+}
+
+func (f *fakeRedis) HGetAll(ctx context.Context, key string) *redis.MapStringStringCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewMapStringStringCmd(ctx)
+	res := map[string]string{}
+	for k, v := range f.hashes[key] {
+		res[k] = v
+	}
+	cmd.SetVal(res)
+	return cmd
+}
+
+func (f *fakeRedis) HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	for _, field := range fields {
+		delete(f.hashes[key], field)
+	}
+	return cmd
+}
+
+func (f *fakeRedis) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewBoolCmd(ctx)
+	if _, ok := f.strings[key]; ok {
+		cmd.SetVal(false)
+		return cmd
+	}
+	f.strings[key] = fmt.Sprint(value)
+	cmd.SetVal(true)
+	return cmd
+}
+
+func (f *fakeRedis) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	for _, key := range keys {
+		delete(f.strings, key)
+		delete(f.lists, key)
+		delete(f.hashes, key)
+	}
+	return cmd
+}
+
+func (f *fakeRedis) RPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	for _, v := range values {
+		f.lists[key] = append(f.lists[key], fmt.Sprintf("%s", v))
+	}
+	cmd.SetVal(int64(len(f.lists[key])))
+	return cmd
+}
+
+func (f *fakeRedis) LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := redis.NewStringSliceCmd(ctx)
+	cmd.SetVal(append([]string{}, f.lists[key]...)) // the package only reads whole lists
+	return cmd
+}
+
+func (f *fakeRedis) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	cmd := redis.NewBoolCmd(ctx)
+	cmd.SetVal(true)
+	return cmd
+}
+
+// Pipelined runs the commands of fn right away, their results are set when Pipelined returns like with redis
+func (f *fakeRedis) Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	return nil, fn(fakePipeliner{fake: f})
+}
+
+type fakePipeliner struct {
+	redis.Pipeliner
+	fake *fakeRedis
+}
+
+func (p fakePipeliner) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	return p.fake.XAck(ctx, stream, group, ids...)
+}
+
+func (p fakePipeliner) XPendingExt(ctx context.Context, a *redis.XPendingExtArgs) *redis.XPendingExtCmd {
+	return p.fake.XPendingExt(ctx, a)
+}
+
+func (p fakePipeliner) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	return p.fake.Del(ctx, keys...)
+}
+
+func (p fakePipeliner) RPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	return p.fake.RPush(ctx, key, values...)
+}
+
+func (p fakePipeliner) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	return p.fake.Expire(ctx, key, expiration)
+}
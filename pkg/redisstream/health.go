@@ -0,0 +1,73 @@
+package redisstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// consumer is the state of the stream listener as seen by the readiness checks
+var consumer struct {
+	sync.Mutex
+	running bool
+	readErr error // error of the last XREADGROUP, nil once a read succeeds again
+}
+
+func setConsumerRunning(running bool) {
+	consumer.Lock()
+	consumer.running = running
+	consumer.Unlock()
+}
+
+func setConsumerReadError(err error) {
+	consumer.Lock()
+	consumer.readErr = err
+	consumer.Unlock()
+}
+
+// Ping is the readiness check of redis
+func Ping(ctx context.Context) error {
+	if RedisClient == nil {
+		return errors.New("redis client is not initialized")
+	}
+	return RedisClient.Ping(ctx).Err()
+}
+
+// CheckConsumer is the readiness check of the stream listener, without it the cache would silently go stale
+func CheckConsumer(ctx context.Context) error {
+	consumer.Lock()
+	defer consumer.Unlock()
+	if !consumer.running {
+		return errors.New("stream consumer is not running")
+	}
+	if consumer.readErr != nil {
+		return fmt.Errorf("reading the stream failed: %w", consumer.readErr)
+	}
+	return nil
+}
+
+// CheckLag fails when more than health.maxConsumerLag stream entries have not been delivered to our consumer group yet.
+// redis reports -1 when it can not tell the lag (e.g. after entries were deleted), that is not treated as a failure
+func CheckLag(ctx context.Context) error {
+	if RedisClient == nil {
+		return errors.New("redis client is not initialized")
+	}
+	stream, group := streamName(), consumerGroup()
+	groups, err := RedisClient.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Name != group {
+			continue
+		}
+		if maxLag := viper.GetInt64("health.maxConsumerLag"); maxLag > 0 && g.Lag > maxLag {
+			return fmt.Errorf("consumer group %s is %d entries behind, the limit is %d", group, g.Lag, maxLag)
+		}
+		return nil
+	}
+	return fmt.Errorf("consumer group %s does not exist on stream %s", group, stream)
+}
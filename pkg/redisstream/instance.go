@@ -0,0 +1,141 @@
+package redisstream
+
+// instance.go gives every instance its own consumer group on the change stream. redis hands each entry of a stream to
+// one consumer per group, so with a shared group a change only reached one worker. with a group per instance every
+// worker reads every change (fan-out) and keeps its own offset and pending entries list.
+//
+// the group is named <consumerGroupPrefix>.<instance id>. the instance id comes from TARGETAD_INSTANCE_ID, app.instanceId
+// or the hostname, in that order. it must be unique and should be stable across restarts (e.g. the pod name of a
+// statefulset), a restarted instance then resumes its group where it stopped. every instance writes a heartbeat and
+// the groups of instances which are gone are destroyed by cleanupDeadGroups, otherwise they would pile up.
+//
+// before every instance had its own group all of them shared the group named like the prefix (targeted_ads_group).
+// nothing reads it anymore after the upgrade, but its pending entries pin stream entries and skew the lag, so it is
+// destroyed as well once none of its consumers read for groupIdleTimeout seconds
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/spf13/viper"
+)
+
+var (
+	instanceOnce sync.Once
+	instanceID   string
+)
+
+// InstanceID returns the unique id of this instance, it is also the consumer name in our group
+func InstanceID() string {
+	instanceOnce.Do(func() {
+		instanceID = os.Getenv("TARGETAD_INSTANCE_ID")
+		if instanceID == "" {
+			instanceID = viper.GetString("app.instanceId")
+		}
+		if instanceID == "" {
+			instanceID, _ = os.Hostname()
+		}
+		if instanceID == "" {
+			instanceID = "unknown"
+		}
+	})
+	return instanceID
+}
+
+func streamName() string {
+	return clusterKey(viper.GetString("redis.redisStream.streamName"))
+}
+
+// consumerGroup is the consumer group of this instance
+func consumerGroup() string {
+	return groupPrefix() + InstanceID()
+}
+
+func consumerName() string {
+	return InstanceID()
+}
+
+func groupPrefix() string {
+	return viper.GetString("redis.redisStream.consumerGroupPrefix") + "."
+}
+
+// legacyConsumerGroup is the group all the instances shared before every instance had its own
+func legacyConsumerGroup() string {
+	return viper.GetString("redis.redisStream.consumerGroupPrefix")
+}
+
+func instancesKey() string {
+	return streamName() + ":instances"
+}
+
+// heartbeat records that this instance is alive, cleanupDeadGroups of the other instances reads it
+func heartbeat(ctx context.Context) error {
+	return RedisClient.HSet(ctx, instancesKey(), InstanceID(), time.Now().UnixMilli()).Err()
+}
+
+// cleanupDeadGroups destroys the groups of other instances which did not send a heartbeat for
+// redis.redisStream.groupIdleTimeout seconds. a group without any heartbeat (e.g. its instance never finished
+// starting) is destroyed once none of its consumers read the stream for that long, like the legacy shared group
+func cleanupDeadGroups(ctx context.Context) {
+	stream, prefix := streamName(), groupPrefix()
+	idleTimeout := time.Duration(viper.GetInt("redis.redisStream.groupIdleTimeout")) * time.Second
+	groups, err := RedisClient.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		level.Error(streamLogger()).Log("msg", "error listing consumer groups", "err", err)
+		return
+	}
+	lastSeen, err := RedisClient.HGetAll(ctx, instancesKey()).Result()
+	if err != nil {
+		level.Error(streamLogger()).Log("msg", "error reading instance heartbeats", "err", err)
+		return
+	}
+	for _, g := range groups {
+		var instance string
+		switch {
+		case g.Name == legacyConsumerGroup():
+			if !consumersIdle(ctx, stream, g.Name, idleTimeout) {
+				continue // instances of an older release still read with it
+			}
+		case strings.HasPrefix(g.Name, prefix) && g.Name != consumerGroup():
+			instance = strings.TrimPrefix(g.Name, prefix)
+			if seen, ok := lastSeen[instance]; ok {
+				if ms, err := strconv.ParseInt(seen, 10, 64); err == nil && time.Since(time.UnixMilli(ms)) < idleTimeout {
+					continue
+				}
+			} else if !consumersIdle(ctx, stream, g.Name, idleTimeout) {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := RedisClient.XGroupDestroy(ctx, stream, g.Name).Err(); err != nil {
+			level.Error(streamLogger()).Log("msg", "error destroying consumer group", "group", g.Name, "err", err)
+			continue
+		}
+		if instance != "" {
+			RedisClient.HDel(ctx, instancesKey(), instance)
+		}
+		groupsDestroyed.Add(1)
+		level.Info(streamLogger()).Log("msg", "destroyed consumer group of a dead instance", "group", g.Name, "pending", g.Pending)
+	}
+}
+
+// consumersIdle reports whether no consumer of the group read the stream within timeout
+func consumersIdle(ctx context.Context, stream, group string, timeout time.Duration) bool {
+	consumers, err := RedisClient.XInfoConsumers(ctx, stream, group).Result()
+	if err != nil {
+		level.Error(streamLogger()).Log("msg", "error listing consumers", "group", group, "err", err)
+		return false
+	}
+	for _, c := range consumers {
+		if c.Idle < timeout {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package redisstream
+
+import (
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stream consumer metrics, labelled with the table the message is about
+var (
+	messagesProcessed = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "stream", Name: "messages_processed_total",
+		Help: "Number of stream messages applied to the cache.",
+	}, []string{"table"})
+	messagesFailed = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "stream", Name: "messages_failed_total",
+		Help: "Number of stream messages which could not be applied, they stay pending and are retried.",
+	}, []string{"table"})
+	messagesAcked = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "stream", Name: "messages_acked_total",
+		Help: "Number of stream messages acknowledged to the consumer group.",
+	}, []string{"table"})
+	messagesRetried = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "stream", Name: "messages_retried_total",
+		Help: "Number of attempts at stream messages which were delivered before.",
+	}, []string{"table"})
+	messagesClaimed = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "stream", Name: "messages_claimed_total",
+		Help: "Number of pending stream messages taken over from idle consumers.",
+	}, nil)
+	messagesDeadLettered = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "stream", Name: "messages_dead_lettered_total",
+		Help: "Number of stream messages moved to the dead-letter stream, by reason.",
+	}, []string{"reason"})
+	outboxPushed = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "outbox", Name: "pushed_total",
+		Help: "Number of outbox changes pushed to the stream.",
+	}, []string{"table"})
+	outboxPushFailures = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "outbox", Name: "push_failures_total",
+		Help: "Number of failed pushes of an outbox change, the change stays in the outbox.",
+	}, nil)
+	outboxBacklog = kitprometheus.NewGaugeFrom(prometheus.GaugeOpts{
+		Namespace: "targetad", Subsystem: "outbox", Name: "backlog",
+		Help: "Number of changes waiting in the outbox after the last drain, only reported by the listening instance.",
+	}, nil)
+	groupsDestroyed = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "stream", Name: "groups_destroyed_total",
+		Help: "Number of consumer groups of dead instances destroyed by this instance.",
+	}, nil)
+	processingLatency = kitprometheus.NewHistogramFrom(prometheus.HistogramOpts{
+		Namespace: "targetad", Subsystem: "stream", Name: "processing_duration_seconds",
+		Help:    "Time spent applying one stream message to the cache, including the db fetch.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"table"})
+)
@@ -0,0 +1,115 @@
+package redisstream
+
+// outbox.go pushes the change_outbox rows written by the notify trigger to the redis stream. a row is deleted only
+// after XADD succeeded, so a change is never lost while redis is down. when the delete fails after a successful push
+// the change is pushed twice, applying a change to the cache twice is harmless (at least once delivery)
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	dbpkg "targetad/pkg/db"
+	"targetad/pkg/target/model"
+	"targetad/pkg/tracing"
+
+	"github.com/go-kit/log/level"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// outboxStore is the part of the database the drain uses
+type outboxStore interface {
+	ListChangeOutbox(ctx context.Context, limit int32) ([]dbpkg.ChangeOutbox, error)
+	DeleteChangeOutbox(ctx context.Context, id int64) error
+	RecordChangeOutboxFailure(ctx context.Context, id int64, lastError string) error
+	CountChangeOutbox(ctx context.Context) (int64, error)
+}
+
+// outboxConn returns the database holding the outbox, nil when it is not connected. replaced in the tests
+var outboxConn = func() outboxStore {
+	if conn := dbpkg.GetConn(); conn != nil {
+		return conn
+	}
+	return nil
+}
+
+// outboxRetryBackoff is how long the listener waits before the next drain when the last failures drains failed,
+// it doubles per failure from outbox.retryBackoff up to outbox.retryBackoffMax seconds
+func outboxRetryBackoff(failures int) time.Duration {
+	backoff := time.Duration(viper.GetInt("outbox.retryBackoff")) * time.Second
+	maxBackoff := time.Duration(viper.GetInt("outbox.retryBackoffMax")) * time.Second
+	for i := 1; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// drainOutbox pushes the outbox to the stream in id order until it is empty. it stops at the first row which can not
+// be pushed, the rows after it wait so the order of the changes is kept. checkLease runs before every batch, the
+// drain stops with its error once this instance is no longer the leader
+func drainOutbox(ctx context.Context, checkLease func(context.Context) error) (err error) {
+	ctx, span := tracing.Start(ctx, "outbox.drain")
+	pushed := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("targetad.outbox.pushed", pushed))
+		tracing.End(span, err)
+		if conn := outboxConn(); conn != nil {
+			if backlog, err := conn.CountChangeOutbox(ctx); err == nil {
+				outboxBacklog.Set(float64(backlog))
+			}
+		}
+	}()
+
+	conn := outboxConn()
+	if conn == nil {
+		return errors.New("database connection is nil")
+	}
+	batchSize := viper.GetInt32("outbox.batchSize")
+	for {
+		if err := checkLease(ctx); err != nil {
+			return err
+		}
+		changes, err := conn.ListChangeOutbox(ctx, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err := PushToRedisStream(ctx, changeEvent(change)); err != nil {
+				outboxPushFailures.Add(1)
+				if err := conn.RecordChangeOutboxFailure(ctx, change.ID, err.Error()); err != nil {
+					level.Warn(streamLogger()).Log("msg", "error recording outbox failure", "outbox_id", change.ID, "err", err)
+				}
+				return err
+			}
+			outboxPushed.With("table", change.TableName).Add(1)
+			pushed++
+			if err := conn.DeleteChangeOutbox(ctx, change.ID); err != nil {
+				return err // pushed again by the next drain
+			}
+			level.Debug(streamLogger()).Log("msg", "pushed change to redis stream", "outbox_id", change.ID, "table", change.TableName, "id", change.RowID, "is_deleted", change.IsDeleted)
+		}
+		if int32(len(changes)) < batchSize {
+			return nil
+		}
+	}
+}
+
+// changeEvent turns an outbox row into the event pushed to the stream. rows written by the trigger before the
+// change_event_images migration have no operation and go out as version 1
+func changeEvent(change dbpkg.ChangeOutbox) *model.ChangeEvent {
+	event := &model.ChangeEvent{Version: 1, Table: change.TableName, ID: change.RowID, IsDeleted: change.IsDeleted}
+	if change.Operation == nil {
+		return event
+	}
+	event.Version = model.ChangeEventVersion
+	event.Operation = model.ChangeOperation(*change.Operation)
+	event.Old, event.New = change.OldRow, change.NewRow
+	if change.TxID != nil {
+		event.TxID = *change.TxID
+	}
+	if change.LSN != nil {
+		event.LSN = *change.LSN
+	}
+	return event
+}
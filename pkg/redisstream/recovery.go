@@ -0,0 +1,134 @@
+package redisstream
+
+// recovery.go retries the entries of the pending entries list (PEL). XREADGROUP with ">" only hands out new messages,
+// a message which failed or whose consumer died before XACK stays pending until somebody claims it. that happens here:
+//   - our own pending entries are claimed again once they have been idle for the backoff of their attempt
+//   - entries of other consumers idle longer than recovery.claimMinIdle are taken over with XAUTOCLAIM, their
+//     consumer is assumed to be dead
+//
+// the attempt of a message is the delivery counter redis keeps in the PEL, every XREADGROUP and claim increments it.
+// XAUTOCLAIM does not skip our own entries, so a backoff longer than claimMinIdle is cut short at claimMinIdle
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+func recoveryInterval() time.Duration {
+	return time.Duration(viper.GetInt("redis.redisStream.recovery.interval")) * time.Second
+}
+
+// retryBackoff is how long a message which failed attempt times waits before it is tried again,
+// it doubles with every attempt up to recovery.retryBackoffMax
+func retryBackoff(attempt int64) time.Duration {
+	backoff := time.Duration(viper.GetInt("redis.redisStream.recovery.retryBackoff")) * time.Second
+	maxBackoff := time.Duration(viper.GetInt("redis.redisStream.recovery.retryBackoffMax")) * time.Second
+	for i := int64(1); i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// recoverPending retries our own pending entries and takes over the ones of dead consumers. ctx stops the
+// recovery between two messages, processCtx is used for the processing itself like in the listener
+func recoverPending(ctx, processCtx context.Context) {
+	stream, group := streamName(), consumerGroup()
+	batchSize := viper.GetInt64("redis.redisStream.recovery.batchSize")
+
+	// entries of other consumers first, once claimed they are ours and are retried right away
+	claimIdle := time.Duration(viper.GetInt("redis.redisStream.recovery.claimMinIdle")) * time.Second
+	cursor := "0-0"
+	for ctx.Err() == nil {
+		messages, next, err := RedisClient.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream: stream, Group: group, Consumer: consumerName(), MinIdle: claimIdle, Start: cursor, Count: batchSize,
+		}).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				level.Error(streamLogger()).Log("msg", "error claiming idle pending entries", "err", err)
+			}
+			return
+		}
+		if len(messages) > 0 {
+			messagesClaimed.Add(float64(len(messages)))
+			level.Info(streamLogger()).Log("msg", "claimed idle pending entries", "count", len(messages))
+			attempts := deliveryCounts(ctx, stream, group, messages)
+			for _, message := range messages {
+				if ctx.Err() != nil {
+					return
+				}
+				handleMessage(processCtx, message, attempts[message.ID])
+			}
+		}
+		if next == "0-0" {
+			break // the whole PEL was scanned
+		}
+		cursor = next
+	}
+
+	// our own entries whose backoff is over. XCLAIM to ourselves increments the delivery counter and resets the idle time
+	start := "-"
+	for ctx.Err() == nil {
+		pending, err := RedisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream, Group: group, Consumer: consumerName(), Start: start, End: "+", Count: batchSize,
+		}).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				level.Error(streamLogger()).Log("msg", "error listing pending entries", "err", err)
+			}
+			return
+		}
+		for _, entry := range pending {
+			if ctx.Err() != nil {
+				return
+			}
+			backoff := retryBackoff(entry.RetryCount)
+			if entry.Idle < backoff {
+				continue
+			}
+			messages, err := RedisClient.XClaim(ctx, &redis.XClaimArgs{
+				Stream: stream, Group: group, Consumer: consumerName(), MinIdle: backoff, Messages: []string{entry.ID},
+			}).Result()
+			if err != nil {
+				level.Error(streamLogger()).Log("msg", "error claiming pending entry", "message_id", entry.ID, "err", err)
+				continue
+			}
+			// nothing comes back when the entry was acked meanwhile or trimmed from the stream
+			for _, message := range messages {
+				handleMessage(processCtx, message, entry.RetryCount+1)
+			}
+		}
+		if len(pending) == 0 || int64(len(pending)) < batchSize {
+			return
+		}
+		start = "(" + pending[len(pending)-1].ID
+	}
+}
+
+// deliveryCounts looks up the delivery counter of claimed messages, a message which is missing counts as attempt 1
+func deliveryCounts(ctx context.Context, stream, group string, messages []redis.XMessage) map[string]int64 {
+	attempts := make(map[string]int64, len(messages))
+	cmds := make([]*redis.XPendingExtCmd, len(messages))
+	_, err := RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, message := range messages {
+			attempts[message.ID] = 1
+			cmds[i] = pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: stream, Group: group, Consumer: consumerName(), Start: message.ID, End: message.ID, Count: 1,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		level.Warn(streamLogger()).Log("msg", "error reading delivery counters", "err", err)
+		return attempts
+	}
+	for _, cmd := range cmds {
+		for _, entry := range cmd.Val() {
+			attempts[entry.ID] = entry.RetryCount
+		}
+	}
+	return attempts
+}
@@ -2,175 +2,376 @@ package redisstream
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"strconv"
 	"strings"
-	dbpkg "targetad/pkg/db"
+	"targetad/pkg/leader"
+	"targetad/pkg/logger"
 	"targetad/pkg/target"
+	"targetad/pkg/target/model"
+	"targetad/pkg/tracing"
 
 	// "targetad/pkg/target"
 	"time"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/redis/go-redis/v9"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	ctx         = context.Background()
-	RedisClient *redis.Client
+	RedisClient redis.UniversalClient // a client, a failover client or a cluster client, see client.go
+	// baseLogger is what the stream workers log to, the startup default until InitRedis is called
+	baseLogger = logger.Get()
 )
 
-// listenForNewDataInPgsql listens for new data's <tablename:primarykey> in PostgreSQL and once new data lands on our 2 tables
+// ListenForNewDataInPgsql listens for new data's <tablename:primarykey> in PostgreSQL and once new data lands on our tables
 // it will write into our redis stream which all the microservices can listen to and update their cache with the latest data
-func ListenForNewDataInPgsql(ctx context.Context) {
-	for {
-		err := listen(ctx)
-		log.Printf("listener stopped: %v. Reconnecting in 2s...", err)
-		time.Sleep(2 * time.Second)
-	}
-}
-
-// I am creating a new db connection here because if the connection is lost in our infinite loop
-// I will reconnect it. I am not adding this as part of the InitDB pool function because
-// I want to keep the connection pool alive and not close it unlike init db's pool which closes and the connections in the pool
-func listen(ctx context.Context) error {
-	config := dbpkg.LoadEnv()
-
-	targetDSN := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s",
-		config.User, config.Password, config.Host, config.Port, config.Name, config.SSLMode)
-
-	conn, err := pgx.Connect(ctx, targetDSN)
-	if err != nil {
-		dbErr := fmt.Errorf("failed to connect to PostgreSQL: %v", err)
-		return dbErr
-	}
-	_, err = conn.Exec(ctx, "LISTEN table_changes;")
+// the changes are read from the change_outbox table, see outbox.go. it runs on the leader only, lease is the leadership
+// of the session holding the leader lock (see pkg/leader). the lease is checked before every drain, the function
+// returns when ctx is cancelled, the session is lost or the lease is
+func ListenForNewDataInPgsql(ctx context.Context, lease *leader.Lease) error {
+	conn := lease.Conn()
+	_, err := conn.Exec(ctx, "LISTEN table_changes;")
 	if err != nil {
 		return fmt.Errorf("listen exec: %w", err)
 	}
 
-	log.Println("Connected and listening on 'table_changes'...")
+	level.Info(streamLogger()).Log("msg", "connected and listening on table_changes")
 
+	// the notification only wakes us up, the changes themselves are read from the outbox. the outbox is also drained
+	// every outbox.pollInterval seconds, that picks up the changes written while nobody was listening and retries
+	// the ones which could not be pushed
+	pollInterval := time.Duration(viper.GetInt("outbox.pollInterval")) * time.Second
+	var (
+		failures int
+		retryAt  time.Time
+	)
 	for {
-		notification, err := conn.WaitForNotification(ctx)
-		if err != nil {
+		waitCtx, cancel := context.WithTimeout(ctx, pollInterval)
+		notification, err := conn.WaitForNotification(waitCtx)
+		cancel()
+		if err != nil && (ctx.Err() != nil || !errors.Is(err, context.DeadlineExceeded)) {
 			return fmt.Errorf("wait failed: %w", err)
 		}
+		if time.Now().Before(retryAt) {
+			continue // the last drain failed, the changes stay in the outbox until the backoff is over
+		}
 
-		log.Printf("Change received from pgsql:")
-		table, id, isdeleted, err := parsePgsqlNotificationPayload(notification.Payload)
-		if err != nil {
-			log.Printf("Error parsing notification payload: %v", err)
-			continue
+		drainCtx := ctx
+		var span trace.Span
+		if notification != nil {
+			// every change starts a new trace here, it is carried through the stream to the workers
+			drainCtx, span = tracing.Start(ctx, "pgsql.notify", trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithNewRoot(), trace.WithAttributes(attribute.String("messaging.destination.name", notification.Channel)))
+			level.Debug(streamLogger()).Log("msg", "received pgsql notification", "payload", notification.Payload)
+		}
+		err = drainOutbox(drainCtx, lease.Check)
+		if span != nil {
+			tracing.End(span, err)
 		}
-		err = PushToRedisStream(table, id, isdeleted)
-		if err != nil { // TODO: if it fails to push to redis stream we need to store the data in a queue and retry later
-			log.Printf("Error pushing to Redis stream: %v", err)
+		if errors.Is(err, leader.ErrLeaseLost) {
+			return err // another instance may lead already, publishing on would push every change twice
+		}
+		if err != nil {
+			failures++
+			retryAt = time.Now().Add(outboxRetryBackoff(failures))
+			level.Error(streamLogger()).Log("msg", "error draining the change outbox, retrying", "failures", failures, "retry_at", retryAt, "err", err)
 			continue
 		}
-
-		log.Printf("Pushed to Redis stream: %s:%s:%t", table, id, isdeleted)
+		failures, retryAt = 0, time.Time{}
 	}
 }
 
-func parsePgsqlNotificationPayload(payload string) (string, string, bool, error) {
-	parts := strings.Split(payload, ":") // i am very sure the payload will be in the format of <table_name:primary_key:is_deleted>
-	if len(parts) != 3 {
-		return "", "", false, fmt.Errorf("invalid payload format: %s", payload)
-	}
-	tableName := parts[0]
-	primaryKey := parts[1]
-	isdeleted := parts[2] == "TRUE"
-	return tableName, primaryKey, isdeleted, nil
+func streamLogger() log.Logger {
+	return log.With(baseLogger, "component", "redisstream")
 }
 
-func InitRedis(addr string) error {
-
-	RedisClient = redis.NewClient(&redis.Options{
-		Addr:         addr,
-		Password:     "", // I am not setting any password for now, but you can set it if needed
-		DB:           viper.GetInt("redis.db"),
-		PoolSize:     viper.GetInt("redis.poolSize"),
-		MinIdleConns: viper.GetInt("redis.minIdleConns"),
-		ReadTimeout:  time.Duration(viper.GetInt("redis.readTimeout")) * time.Second,
-		WriteTimeout: time.Duration(viper.GetInt("redis.writeTimeout")) * time.Second,
-		DialTimeout:  time.Duration(viper.GetInt("redis.dialTimeout")) * time.Second, // wait for 5 seconds to establish a dns connection
-	})
-
+// InitRedis connects to redis as configured by redis.mode and checks the connection, see client.go
+func InitRedis(l log.Logger) error {
+	baseLogger = l
+	client, err := newRedisClient()
+	if err != nil {
+		return err
+	}
+	RedisClient = client
 	if err := RedisClient.Ping(ctx).Err(); err != nil {
 		return err
 	}
-	if err := initRedisGroup(); err != nil {
+	level.Info(streamLogger()).Log("msg", "connected to redis", "mode", redisMode())
+	return nil
+}
 
+// StreamOffset returns the id of the last entry of the change stream, 0-0 when the stream does not exist yet.
+// take it before loading the cache and pass it to InitConsumerGroup afterwards
+func StreamOffset(ctx context.Context) (string, error) {
+	info, err := RedisClient.XInfoStream(ctx, streamName()).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return "0-0", nil
+		}
+		return "", err
 	}
-	return nil
+	return info.LastGeneratedID, nil
 }
 
-func initRedisGroup() error {
-	//$ to indicate that we want to read the last message in the stream
+// InitConsumerGroup points the consumer group of this instance (see instance.go) at offset, the stream position taken
+// before the cache was loaded. the changes after it overlap with the snapshot, they are replayed and applying them
+// again is harmless. a group which already exists (a restart with the same instance id) is moved to offset as well,
+// its old position is meaningless for the freshly loaded cache
+func InitConsumerGroup(ctx context.Context, offset string) error {
 	// if the stream does not exist, it will be created automatically
-	// if the group already exists, it will not be created again
-	err := RedisClient.XGroupCreateMkStream(ctx, viper.GetString("redis.redisStream.streamName"), viper.GetString("redis.redisStream.consumerGroup"), "$").Err()
-	if err != nil && !strings.Contains(err.Error(), "BUSYGROUP") {
-		return err
+	err := RedisClient.XGroupCreateMkStream(ctx, streamName(), consumerGroup(), offset).Err()
+	if err != nil && strings.Contains(err.Error(), "BUSYGROUP") {
+		err = RedisClient.XGroupSetID(ctx, streamName(), consumerGroup(), offset).Err()
 	}
-	return nil
+	if err != nil {
+		return fmt.Errorf("error initializing consumer group %s: %w", consumerGroup(), err)
+	}
+	level.Info(streamLogger()).Log("msg", "using consumer group", "group", consumerGroup(), "consumer", consumerName(), "offset", offset)
+	return heartbeat(ctx)
 }
 
-func PushToRedisStream(table string, id string, isDeleted bool) error {
-	_, err := RedisClient.XAdd(ctx, &redis.XAddArgs{
-		Stream: viper.GetString("redis.redisStream.streamName"),
-		Values: map[string]interface{}{
-			"table":      table,
-			"id":         id,
-			"is_deleted": isDeleted,
-			"ts":         time.Now().UnixMilli(),
-		},
+// PushToRedisStream adds the change to the stream. the trace context of ctx goes along in the traceparent field.
+// table, id and is_deleted are written for every version, workers of version 1 read only those
+func PushToRedisStream(ctx context.Context, event *model.ChangeEvent) (err error) {
+	ctx, span := tracing.Start(ctx, "redisstream.push", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(tracing.Table(event.Table)))
+	defer func() { tracing.End(span, err) }()
+
+	values := map[string]interface{}{
+		"table":      event.Table,
+		"id":         event.ID,
+		"is_deleted": event.IsDeleted,
+		"ts":         time.Now().UnixMilli(),
+	}
+	if event.Version > 1 {
+		values["version"] = event.Version
+		values["op"] = string(event.Operation)
+		if event.Old != nil {
+			values["old"] = string(event.Old)
+		}
+		if event.New != nil {
+			values["new"] = string(event.New)
+		}
+		if event.TxID != 0 {
+			values["txid"] = event.TxID
+		}
+		if event.LSN != "" {
+			values["lsn"] = event.LSN
+		}
+	}
+	tracing.InjectStreamFields(ctx, values)
+	_, err = RedisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamName(),
+		Values: values,
 	}).Result()
 	return err
 }
 
+// StartRedisStreamListener reads the stream with the consumer group of this instance until ctx is cancelled. every
+// recovery.interval seconds it also retries the pending entries, see recoverPending, and every groupCleanupInterval
+// seconds it writes the heartbeat of the instance and removes the groups of dead instances. the message being processed when ctx is cancelled
+// is still processed and acknowledged, only then the listener returns. the read blocks for at most consumerBlock seconds
+// so a cancelled ctx is noticed even when the stream is idle
 func StartRedisStreamListener(ctx context.Context) {
+	// processing and acking must not be cut short by the shutdown, otherwise the message stays pending
+	processCtx := context.WithoutCancel(ctx)
+	setConsumerRunning(true)
+	defer setConsumerRunning(false)
+	// entries left pending by a crash of this consumer or of a dead one are picked up before reading new messages
+	recoverPending(ctx, processCtx)
+	lastRecovery, lastCleanup := time.Now(), time.Time{}
 	for {
+		if ctx.Err() != nil {
+			level.Info(streamLogger()).Log("msg", "redis stream listener stopped, shutting down")
+			return
+		}
 		streams, err := RedisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
-			Group:    viper.GetString("redis.redisStream.consumerGroup"),
-			Consumer: viper.GetString("redis.redisStream.consumerName"),
-			Streams:  []string{viper.GetString("redis.redisStream.streamName"), ">"},               // " > " = only get new messages not yet seen by this consumer. ones added after you start listening
+			Group:    consumerGroup(),
+			Consumer: consumerName(),
+			Streams:  []string{streamName(), ">"},                                                  // " > " = only get new messages not yet seen by this consumer. ones added after you start listening
 			Block:    time.Duration(viper.GetInt("redis.redisStream.consumerBlock")) * time.Second, // time i should wait for new messages before returning an empty result
 			Count:    viper.GetInt64("redis.redisStream.consumerCount"),                            // number of records to read in one go
 		}).Result()
+		if err == nil || err == redis.Nil {
+			setConsumerReadError(nil)
+		}
 		if err != nil {
 			if err == redis.Nil {
 				continue // no new messages
 			}
-			log.Printf("Error reading from Redis stream: %v", err)
+			if ctx.Err() != nil {
+				continue // shutting down, the check at the top of the loop returns
+			}
+			level.Error(streamLogger()).Log("msg", "error reading from redis stream", "err", err)
+			setConsumerReadError(err)
 			time.Sleep(2 * time.Second) // wait before retrying
 			continue
 		}
 
 		for _, stream := range streams {
 			for _, message := range stream.Messages {
-				table := message.Values["table"].(string)
-				id := message.Values["id"].(string)
-				isDeleted := message.Values["is_deleted"].(string) == "true"
-				log.Printf("Received message from stream %s: table=%s, id=%s, is_deleted =%t", stream.Stream, table, id, isDeleted)
-				// Process the message received from the stream
-				err = target.ProcessRedisStreamDataService(ctx, table, id, isDeleted)
-				if err != nil {
-					log.Printf("Error processing Redis stream data: %v", err)
-				} else {
-					// Acknowledge the message after processing only after this acknowledgement
-					// the message will be removed from the stream
-					// if you do not acknowledge the message, it will be reprocessed again and again this is the reason why
-					// I am using redis stream instead of redis pub/sub
-					// because in pub/sub you cannot acknowledge the message
-					// and it will be reprocessed again and again
-					if err := RedisClient.XAck(ctx, viper.GetString("redis.redisStream.streamName"), viper.GetString("redis.redisStream.consumerGroup"), message.ID).Err(); err != nil {
-						log.Printf("Error acknowledging message: %v", err)
-					}
-				}
+				handleMessage(processCtx, message, 1)
 			}
 		}
+		if time.Since(lastRecovery) >= recoveryInterval() {
+			recoverPending(ctx, processCtx)
+			lastRecovery = time.Now()
+		}
+		if time.Since(lastCleanup) >= time.Duration(viper.GetInt("redis.redisStream.groupCleanupInterval"))*time.Second {
+			if err := heartbeat(ctx); err != nil && ctx.Err() == nil {
+				level.Error(streamLogger()).Log("msg", "error writing the instance heartbeat", "err", err)
+			}
+			cleanupDeadGroups(ctx)
+			lastCleanup = time.Now()
+		}
+	}
+}
+
+// handleMessage applies one stream message to the cache and acknowledges it. attempt is the delivery counter of the
+// message, 1 for a message read for the first time. a message which fails is not acknowledged, it stays in the
+// pending entries list and is retried by recoverPending until it has failed deadLetter.maxAttempts times.
+// a malformed message is moved to the dead-letter stream right away
+func handleMessage(processCtx context.Context, message redis.XMessage, attempt int64) {
+	if len(message.Values) == 0 {
+		// a pending entry whose message was trimmed from the stream, there is nothing left to apply
+		RedisClient.XAck(processCtx, streamName(), consumerGroup(), message.ID)
+		return
+	}
+	// the span continues the trace started by the pgsql notification on the pushing instance
+	msgCtx, span := tracing.Start(tracing.ExtractStreamFields(processCtx, message.Values), "redisstream.consume",
+		trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attribute.String("messaging.message.id", message.ID),
+			attribute.Int64("targetad.stream.attempt", attempt)))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	event, err := parseStreamMessage(message)
+	if err == nil {
+		err = target.ValidateChangeEvent(event)
+	}
+	if err != nil {
+		messagesFailed.With("table", "unknown").Add(1)
+		recordAttempt(msgCtx, message.ID, attempt, err)
+		if err := deadLetter(msgCtx, message, DeadLetterReasonMalformed, attempt, err); err != nil {
+			level.Error(streamLogger()).Log("msg", "error dead-lettering stream message", "message_id", message.ID, "err", err)
+		}
+		return
+	}
+	table, id := event.Table, event.ID
+	level.Debug(streamLogger()).Log("msg", "received stream message", "message_id", message.ID, "table", table, "id", id, "is_deleted", event.IsDeleted,
+		"version", event.Version, "op", event.Operation, "attempt", attempt)
+	span.SetAttributes(tracing.Table(table), attribute.Int("targetad.change.version", event.Version))
+	if ts, err := strconv.ParseInt(fmt.Sprint(message.Values["ts"]), 10, 64); err == nil {
+		// time the message spent in the stream before this worker read it
+		span.SetAttributes(attribute.Int64("targetad.stream.lag_ms", time.Now().UnixMilli()-ts))
+	}
+	if attempt > 1 {
+		messagesRetried.With("table", table).Add(1)
+	}
+	// Process the message received from the stream
+	begin := time.Now()
+	err = target.ProcessChangeEvent(msgCtx, event)
+	processingLatency.With("table", table).Observe(time.Since(begin).Seconds())
+	if err != nil {
+		messagesFailed.With("table", table).Add(1)
+		level.Error(streamLogger()).Log("msg", "error processing stream message", "message_id", message.ID, "table", table, "id", id, "attempt", attempt, "err", err)
+		recordAttempt(msgCtx, message.ID, attempt, err)
+		reason := DeadLetterReasonMaxAttempts
+		if errors.Is(err, target.ErrMalformedChange) {
+			reason = DeadLetterReasonMalformed
+		} else if max := maxAttempts(); max <= 0 || attempt < max {
+			return // stays pending, recoverPending retries it after the backoff
+		}
+		if err := deadLetter(msgCtx, message, reason, attempt, err); err != nil {
+			level.Error(streamLogger()).Log("msg", "error dead-lettering stream message", "message_id", message.ID, "err", err)
+		}
+		return
+	}
+	messagesProcessed.With("table", table).Add(1)
+	target.RecordAppliedMessage(message.ID)
+	if attempt > 1 {
+		forgetAttempts(msgCtx, message.ID)
+	}
+	// Acknowledge the message after processing only after this acknowledgement
+	// the message will be removed from the stream
+	// if you do not acknowledge the message, it will be reprocessed again and again this is the reason why
+	// I am using redis stream instead of redis pub/sub
+	// because in pub/sub you cannot acknowledge the message
+	// and it will be reprocessed again and again
+	if err := RedisClient.XAck(msgCtx, streamName(), consumerGroup(), message.ID).Err(); err != nil {
+		level.Error(streamLogger()).Log("msg", "error acknowledging stream message", "message_id", message.ID, "err", err)
+	} else {
+		messagesAcked.With("table", table).Add(1)
+	}
+}
+
+// parseStreamMessage reads the fields written by PushToRedisStream, a message without a version is version 1.
+// go-redis writes a bool as "1" or "0", strconv.ParseBool also takes the "true"/"false" of older messages.
+// the fields are checked against the schema of the version by target.ValidateChangeEvent
+func parseStreamMessage(message redis.XMessage) (*model.ChangeEvent, error) {
+	field := func(name string) (string, error) {
+		v, ok := message.Values[name].(string)
+		if !ok {
+			return "", fmt.Errorf("%w: missing field %q", target.ErrMalformedChange, name)
+		}
+		return v, nil
+	}
+	optional := func(name string) (string, bool) {
+		v, ok := message.Values[name].(string)
+		return v, ok
+	}
+	var (
+		event = &model.ChangeEvent{Version: 1}
+		err   error
+	)
+	if event.Table, err = field("table"); err != nil {
+		return nil, err
+	}
+	if event.ID, err = field("id"); err != nil {
+		return nil, err
+	}
+	deleted, err := field("is_deleted")
+	if err != nil {
+		return nil, err
+	}
+	if event.IsDeleted, err = strconv.ParseBool(deleted); err != nil {
+		return nil, fmt.Errorf("%w: invalid is_deleted %q", target.ErrMalformedChange, deleted)
+	}
+	if v, ok := optional("version"); ok {
+		if event.Version, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("%w: invalid version %q", target.ErrMalformedChange, v)
+		}
+	}
+	if event.Version == 1 {
+		return event, nil
+	}
+	op, _ := optional("op")
+	event.Operation = model.ChangeOperation(op)
+	if v, ok := optional("old"); ok {
+		event.Old = json.RawMessage(v)
+	}
+	if v, ok := optional("new"); ok {
+		event.New = json.RawMessage(v)
+	}
+	if v, ok := optional("txid"); ok {
+		if event.TxID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: invalid txid %q", target.ErrMalformedChange, v)
+		}
+	}
+	event.LSN, _ = optional("lsn")
+	return event, nil
+}
+
+// CloseRedis closes the redis client, call it only after the stream listener has returned
+func CloseRedis() error {
+	if RedisClient == nil {
+		return nil
 	}
+	return RedisClient.Close()
 }
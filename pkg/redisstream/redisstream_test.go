@@ -0,0 +1,417 @@
+package redisstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	dbpkg "targetad/pkg/db"
+	"targetad/pkg/leader"
+	"targetad/pkg/target"
+	"targetad/pkg/target/model"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+// TestDeadLetterOncePerMessage tests that a poison message dead-lettered by every instance ends up in the dead-letter
+// stream once and is acked by each of them, and that a failed XADD leaves it to the next attempt
+func TestDeadLetterOncePerMessage(t *testing.T) {
+	fake := useFakeRedis(t)
+	ctx := context.Background()
+	if err := InitConsumerGroup(ctx, "0-0"); err != nil {
+		t.Fatalf("Failed to create the consumer group: %v", err)
+	}
+	id := fake.XAdd(ctx, &redis.XAddArgs{Stream: streamName(), Values: map[string]interface{}{"table": "campaigns", "id": "not-a-uuid", "is_deleted": false}}).Val()
+	message := fake.XReadGroup(ctx, &redis.XReadGroupArgs{Group: consumerGroup(), Consumer: consumerName(), Streams: []string{streamName(), ">"}}).Val()[0].Messages[0]
+
+	fake.failWith("xadd", errors.New("READONLY"))
+	if err := deadLetter(ctx, message, DeadLetterReasonMalformed, 1, errors.New("invalid id")); err == nil {
+		t.Fatal("expected an error when the dead letter can not be added")
+	}
+	if pending := fake.pendingOf(streamName(), consumerGroup()); pending[id] != 1 {
+		t.Fatalf("expected the message to stay pending after a failed XADD, got %v", pending)
+	}
+	fake.failWith("xadd", nil)
+
+	// every instance gives up on the message, the second call stands for another instance
+	for range 2 {
+		if err := deadLetter(ctx, message, DeadLetterReasonMalformed, 1, errors.New("invalid id")); err != nil {
+			t.Fatalf("Failed to dead-letter the message: %v", err)
+		}
+	}
+	letters := fake.entries(deadLetterStream())
+	if len(letters) != 1 || letters[0].Values[dlqOriginalID] != id {
+		t.Fatalf("expected one dead letter of %s, got %v", id, letters)
+	}
+	if pending := fake.pendingOf(streamName(), consumerGroup()); len(pending) != 0 {
+		t.Fatalf("expected the message to be acked, got %v", pending)
+	}
+}
+
+// TestCleanupDeadGroups tests which consumer groups are destroyed: the groups of instances whose heartbeat is too old
+// or which never sent one and are idle, and the legacy shared group once nobody reads with it
+func TestCleanupDeadGroups(t *testing.T) {
+	fake := useFakeRedis(t)
+	ctx := context.Background()
+	idle := 20 * time.Minute // longer than groupIdleTimeout
+	for _, group := range []string{
+		consumerGroup(), "test_group.live", "test_group.dead", "test_group.starting", "test_group.orphan",
+		"test_group", "other_service",
+	} {
+		fake.XGroupCreateMkStream(ctx, streamName(), group, "0-0")
+	}
+	fake.HSet(ctx, instancesKey(), "live", time.Now().UnixMilli(), "dead", time.Now().Add(-idle).UnixMilli())
+	fake.addConsumer(streamName(), "test_group.starting", "starting", time.Second) // no heartbeat yet but reading
+	fake.addConsumer(streamName(), "test_group.orphan", "orphan", idle)
+	fake.addConsumer(streamName(), "test_group", "worker-old", idle)
+	fake.addConsumer(streamName(), "other_service", "other", idle)
+
+	cleanupDeadGroups(ctx)
+	want := []string{"other_service", "test_group.live", "test_group.starting", consumerGroup()}
+	if got := fake.groupNames(streamName()); !slices.Equal(got, want) {
+		t.Fatalf("expected the groups %v to survive, got %v", want, got)
+	}
+	if _, ok := fake.HGetAll(ctx, instancesKey()).Val()["dead"]; ok {
+		t.Fatal("expected the heartbeat of the dead instance to be removed")
+	}
+
+	// the legacy group is kept while an instance of the older release still reads with it
+	fake.XGroupCreateMkStream(ctx, streamName(), "test_group", "0-0")
+	fake.addConsumer(streamName(), "test_group", "worker-old", time.Second)
+	cleanupDeadGroups(ctx)
+	if got := fake.groupNames(streamName()); len(got) != 5 {
+		t.Fatalf("expected the legacy group in use to be kept, got %v", got)
+	}
+}
+
+// TestConsumersIdle tests that a group counts as idle only when every consumer is idle for the timeout
+func TestConsumersIdle(t *testing.T) {
+	fake := useFakeRedis(t)
+	ctx := context.Background()
+	fake.XGroupCreateMkStream(ctx, streamName(), "test_group.a", "0-0")
+	timeout := time.Minute
+	for _, tc := range []struct {
+		name  string
+		idle  []time.Duration
+		group string
+		want  bool
+	}{
+		{"no consumers", nil, "test_group.a", true},
+		{"all idle", []time.Duration{2 * time.Minute, 3 * time.Minute}, "test_group.a", true},
+		{"one reading", []time.Duration{2 * time.Minute, time.Second}, "test_group.a", false},
+		{"unknown group", nil, "test_group.missing", false},
+	} {
+		fake.XGroupDestroy(ctx, streamName(), "test_group.a")
+		fake.XGroupCreateMkStream(ctx, streamName(), "test_group.a", "0-0")
+		for i, idle := range tc.idle {
+			fake.addConsumer(streamName(), "test_group.a", string(rune('a'+i)), idle)
+		}
+		if got := consumersIdle(ctx, streamName(), tc.group, timeout); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+// TestRetryBackoff tests that the backoff doubles per attempt and is capped at retryBackoffMax
+func TestRetryBackoff(t *testing.T) {
+	useFakeRedis(t)
+	for _, tc := range []struct {
+		base, max int
+		attempt   int64
+		want      time.Duration
+	}{
+		{1, 30, 1, time.Second},
+		{1, 30, 2, 2 * time.Second},
+		{1, 30, 3, 4 * time.Second},
+		{1, 30, 5, 16 * time.Second},
+		{1, 30, 6, 30 * time.Second},
+		{1, 30, 50, 30 * time.Second},
+		{40, 30, 1, 30 * time.Second},
+	} {
+		viper.Set("redis.redisStream.recovery.retryBackoff", tc.base)
+		viper.Set("redis.redisStream.recovery.retryBackoffMax", tc.max)
+		if got := retryBackoff(tc.attempt); got != tc.want {
+			t.Errorf("retryBackoff(%d) with %ds up to %ds: expected %s, got %s", tc.attempt, tc.base, tc.max, tc.want, got)
+		}
+	}
+}
+
+// TestDeliveryCounts tests that the attempt of a claimed message is the delivery counter of its pending entry,
+// and 1 for a message which is not pending
+func TestDeliveryCounts(t *testing.T) {
+	fake := useFakeRedis(t)
+	ctx := context.Background()
+	fake.XGroupCreateMkStream(ctx, streamName(), consumerGroup(), "0-0")
+	first := fake.XAdd(ctx, &redis.XAddArgs{Stream: streamName(), Values: map[string]interface{}{"table": "campaigns"}}).Val()
+	second := fake.XAdd(ctx, &redis.XAddArgs{Stream: streamName(), Values: map[string]interface{}{"table": "campaigns"}}).Val()
+	messages := fake.XReadGroup(ctx, &redis.XReadGroupArgs{Group: consumerGroup(), Consumer: consumerName(), Streams: []string{streamName(), ">"}}).Val()[0].Messages
+	for range 2 {
+		fake.age(streamName(), consumerGroup(), second, time.Minute)
+		fake.XClaim(ctx, &redis.XClaimArgs{Stream: streamName(), Group: consumerGroup(), Consumer: consumerName(), Messages: []string{second}})
+	}
+
+	attempts := deliveryCounts(ctx, streamName(), consumerGroup(), append(messages, redis.XMessage{ID: "99-0"}))
+	for id, want := range map[string]int64{first: 1, second: 3, "99-0": 1} {
+		if attempts[id] != want {
+			t.Errorf("expected attempt %d for %s, got %d", want, id, attempts[id])
+		}
+	}
+}
+
+// TestRecoverPending tests the claim flow: our own failed entry is retried once the backoff of its attempt is over
+// and dead-lettered after maxAttempts, and the idle entry of a dead consumer is taken over and applied
+func TestRecoverPending(t *testing.T) {
+	fake := useFakeRedis(t)
+	ctx := context.Background()
+	target.TargetCache = nil // every apply fails with ErrCacheNotReady until the cache is set
+	if err := InitConsumerGroup(ctx, "0-0"); err != nil {
+		t.Fatalf("Failed to create the consumer group: %v", err)
+	}
+	insert := func() string {
+		id := uuid.NewString()
+		image := fmt.Sprintf(`{"id": %q, "campaign_string_id": "spotify", "status": "active", "advertiser_id": %q, "media_type": "banner", "row_version": 1}`, id, uuid.NewString())
+		return pushChange(t, fake, &model.ChangeEvent{Version: 2, Operation: model.ChangeOperationInsert, Table: "campaigns", ID: id, New: json.RawMessage(image)})
+	}
+	failing := insert()
+	message := fake.XReadGroup(ctx, &redis.XReadGroupArgs{Group: consumerGroup(), Consumer: consumerName(), Streams: []string{streamName(), ">"}}).Val()[0].Messages[0]
+	handleMessage(ctx, message, 1)
+
+	recoverPending(ctx, ctx)
+	if pending := fake.pendingOf(streamName(), consumerGroup()); pending[failing] != 1 {
+		t.Fatalf("expected no retry before the backoff is over, got %v", pending)
+	}
+	fake.age(streamName(), consumerGroup(), failing, 2*time.Second)
+	recoverPending(ctx, ctx)
+	if pending := fake.pendingOf(streamName(), consumerGroup()); pending[failing] != 2 {
+		t.Fatalf("expected the second attempt after the backoff, got %v", pending)
+	}
+	fake.age(streamName(), consumerGroup(), failing, time.Second)
+	recoverPending(ctx, ctx)
+	if pending := fake.pendingOf(streamName(), consumerGroup()); pending[failing] != 2 {
+		t.Fatalf("expected the backoff to double after the second attempt, got %v", pending)
+	}
+	fake.age(streamName(), consumerGroup(), failing, 3*time.Second)
+	recoverPending(ctx, ctx)
+	if pending := fake.pendingOf(streamName(), consumerGroup()); len(pending) != 0 {
+		t.Fatalf("expected the message to be dead-lettered after %d attempts, got %v", maxAttempts(), pending)
+	}
+	if letters := fake.entries(deadLetterStream()); len(letters) != 1 || letters[0].Values[dlqReason] != DeadLetterReasonMaxAttempts || letters[0].Values[dlqAttempts] != "3" {
+		t.Fatalf("expected one dead letter after 3 attempts, got %v", letters)
+	}
+
+	// a consumer of the group died with the entry pending
+	orphan := insert()
+	fake.XReadGroup(ctx, &redis.XReadGroupArgs{Group: consumerGroup(), Consumer: "worker-dead", Streams: []string{streamName(), ">"}})
+	recoverPending(ctx, ctx)
+	if pending := fake.pendingOf(streamName(), consumerGroup()); pending[orphan] != 1 {
+		t.Fatalf("expected the entry of the other consumer to wait for claimMinIdle, got %v", pending)
+	}
+	target.TargetCache = &model.TargetingData{Campaigns: map[uuid.UUID]*model.Campaign{}, Advertisers: map[uuid.UUID]*model.Advertiser{},
+		Rules: map[uuid.UUID]*model.TargetingRule{}, Tombstones: map[uuid.UUID]int64{}}
+	defer func() { target.TargetCache = nil }()
+	fake.age(streamName(), consumerGroup(), orphan, 2*time.Minute)
+	recoverPending(ctx, ctx)
+	if pending := fake.pendingOf(streamName(), consumerGroup()); len(pending) != 0 || len(target.TargetCache.Campaigns) != 1 {
+		t.Fatalf("expected the orphaned entry to be claimed and applied, got %v and %d campaigns", pending, len(target.TargetCache.Campaigns))
+	}
+}
+
+// pushChange pushes the change like the outbox does and returns its stream id
+func pushChange(t *testing.T, fake *fakeRedis, event *model.ChangeEvent) string {
+	t.Helper()
+	if err := PushToRedisStream(context.Background(), event); err != nil {
+		t.Fatalf("Failed to push the change: %v", err)
+	}
+	entries := fake.entries(streamName())
+	return entries[len(entries)-1].ID
+}
+
+// fakeOutbox is an in memory change_outbox
+type fakeOutbox struct {
+	rows       []dbpkg.ChangeOutbox
+	failDelete error
+}
+
+func (o *fakeOutbox) ListChangeOutbox(ctx context.Context, limit int32) ([]dbpkg.ChangeOutbox, error) {
+	return append([]dbpkg.ChangeOutbox{}, o.rows[:min(int(limit), len(o.rows))]...), nil
+}
+
+func (o *fakeOutbox) DeleteChangeOutbox(ctx context.Context, id int64) error {
+	if err := o.failDelete; err != nil {
+		o.failDelete = nil
+		return err
+	}
+	o.rows = slices.DeleteFunc(o.rows, func(row dbpkg.ChangeOutbox) bool { return row.ID == id })
+	return nil
+}
+
+func (o *fakeOutbox) RecordChangeOutboxFailure(ctx context.Context, id int64, lastError string) error {
+	for i := range o.rows {
+		if o.rows[i].ID == id {
+			o.rows[i].Attempts++
+			o.rows[i].LastError = &lastError
+		}
+	}
+	return nil
+}
+
+func (o *fakeOutbox) CountChangeOutbox(ctx context.Context) (int64, error) {
+	return int64(len(o.rows)), nil
+}
+
+// useFakeOutbox points the drain at an outbox holding the changes of n campaigns, ids 1 to n in order
+func useFakeOutbox(t *testing.T, n int) *fakeOutbox {
+	outbox := &fakeOutbox{}
+	for i := 1; i <= n; i++ {
+		outbox.rows = append(outbox.rows, dbpkg.ChangeOutbox{ID: int64(i), TableName: "campaigns", RowID: fmt.Sprintf("row-%d", i)})
+	}
+	previous := outboxConn
+	outboxConn = func() outboxStore { return outbox }
+	t.Cleanup(func() { outboxConn = previous })
+	return outbox
+}
+
+// pushedRows returns the row ids of the changes on the stream in stream order
+func pushedRows(fake *fakeRedis) []string {
+	var rows []string
+	for _, entry := range fake.entries(streamName()) {
+		rows = append(rows, entry.Values["id"].(string))
+	}
+	return rows
+}
+
+func leaseHeld(context.Context) error {
+	return nil
+}
+
+// TestDrainOutbox tests the at least once guarantees of the outbox: the changes are pushed in order over several
+// batches, the drain stops at the first failed XADD and a row is deleted only after it was pushed
+func TestDrainOutbox(t *testing.T) {
+	fake := useFakeRedis(t)
+	outbox := useFakeOutbox(t, 5)
+	ctx := context.Background()
+
+	fake.failAfter("xadd", 2, errors.New("LOADING"))
+	if err := drainOutbox(ctx, leaseHeld); err == nil {
+		t.Fatal("expected the drain to fail with redis")
+	}
+	if got := pushedRows(fake); !slices.Equal(got, []string{"row-1", "row-2"}) {
+		t.Fatalf("expected the first two changes to be pushed, got %v", got)
+	}
+	if len(outbox.rows) != 3 || outbox.rows[0].ID != 3 || outbox.rows[0].Attempts != 1 || outbox.rows[0].LastError == nil || outbox.rows[1].Attempts != 0 {
+		t.Fatalf("expected the drain to stop at row 3 and keep it with its failure, got %+v", outbox.rows)
+	}
+
+	fake.failWith("xadd", nil)
+	outbox.failDelete = errors.New("connection reset")
+	if err := drainOutbox(ctx, leaseHeld); err == nil {
+		t.Fatal("expected the drain to fail with the delete")
+	}
+	if len(outbox.rows) != 3 || outbox.rows[0].ID != 3 {
+		t.Fatalf("expected row 3 to stay in the outbox when its delete failed, got %+v", outbox.rows)
+	}
+	if err := drainOutbox(ctx, leaseHeld); err != nil {
+		t.Fatalf("Failed to drain the outbox: %v", err)
+	}
+	if got := pushedRows(fake); !slices.Equal(got, []string{"row-1", "row-2", "row-3", "row-3", "row-4", "row-5"}) || len(outbox.rows) != 0 {
+		t.Fatalf("expected every change pushed in order, row 3 twice, got %v and %d rows left", got, len(outbox.rows))
+	}
+}
+
+// TestDrainOutboxLeaseLost tests that a leader which lost its lease does not push anything
+func TestDrainOutboxLeaseLost(t *testing.T) {
+	fake := useFakeRedis(t)
+	outbox := useFakeOutbox(t, 3)
+	if err := drainOutbox(context.Background(), func(context.Context) error { return leader.ErrLeaseLost }); !errors.Is(err, leader.ErrLeaseLost) {
+		t.Fatalf("expected the lease error, got %v", err)
+	}
+	if got := pushedRows(fake); len(got) != 0 || len(outbox.rows) != 3 {
+		t.Fatalf("expected nothing pushed, got %v", got)
+	}
+}
+
+// TestOutboxRetryBackoff tests that the backoff after failed drains doubles per failure and is capped
+func TestOutboxRetryBackoff(t *testing.T) {
+	viper.Set("outbox.retryBackoff", 1)
+	viper.Set("outbox.retryBackoffMax", 30)
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 16 * time.Second, 6: 30 * time.Second, 100: 30 * time.Second} {
+		if got := outboxRetryBackoff(failures); got != want {
+			t.Errorf("outboxRetryBackoff(%d): expected %s, got %s", failures, want, got)
+		}
+	}
+}
+
+// TestBootstrapOffset tests the gap free start: the offset is 0-0 before the stream exists and its last id after, the
+// group of a restarted instance is moved to the offset and the changes after it are replayed, a change the snapshot
+// contains already is applied without effect
+func TestBootstrapOffset(t *testing.T) {
+	fake := useFakeRedis(t)
+	ctx := context.Background()
+	if offset, err := StreamOffset(ctx); err != nil || offset != "0-0" {
+		t.Fatalf("expected offset 0-0 without a stream, got %q %v", offset, err)
+	}
+
+	campaignID, advertiserID := uuid.New(), uuid.New()
+	update := func(status string, version int) *model.ChangeEvent {
+		image := json.RawMessage(fmt.Sprintf(`{"id": %q, "campaign_string_id": "spotify", "status": %q, "advertiser_id": %q, "media_type": "banner", "row_version": %d}`,
+			campaignID, status, advertiserID, version))
+		return &model.ChangeEvent{Version: 2, Operation: model.ChangeOperationUpdate, Table: "campaigns", ID: campaignID.String(), Old: image, New: image}
+	}
+
+	// an earlier run of this instance read the stream up to its first change
+	earlier := pushChange(t, fake, update("paused", 1))
+	if err := InitConsumerGroup(ctx, "0-0"); err != nil {
+		t.Fatalf("Failed to create the consumer group: %v", err)
+	}
+	fake.XReadGroup(ctx, &redis.XReadGroupArgs{Group: consumerGroup(), Consumer: consumerName(), Streams: []string{streamName(), ">"}})
+
+	offset, err := StreamOffset(ctx)
+	if err != nil || offset != earlier {
+		t.Fatalf("expected the offset to be the last entry, got %q %v", offset, err)
+	}
+	// committed while the snapshot loads, the snapshot has it already
+	overlapping := pushChange(t, fake, update("active", 2))
+	target.TargetCache = &model.TargetingData{
+		Campaigns: map[uuid.UUID]*model.Campaign{
+			campaignID: {ID: campaignID, CampaignStringID: "spotify", Status: model.CampaignStatusActive, MediaType: model.MediaTypeBanner, AdvertiserID: advertiserID, Version: 2},
+		},
+		Advertisers: map[uuid.UUID]*model.Advertiser{}, Rules: map[uuid.UUID]*model.TargetingRule{}, Tombstones: map[uuid.UUID]int64{},
+	}
+	defer func() { target.TargetCache = nil }()
+	before := *target.TargetCache.Campaigns[campaignID]
+
+	// the group of the restarted instance still exists, InitConsumerGroup moves it back from wherever it is to the offset
+	fake.XGroupSetID(ctx, streamName(), consumerGroup(), "$")
+	if err := InitConsumerGroup(ctx, offset); err != nil {
+		t.Fatalf("Failed to move the consumer group: %v", err)
+	}
+	streams := fake.XReadGroup(ctx, &redis.XReadGroupArgs{Group: consumerGroup(), Consumer: consumerName(), Streams: []string{streamName(), ">"}}).Val()
+	if len(streams) != 1 || len(streams[0].Messages) != 1 || streams[0].Messages[0].ID != overlapping {
+		t.Fatalf("expected only the change after the offset to be replayed, got %v", streams)
+	}
+	if _, ok := fake.HGetAll(ctx, instancesKey()).Val()[InstanceID()]; !ok {
+		t.Fatal("expected InitConsumerGroup to send the first heartbeat")
+	}
+	handleMessage(ctx, streams[0].Messages[0], 1)
+	if got := *target.TargetCache.Campaigns[campaignID]; got.Status != before.Status || got.Version != before.Version {
+		t.Fatalf("expected the overlapping change to leave the cache as it was, got %+v", got)
+	}
+	if pending := fake.pendingOf(streamName(), consumerGroup()); len(pending) != 1 || pending[earlier] != 1 {
+		t.Fatalf("expected the overlapping change to be acked and only the entry of the earlier run pending, got %v", pending)
+	}
+
+	// the entry the earlier run left pending is older than the snapshot, its retry is dropped as stale
+	fake.age(streamName(), consumerGroup(), earlier, 2*time.Second)
+	recoverPending(ctx, ctx)
+	if got := *target.TargetCache.Campaigns[campaignID]; got.Status != before.Status || got.Version != before.Version {
+		t.Fatalf("expected the stale pending change to leave the cache as it was, got %+v", got)
+	}
+	if pending := fake.pendingOf(streamName(), consumerGroup()); len(pending) != 0 {
+		t.Fatalf("expected the stale pending change to be acked, got %v", pending)
+	}
+}
@@ -0,0 +1,245 @@
+package target
+
+// change.go applies version 2 change events. they carry the row images written by the notify trigger, so the cache is
+// updated from the event alone and pgsql is not queried once per change and worker. the images are to_jsonb of the
+// row, only the columns the cache needs are decoded and unknown columns are ignored so a new column does not break
+// older workers. an event which does not match the schema wraps ErrMalformedChange and is dead-lettered
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	dbpkg "targetad/pkg/db"
+	"targetad/pkg/target/model"
+	"targetad/pkg/tracing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/pgtype"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type campaignImage struct {
+	ID               uuid.UUID       `json:"id"`
+	CampaignStringID string          `json:"campaign_string_id"`
+	Name             string          `json:"name"`
+	ImageUrl         string          `json:"image_url"`
+	Cta              string          `json:"cta"`
+	Status           string          `json:"status"`
+	IsDeleted        bool            `json:"is_deleted"`
+	AdvertiserID     uuid.UUID       `json:"advertiser_id"`
+	MediaType        string          `json:"media_type"`
+	Video            json.RawMessage `json:"video"`
+	RowVersion       int64           `json:"row_version"`
+}
+
+type advertiserImage struct {
+	ID                      uuid.UUID `json:"id"`
+	Name                    string    `json:"name"`
+	IsPaused                bool      `json:"is_paused"`
+	MaxCampaignsPerResponse int32     `json:"max_campaigns_per_response"`
+	IsDeleted               bool      `json:"is_deleted"`
+	RowVersion              int64     `json:"row_version"`
+}
+
+type ruleImage struct {
+	ID          uuid.UUID `json:"id"`
+	CampaignsID uuid.UUID `json:"campaigns_id"`
+	IsIncluded  bool      `json:"is_included"`
+	Category    int32     `json:"category"`
+	Value       string    `json:"value"`
+	IsDeleted   bool      `json:"is_deleted"`
+	RowVersion  int64     `json:"row_version"`
+}
+
+// ProcessChangeEvent applies a change from the stream to the cache. version 1 events are applied by reading the row
+// back from pgsql, see ProcessRedisStreamDataService
+func ProcessChangeEvent(ctx context.Context, event *model.ChangeEvent) (err error) {
+	if err := ValidateChangeEvent(event); err != nil {
+		return err
+	}
+	if event.Version == 1 {
+		return ProcessRedisStreamDataService(ctx, event.Table, event.ID, event.IsDeleted)
+	}
+	ctx, span := tracing.Start(ctx, "target.ProcessChangeEvent", trace.WithAttributes(tracing.Table(event.Table),
+		attribute.String("targetad.id", event.ID), attribute.Bool("targetad.is_deleted", event.IsDeleted),
+		attribute.Int("targetad.change.version", event.Version), attribute.String("targetad.change.operation", string(event.Operation)),
+		attribute.Int64("targetad.change.txid", event.TxID), attribute.String("targetad.change.lsn", event.LSN)))
+	defer func() { tracing.End(span, err) }()
+
+	if TargetCache == nil {
+		return ErrCacheNotReady // the message stays pending and is retried
+	}
+	rowID := uuid.MustParse(event.ID) // checked by ValidateChangeEvent
+	deleted := event.Operation == model.ChangeOperationDelete
+
+	// a change which is not newer than the cache (see version.go) is dropped without an error, so it is acked
+	switch event.Table {
+	case string(dbpkg.CampaignsTable):
+		var image campaignImage
+		if err := decodeImage(changeImage(event), rowID, &image, &image.ID); err != nil {
+			return err
+		}
+		version := changeVersion(event, image.RowVersion)
+		_, apply := startApply(ctx)
+		TargetCache.TargetMutex.Lock()
+		TargetCache.Generation++
+		if admitChange(ctx, TargetCache, event.Table, rowID, version) {
+			if deleted || image.IsDeleted {
+				delete(TargetCache.Campaigns, rowID)
+				setTombstone(TargetCache, rowID, version)
+			} else {
+				TargetCache.Campaigns[rowID] = toCacheCampaign(image.toRow())
+				delete(TargetCache.Tombstones, rowID)
+			}
+		}
+		TargetCache.TargetMutex.Unlock()
+		apply.End()
+	case string(dbpkg.AdvertisersTable):
+		var image advertiserImage
+		if err := decodeImage(changeImage(event), rowID, &image, &image.ID); err != nil {
+			return err
+		}
+		version := changeVersion(event, image.RowVersion)
+		_, apply := startApply(ctx)
+		TargetCache.TargetMutex.Lock()
+		TargetCache.Generation++
+		if admitChange(ctx, TargetCache, event.Table, rowID, version) {
+			if deleted || image.IsDeleted {
+				delete(TargetCache.Advertisers, rowID)
+				setTombstone(TargetCache, rowID, version)
+			} else {
+				TargetCache.Advertisers[rowID] = toCacheAdvertiser(image.toRow())
+				delete(TargetCache.Tombstones, rowID)
+			}
+		}
+		TargetCache.TargetMutex.Unlock()
+		apply.End()
+	case string(dbpkg.TargetingRulesTable):
+		// the old image tells which campaign lost the rule, also for a hard delete or a rule moved to another campaign
+		var oldImage, image ruleImage
+		if event.Old != nil {
+			if err := decodeImage(event.Old, rowID, &oldImage, &oldImage.ID); err != nil {
+				return err
+			}
+		}
+		if err := decodeImage(changeImage(event), rowID, &image, &image.ID); err != nil {
+			return err
+		}
+		version := changeVersion(event, image.RowVersion)
+		_, apply := startApply(ctx)
+		TargetCache.TargetMutex.Lock()
+		TargetCache.Generation++
+		if admitChange(ctx, TargetCache, event.Table, rowID, version) {
+			affected := make([]uuid.UUID, 0, 3)
+			if cached, ok := TargetCache.Rules[rowID]; ok {
+				affected = append(affected, cached.CampaignID)
+			}
+			if event.Old != nil {
+				affected = append(affected, oldImage.CampaignsID)
+			}
+			delete(TargetCache.Rules, rowID)
+			if deleted || image.IsDeleted {
+				setTombstone(TargetCache, rowID, version)
+			} else {
+				rule := image.toRule()
+				TargetCache.Rules[rowID] = rule
+				delete(TargetCache.Tombstones, rowID)
+				affected = append(affected, rule.CampaignID)
+			}
+			for _, campaignID := range affected {
+				rebuildCampaignIndexes(TargetCache, campaignID)
+			}
+		}
+		TargetCache.TargetMutex.Unlock()
+		apply.End()
+	}
+	return nil
+}
+
+// ValidateChangeEvent checks the event against the schema of its version, the row images are checked when they are applied
+func ValidateChangeEvent(event *model.ChangeEvent) error {
+	if event.Version < 1 || event.Version > model.ChangeEventVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrMalformedChange, event.Version)
+	}
+	switch event.Table {
+	case string(dbpkg.CampaignsTable), string(dbpkg.AdvertisersTable), string(dbpkg.TargetingRulesTable):
+	default:
+		return fmt.Errorf("%w: unknown table %q", ErrMalformedChange, event.Table)
+	}
+	if _, err := uuid.Parse(event.ID); err != nil {
+		return fmt.Errorf("%w: invalid id %q: %v", ErrMalformedChange, event.ID, err)
+	}
+	if event.Version == 1 {
+		return nil
+	}
+	switch event.Operation {
+	case model.ChangeOperationInsert:
+		if event.New == nil || event.Old != nil {
+			return fmt.Errorf("%w: an insert carries the new image only", ErrMalformedChange)
+		}
+	case model.ChangeOperationUpdate:
+		if event.New == nil || event.Old == nil {
+			return fmt.Errorf("%w: an update carries the old and the new image", ErrMalformedChange)
+		}
+	case model.ChangeOperationDelete:
+		if event.New != nil || event.Old == nil {
+			return fmt.Errorf("%w: a delete carries the old image only", ErrMalformedChange)
+		}
+	default:
+		return fmt.Errorf("%w: unknown operation %q", ErrMalformedChange, event.Operation)
+	}
+	return nil
+}
+
+// decodeImage decodes a row image into v and checks that the id of the image, decoded into imageID, is the id of the event
+func decodeImage(raw json.RawMessage, rowID uuid.UUID, v any, imageID *uuid.UUID) error {
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("%w: invalid row image: %v", ErrMalformedChange, err)
+	}
+	if *imageID != rowID {
+		return fmt.Errorf("%w: row image of %s in the change of %s", ErrMalformedChange, *imageID, rowID)
+	}
+	return nil
+}
+
+func (image campaignImage) toRow() dbpkg.Campaign {
+	row := dbpkg.Campaign{
+		ID:               pgtype.UUID{Bytes: image.ID, Status: pgtype.Present},
+		CampaignStringID: image.CampaignStringID,
+		Name:             image.Name,
+		ImageUrl:         image.ImageUrl,
+		Cta:              image.Cta,
+		Status:           image.Status,
+		IsDeleted:        image.IsDeleted,
+		AdvertiserID:     pgtype.UUID{Bytes: image.AdvertiserID, Status: pgtype.Present},
+		MediaType:        image.MediaType,
+		RowVersion:       image.RowVersion,
+	}
+	if string(image.Video) != "null" {
+		row.Video = image.Video
+	}
+	return row
+}
+
+func (image advertiserImage) toRow() dbpkg.Advertiser {
+	return dbpkg.Advertiser{
+		ID:                      pgtype.UUID{Bytes: image.ID, Status: pgtype.Present},
+		Name:                    image.Name,
+		IsPaused:                image.IsPaused,
+		MaxCampaignsPerResponse: image.MaxCampaignsPerResponse,
+		IsDeleted:               image.IsDeleted,
+		RowVersion:              image.RowVersion,
+	}
+}
+
+func (image ruleImage) toRule() *model.TargetingRule {
+	return &model.TargetingRule{
+		ID:         image.ID,
+		CampaignID: image.CampaignsID,
+		IsIncluded: image.IsIncluded,
+		Category:   image.Category,
+		Value:      image.Value,
+		Version:    image.RowVersion,
+	}
+}
@@ -0,0 +1,144 @@
+package target
+
+// introspect.go exposes the state of the cache to the admin api, so what a worker believes can be compared with pgsql.
+// everything is copied under the read lock, nothing returned here aliases the live cache
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"targetad/pkg/apperr"
+	"targetad/pkg/target/model"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Index names used by the introspection endpoint
+const (
+	IndexIncludeApp     = "include_app"
+	IndexIncludeOS      = "include_os"
+	IndexIncludeCountry = "include_country"
+	IndexExcludeCountry = "exclude_country"
+)
+
+var (
+	ErrUnknownIndex = &apperr.Error{Code: apperr.CodeValidation, Message: "unknown cache index",
+		Fields: []apperr.FieldError{{Field: "index", Rule: "oneof", Param: "include_app include_os include_country exclude_country"}}}
+	ErrCampaignNotCached = apperr.New(apperr.CodeNotFound, "campaign is not in the cache")
+)
+
+// snapshotCounter numbers the full loads of the cache
+var snapshotCounter atomic.Uint64
+
+type namedIndex struct {
+	name, category, rule string
+	index                map[string][]uuid.UUID
+}
+
+// cacheIndexes lists the inverted indexes of the cache, the caller must hold the read lock
+func cacheIndexes(cache *model.TargetingData) []namedIndex {
+	return []namedIndex{
+		{IndexIncludeApp, "app", "include", cache.IncludeAppIndex},
+		{IndexIncludeOS, "os", "include", cache.IncludeOSIndex},
+		{IndexIncludeCountry, "country", "include", cache.IncludeCountryIndex},
+		{IndexExcludeCountry, "country", "exclude", cache.ExcludeCountryIndex},
+	}
+}
+
+// RecordAppliedMessage remembers the stream message which was applied last, the stream listener calls it after a successful apply
+func RecordAppliedMessage(messageID string) {
+	if TargetCache == nil {
+		return
+	}
+	TargetCache.TargetMutex.Lock()
+	defer TargetCache.TargetMutex.Unlock()
+	TargetCache.LastAppliedMessageID = messageID
+	TargetCache.LastAppliedAt = time.Now()
+	TargetCache.AppliedMessages++
+}
+
+// CacheStateService reports the snapshot version, the last applied stream message and the size of every index
+func CacheStateService(ctx context.Context) (*model.CacheState, error) {
+	if TargetCache == nil {
+		return nil, ErrCacheNotReady
+	}
+	TargetCache.TargetMutex.RLock()
+	defer TargetCache.TargetMutex.RUnlock()
+
+	res := &model.CacheState{
+		SnapshotVersion:      TargetCache.SnapshotVersion,
+		LoadedAt:             TargetCache.LoadedAt,
+		StreamOffset:         TargetCache.StreamOffset,
+		LastAppliedMessageID: TargetCache.LastAppliedMessageID,
+		AppliedMessages:      TargetCache.AppliedMessages,
+		Campaigns:            len(TargetCache.Campaigns),
+		Advertisers:          len(TargetCache.Advertisers),
+		LastReconcile:        lastReconcile(),
+	}
+	if !TargetCache.LastAppliedAt.IsZero() {
+		at := TargetCache.LastAppliedAt
+		res.LastAppliedAt = &at
+	}
+	for _, idx := range cacheIndexes(TargetCache) {
+		stats := model.IndexStats{Index: idx.name, Keys: len(idx.index)}
+		for _, ids := range idx.index {
+			stats.Entries += len(ids)
+		}
+		res.Indexes = append(res.Indexes, stats)
+	}
+	return res, nil
+}
+
+// CacheIndexService returns the raw entries of one index key, e.g. include_country/US. a key which is not
+// in the index gives an empty list, that is a valid answer and not an error
+func CacheIndexService(ctx context.Context, index, key string) (*model.CacheIndexEntries, error) {
+	if TargetCache == nil {
+		return nil, ErrCacheNotReady
+	}
+	TargetCache.TargetMutex.RLock()
+	defer TargetCache.TargetMutex.RUnlock()
+
+	for _, idx := range cacheIndexes(TargetCache) {
+		if idx.name == index {
+			return &model.CacheIndexEntries{Index: index, Key: key, CampaignIDs: append([]uuid.UUID{}, idx.index[key]...)}, nil
+		}
+	}
+	return nil, ErrUnknownIndex
+}
+
+// CachedCampaignService returns the cached campaign, its advertiser and every index key which points at it
+func CachedCampaignService(ctx context.Context, id uuid.UUID) (*model.CachedCampaign, error) {
+	if TargetCache == nil {
+		return nil, ErrCacheNotReady
+	}
+	TargetCache.TargetMutex.RLock()
+	defer TargetCache.TargetMutex.RUnlock()
+
+	campaign, ok := TargetCache.Campaigns[id]
+	if !ok {
+		return nil, ErrCampaignNotCached
+	}
+	c := *campaign
+	res := &model.CachedCampaign{Campaign: &c, Targeting: []model.IndexRef{}}
+	if advertiser, ok := TargetCache.Advertisers[campaign.AdvertiserID]; ok {
+		a := *advertiser
+		res.Advertiser = &a
+	}
+	for _, idx := range cacheIndexes(TargetCache) {
+		for key, ids := range idx.index {
+			for _, campaignID := range ids {
+				if campaignID == id {
+					res.Targeting = append(res.Targeting, model.IndexRef{Index: idx.name, Key: key})
+				}
+			}
+		}
+	}
+	sort.Slice(res.Targeting, func(i, j int) bool {
+		if res.Targeting[i].Index != res.Targeting[j].Index {
+			return res.Targeting[i].Index < res.Targeting[j].Index
+		}
+		return res.Targeting[i].Key < res.Targeting[j].Key
+	})
+	return res, nil
+}
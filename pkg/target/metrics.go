@@ -0,0 +1,70 @@
+package target
+
+import (
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cacheCollector reports the size of the cache at scrape time, so the gauges can never drift from the cache itself
+type cacheCollector struct {
+	campaigns    *prometheus.Desc
+	advertisers  *prometheus.Desc
+	indexKeys    *prometheus.Desc
+	indexEntries *prometheus.Desc
+}
+
+func init() {
+	prometheus.MustRegister(&cacheCollector{
+		campaigns:   prometheus.NewDesc("targetad_cache_campaigns", "Number of campaigns in the cache.", nil, nil),
+		advertisers: prometheus.NewDesc("targetad_cache_advertisers", "Number of advertisers in the cache.", nil, nil),
+		indexKeys: prometheus.NewDesc("targetad_cache_index_keys", "Number of distinct values in a targeting index.",
+			[]string{"category", "rule"}, nil),
+		indexEntries: prometheus.NewDesc("targetad_cache_index_entries", "Number of campaign ids in a targeting index.",
+			[]string{"category", "rule"}, nil),
+	})
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.campaigns
+	ch <- c.advertisers
+	ch <- c.indexKeys
+	ch <- c.indexEntries
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	cache := TargetCache
+	if cache == nil {
+		return // nothing loaded yet, the series only show up once the cache is there
+	}
+	cache.TargetMutex.RLock()
+	defer cache.TargetMutex.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(c.campaigns, prometheus.GaugeValue, float64(len(cache.Campaigns)))
+	ch <- prometheus.MustNewConstMetric(c.advertisers, prometheus.GaugeValue, float64(len(cache.Advertisers)))
+	for _, idx := range cacheIndexes(cache) {
+		entries := 0
+		for _, ids := range idx.index {
+			entries += len(ids)
+		}
+		ch <- prometheus.MustNewConstMetric(c.indexKeys, prometheus.GaugeValue, float64(len(idx.index)), idx.category, idx.rule)
+		ch <- prometheus.MustNewConstMetric(c.indexEntries, prometheus.GaugeValue, float64(entries), idx.category, idx.rule)
+	}
+}
+
+// changesDropped counts the stream changes which were not applied because the cache has the row at that version or a newer one
+var changesDropped = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+	Namespace: "targetad", Subsystem: "cache", Name: "changes_dropped_total",
+	Help: "Number of changes dropped because the cache already has the row at that version (duplicate) or a newer one (stale).",
+}, []string{"table", "reason"})
+
+// reconciliation metrics, see reconcile.go
+var (
+	reconcileRuns = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "reconcile", Name: "runs_total",
+		Help: "Number of comparisons of the cache with pgsql by result: ok, drift or error.",
+	}, []string{"result"})
+	reconcileDrift = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Namespace: "targetad", Subsystem: "reconcile", Name: "drifted_rows_total",
+		Help: "Number of cached rows found not matching pgsql.",
+	}, []string{"table"})
+)
@@ -1,7 +1,10 @@
 package model
 
 import (
+	"encoding/json"
 	"sync"
+	"targetad/pkg/apperr"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -9,28 +12,98 @@ import (
 type TargetingData struct {
 	TargetMutex         sync.RWMutex
 	Campaigns           map[uuid.UUID]*Campaign
+	Advertisers         map[uuid.UUID]*Advertiser
 	IncludeCountryIndex map[string][]uuid.UUID
 	ExcludeCountryIndex map[string][]uuid.UUID
 	IncludeOSIndex      map[string][]uuid.UUID
 	IncludeAppIndex     map[string][]uuid.UUID
+	Rules               map[uuid.UUID]*TargetingRule // the valid rules behind the indexes, a rule change rebuilds the entries of its campaign from them
+	Tombstones          map[uuid.UUID]int64          // version of the rows removed since the snapshot, an older change of them is stale
+
+	// bookkeeping for the cache introspection endpoint, guarded by TargetMutex as well
+	SnapshotVersion      uint64    // incremented on every full load from pgsql
+	LoadedAt             time.Time // when the snapshot was loaded
+	StreamOffset         string    // last stream id taken before the snapshot, the consumer replays everything after it
+	LastAppliedMessageID string    // id of the last stream message applied on top of the snapshot
+	LastAppliedAt        time.Time
+	AppliedMessages      uint64 // number of stream messages applied since the snapshot was loaded
+	Generation           uint64 // incremented by every apply while it holds the write lock, see reconcile.go
 }
 
 type TargetCategory int
 
+// TargetingRule is a valid targeting rule as kept in the cache
+type TargetingRule struct {
+	ID         uuid.UUID `json:"id"`
+	CampaignID uuid.UUID `json:"campaigns_id"`
+	IsIncluded bool      `json:"is_included"`
+	Category   int32     `json:"category"`
+	Value      string    `json:"value"`
+	Version    int64     `json:"version"` // row_version of the rule
+}
+
 const (
 	TargetCategoryAppID TargetCategory = iota + 1
 	TargetCategoryCountry
 	TargetCategoryOS
 )
 
+// CampaignStatus is the lifecycle state of a campaign, only active campaigns are delivered
+type CampaignStatus string
+
+const (
+	CampaignStatusDraft         CampaignStatus = "draft"
+	CampaignStatusPendingReview CampaignStatus = "pending_review"
+	CampaignStatusActive        CampaignStatus = "active"
+	CampaignStatusPaused        CampaignStatus = "paused"
+	CampaignStatusCompleted     CampaignStatus = "completed"
+	CampaignStatusArchived      CampaignStatus = "archived"
+)
+
 type Campaign struct {
-	ID               uuid.UUID
-	CampaignStringID string
-	Name             string
-	ImageUrl         string
-	CTA              string
-	ActivityStatus   bool
-	IsDeleted        bool
+	ID               uuid.UUID      `json:"id"`
+	CampaignStringID string         `json:"cid"`
+	Name             string         `json:"name"`
+	ImageUrl         string         `json:"img"`
+	CTA              string         `json:"cta"`
+	Status           CampaignStatus `json:"status"`
+	IsDeleted        bool           `json:"is_deleted"`
+	AdvertiserID     uuid.UUID      `json:"advertiser_id"`
+	MediaType        MediaType      `json:"media_type"`
+	Video            *VideoAsset    `json:"video,omitempty"` // only set for video campaigns
+	Version          int64          `json:"version"`         // row_version of the campaign
+}
+
+// MediaType decides which delivery variant serves the campaign, banners go to /v1/delivery and videos to the vast variant
+type MediaType string
+
+const (
+	MediaTypeBanner MediaType = "banner"
+	MediaTypeVideo  MediaType = "video"
+)
+
+// VideoAsset is the json stored in the video column of a video campaign
+type VideoAsset struct {
+	DurationSeconds int         `json:"duration" validate:"required,min=1"`
+	ClickThroughURL string      `json:"click_through,omitempty" validate:"omitempty,url"`
+	MediaFiles      []MediaFile `json:"media_files" validate:"required,min=1,dive"`
+}
+
+type MediaFile struct {
+	URL      string `json:"url" validate:"required,url"`
+	MimeType string `json:"mime_type" validate:"required"` // e.g. video/mp4
+	Width    int    `json:"width" validate:"required,min=1"`
+	Height   int    `json:"height" validate:"required,min=1"`
+	Bitrate  int    `json:"bitrate,omitempty"` // kbps
+}
+
+// Advertiser holds the advertiser level delivery controls
+type Advertiser struct {
+	ID                      uuid.UUID `json:"id"`
+	Name                    string    `json:"name"`
+	IsPaused                bool      `json:"is_paused"`                  // pauses all the campaigns of this advertiser
+	MaxCampaignsPerResponse int       `json:"max_campaigns_per_response"` // 0 means no cap
+	Version                 int64     `json:"version"`                    // row_version of the advertiser
 }
 
 type DeliveryServiceRequest struct {
@@ -44,3 +117,113 @@ type DeliveryServiceResponse struct {
 	Image            string `json:"img"`
 	Cta              string `json:"cta"`
 }
+
+// VideoDeliveryResponse is a matched video campaign, the transport renders it as a VAST ad
+type VideoDeliveryResponse struct {
+	CampaignStringID string
+	Name             string
+	Video            VideoAsset
+}
+
+// BatchDeliveryItem is one device request of a batch, CorrelationID is echoed back so the gateway can match the results
+type BatchDeliveryItem struct {
+	CorrelationID string `json:"correlation_id" validate:"required"`
+	DeliveryServiceRequest
+}
+
+type BatchDeliveryServiceRequest struct {
+	Items []BatchDeliveryItem `json:"items"`
+}
+
+// BatchDeliveryItemResponse holds either the campaigns or the error of one item
+type BatchDeliveryItemResponse struct {
+	CorrelationID string                     `json:"correlation_id"`
+	Campaigns     []*DeliveryServiceResponse `json:"campaigns"`
+	Error         *apperr.Error              `json:"error,omitempty"`
+}
+
+type BatchDeliveryServiceResponse struct {
+	Items []*BatchDeliveryItemResponse `json:"items"`
+}
+
+// CacheState is what the cache introspection endpoint reports about the cache of this instance
+type CacheState struct {
+	SnapshotVersion      uint64           `json:"snapshot_version"`
+	LoadedAt             time.Time        `json:"loaded_at"`
+	StreamOffset         string           `json:"stream_offset"`
+	LastAppliedMessageID string           `json:"last_applied_message_id,omitempty"`
+	LastAppliedAt        *time.Time       `json:"last_applied_at,omitempty"`
+	AppliedMessages      uint64           `json:"applied_messages"`
+	Campaigns            int              `json:"campaigns"`
+	Advertisers          int              `json:"advertisers"`
+	Indexes              []IndexStats     `json:"indexes"`
+	LastReconcile        *ReconcileReport `json:"last_reconcile,omitempty"`
+}
+
+// ReconcileReport is the outcome of one comparison of the cache with pgsql
+type ReconcileReport struct {
+	At               time.Time    `json:"at"`
+	DurationMs       int64        `json:"duration_ms"`
+	PgsqlDigest      string       `json:"pgsql_digest"`
+	CacheDigest      string       `json:"cache_digest"` // before the repair
+	Suspects         int          `json:"suspects"`     // rows which differ, they count as drifted when they still differ on the next run
+	Drifted          []DriftedRow `json:"drifted"`
+	Action           string       `json:"action"`            // none, rebuild or swap
+	TombstonesPruned int          `json:"tombstones_pruned"` // tombstones of rows pgsql confirmed gone
+}
+
+// DriftedRow is a row whose cached state does not match pgsql. the state of a campaign covers its rules and index entries
+type DriftedRow struct {
+	Table string    `json:"table"`
+	ID    uuid.UUID `json:"id"`
+}
+
+type IndexStats struct {
+	Index   string `json:"index"`
+	Keys    int    `json:"keys"`    // distinct values, e.g. countries
+	Entries int    `json:"entries"` // campaign ids over all the keys
+}
+
+// CacheIndexEntries are the raw campaign ids stored under one key of an index, duplicates included
+type CacheIndexEntries struct {
+	Index       string      `json:"index"`
+	Key         string      `json:"key"`
+	CampaignIDs []uuid.UUID `json:"campaign_ids"`
+}
+
+// CachedCampaign is a campaign as the cache sees it, together with its advertiser and the index keys pointing at it
+type CachedCampaign struct {
+	Campaign   *Campaign   `json:"campaign"`
+	Advertiser *Advertiser `json:"advertiser,omitempty"`
+	Targeting  []IndexRef  `json:"targeting"`
+}
+
+type IndexRef struct {
+	Index string `json:"index"`
+	Key   string `json:"key"`
+}
+
+// ChangeEventVersion is the version of the change stream messages written by this build. version 1 messages only carry
+// table, id and is_deleted and the row is read back from pgsql, version 2 messages carry the row images
+const ChangeEventVersion = 2
+
+type ChangeOperation string
+
+const (
+	ChangeOperationInsert ChangeOperation = "insert"
+	ChangeOperationUpdate ChangeOperation = "update"
+	ChangeOperationDelete ChangeOperation = "delete"
+)
+
+// ChangeEvent is one change of a pgsql row as carried by the change stream
+type ChangeEvent struct {
+	Version   int
+	Operation ChangeOperation // empty in version 1
+	Table     string
+	ID        string
+	IsDeleted bool            // the row is gone or soft deleted
+	Old       json.RawMessage // to_jsonb of the row before the change, nil on insert and in version 1
+	New       json.RawMessage // to_jsonb of the row after the change, nil on delete and in version 1
+	TxID      int64           // pgsql transaction which made the change, 0 when unknown
+	LSN       string          // wal position when the row was written, empty when unknown
+}
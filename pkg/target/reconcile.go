@@ -0,0 +1,453 @@
+package target
+
+// reconcile.go compares the cache with pgsql every reconcile.interval seconds. a missed change or a bug in the apply
+// leaves the cache wrong until the next restart otherwise. a fresh snapshot is loaded and a digest is computed per
+// campaign (the campaign, its rules and its index entries) and per advertiser on both sides, the digests of all the
+// rows make the digest of the whole state.
+//
+// the snapshot and the cache are not taken at the same moment, a row changed meanwhile differs without any drift.
+// so a row which differs at different versions only counts as drifted when it still differs on the next run and
+// pgsql did not change it in between. a row which differs at the same versions, the version of the row and for a
+// campaign the versions of its rules, is drifted right away.
+//
+// drifted rows are repaired by reconcile.mode:
+//   - rebuild (default) copies only the drifted rows from the snapshot, a row which the stream changed since the
+//     comparison or which the cache holds in a newer version than the snapshot is left for the next run
+//   - swap replaces the whole cache by the snapshot, unless a stream change was applied while the snapshot was
+//     loading, then the drifted rows are rebuilt instead. every apply increments the generation of the cache under the
+//     write lock, so a change applied before the swap takes the lock always shows up
+//
+// every run also prunes the tombstones (see version.go) of the rows confirmed missing in pgsql, so they do not pile up
+// between two full loads
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"sort"
+	"sync"
+	"sync/atomic"
+	dbpkg "targetad/pkg/db"
+	"targetad/pkg/target/model"
+	"targetad/pkg/tracing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	ReconcileModeRebuild = "rebuild"
+	ReconcileModeSwap    = "swap"
+
+	reconcileActionNone = "none"
+)
+
+// the tables of the rows compared by the reconciler
+const (
+	reconcileCampaigns   = "campaigns"
+	reconcileAdvertisers = "advertisers"
+)
+
+var reconciler struct {
+	sync.Mutex // one run at a time, the periodic one and the one started through the admin api
+	// suspects are the rows which differed on the last run, with the pgsql digest they had
+	suspects map[rowKey][sha256.Size]byte
+	// tombstones are the tombstones of the cache on the last run
+	tombstones map[uuid.UUID]int64
+}
+
+// lastReport is the report of the last run. it is not guarded by the reconciler lock, the introspection reads it
+// while holding the cache lock which the reconciler takes after its own
+var lastReport atomic.Pointer[model.ReconcileReport]
+
+type rowKey struct {
+	table string
+	id    uuid.UUID
+}
+
+type rowState struct {
+	versions [sha256.Size]byte // digest of the row_version of the row, and of its rules for a campaign
+	digest   [sha256.Size]byte
+}
+
+// campaignVersions is what the versions of a campaign row cover
+type campaignVersions struct {
+	Campaign int64               `json:"campaign"`
+	Rules    map[uuid.UUID]int64 `json:"rules"`
+}
+
+// campaignState is what the digest of a campaign covers, the campaign is nil for rules of a campaign which is not cached
+type campaignState struct {
+	Campaign  *model.Campaign        `json:"campaign"`
+	Rules     []*model.TargetingRule `json:"rules"`
+	Targeting []model.IndexRef       `json:"targeting"`
+}
+
+// StartReconciler compares the cache with pgsql every reconcile.interval seconds until ctx is cancelled, 0 disables it
+func StartReconciler(ctx context.Context) {
+	interval := time.Duration(viper.GetInt("reconcile.interval")) * time.Second
+	if interval <= 0 {
+		level.Info(reconcileLogger()).Log("msg", "cache reconciliation is disabled")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			level.Info(reconcileLogger()).Log("msg", "cache reconciler stopped, shutting down")
+			return
+		case <-ticker.C:
+		}
+		if _, err := ReconcileService(ctx); err != nil && ctx.Err() == nil {
+			level.Error(reconcileLogger()).Log("msg", "error reconciling the cache", "err", err)
+		}
+	}
+}
+
+// ReconcileService compares the cache with a fresh snapshot from pgsql and repairs the drifted rows
+func ReconcileService(ctx context.Context) (report *model.ReconcileReport, err error) {
+	ctx, span := tracing.Start(ctx, "target.ReconcileService")
+	defer func() {
+		if report != nil {
+			span.SetAttributes(attribute.Int("targetad.reconcile.drifted", len(report.Drifted)), attribute.String("targetad.reconcile.action", report.Action))
+		}
+		tracing.End(span, err)
+	}()
+	if TargetCache == nil {
+		return nil, ErrCacheNotReady
+	}
+	reconciler.Lock()
+	defer reconciler.Unlock()
+
+	begin := time.Now()
+	TargetCache.TargetMutex.RLock()
+	generation := TargetCache.Generation
+	TargetCache.TargetMutex.RUnlock()
+	fresh, err := loadSnapshot(ctx)
+	if err != nil {
+		reconcileRuns.With("result", "error").Add(1)
+		return nil, err
+	}
+	report = reconcileSnapshot(ctx, fresh, generation, viper.GetString("reconcile.mode"))
+	report.At, report.DurationMs = begin, time.Since(begin).Milliseconds()
+	lastReport.Store(report)
+	return report, nil
+}
+
+// reconcileSnapshot compares the cache with the snapshot fresh and repairs the drifted rows. generation is the
+// generation of the cache taken before the snapshot was loaded, the caller must hold the reconciler lock
+func reconcileSnapshot(ctx context.Context, fresh *model.TargetingData, generation uint64, mode string) *model.ReconcileReport {
+	pgsql := rowStates(fresh)
+	TargetCache.TargetMutex.RLock()
+	cached := rowStates(TargetCache)
+	tombstones := maps.Clone(TargetCache.Tombstones)
+	TargetCache.TargetMutex.RUnlock()
+
+	report := &model.ReconcileReport{PgsqlDigest: stateDigest(pgsql), CacheDigest: stateDigest(cached), Drifted: []model.DriftedRow{}, Action: reconcileActionNone}
+	report.TombstonesPruned = pruneTombstones(TargetCache, fresh, reconciler.tombstones)
+	reconciler.tombstones = tombstones
+	suspects := make(map[rowKey][sha256.Size]byte)
+	var drifted []rowKey
+	if report.PgsqlDigest != report.CacheDigest {
+		for key := range unionKeys(pgsql, cached) {
+			p, pOK := pgsql[key]
+			c, cOK := cached[key]
+			if pOK && cOK && p.digest == c.digest {
+				continue
+			}
+			previous, wasSuspect := reconciler.suspects[key]
+			if (pOK && cOK && p.versions == c.versions) || (wasSuspect && previous == p.digest) {
+				drifted = append(drifted, key)
+				continue
+			}
+			suspects[key] = p.digest
+		}
+	}
+	reconciler.suspects = suspects
+	report.Suspects = len(suspects)
+	sort.Slice(drifted, func(i, j int) bool {
+		if drifted[i].table != drifted[j].table {
+			return drifted[i].table < drifted[j].table
+		}
+		return drifted[i].id.String() < drifted[j].id.String()
+	})
+	for _, key := range drifted {
+		report.Drifted = append(report.Drifted, model.DriftedRow{Table: key.table, ID: key.id})
+		reconcileDrift.With("table", key.table).Add(1)
+	}
+	if len(drifted) == 0 {
+		reconcileRuns.With("result", "ok").Add(1)
+		level.Debug(reconcileLogger()).Log("msg", "cache matches pgsql", "digest", report.CacheDigest, "suspects", report.Suspects)
+		return report
+	}
+	reconcileRuns.With("result", "drift").Add(1)
+
+	TargetCache.TargetMutex.Lock()
+	defer TargetCache.TargetMutex.Unlock()
+	if mode == ReconcileModeSwap && TargetCache.Generation == generation {
+		swapSnapshot(TargetCache, fresh)
+		report.Action = ReconcileModeSwap
+	} else {
+		repaired := 0
+		for _, key := range drifted {
+			if rebuildRow(TargetCache, fresh, key, cached[key]) {
+				repaired++
+			}
+		}
+		report.Action = ReconcileModeRebuild
+		level.Debug(reconcileLogger()).Log("msg", "rebuilt drifted rows", "rebuilt", repaired, "skipped", len(drifted)-repaired)
+	}
+	level.Warn(reconcileLogger()).Log("msg", "cache drifted from pgsql", "drifted", len(drifted), "rows", driftedSample(report.Drifted),
+		"action", report.Action, "pgsql_digest", report.PgsqlDigest, "cache_digest", report.CacheDigest)
+	return report
+}
+
+// lastReconcile returns a copy of the report of the last run, nil before the first one
+func lastReconcile() *model.ReconcileReport {
+	last := lastReport.Load()
+	if last == nil {
+		return nil
+	}
+	report := *last
+	report.Drifted = append([]model.DriftedRow{}, report.Drifted...)
+	return &report
+}
+
+// rowStates computes the versions and the digest of every campaign and advertiser, the caller must hold the read lock
+func rowStates(cache *model.TargetingData) map[rowKey]rowState {
+	states := make(map[rowKey]rowState, len(cache.Campaigns)+len(cache.Advertisers))
+	refs := make(map[uuid.UUID][]model.IndexRef)
+	for _, idx := range cacheIndexes(cache) {
+		for key, ids := range idx.index {
+			for _, id := range ids {
+				refs[id] = append(refs[id], model.IndexRef{Index: idx.name, Key: key})
+			}
+		}
+	}
+	rules := make(map[uuid.UUID][]*model.TargetingRule)
+	for _, rule := range cache.Rules {
+		rules[rule.CampaignID] = append(rules[rule.CampaignID], rule)
+	}
+	campaigns := make(map[uuid.UUID]bool, len(cache.Campaigns))
+	for id := range cache.Campaigns {
+		campaigns[id] = true
+	}
+	for id := range rules {
+		campaigns[id] = true
+	}
+	for id := range refs {
+		campaigns[id] = true
+	}
+	for id := range campaigns {
+		states[rowKey{reconcileCampaigns, id}] = campaignRowState(cache.Campaigns[id], rules[id], refs[id])
+	}
+	for id, advertiser := range cache.Advertisers {
+		states[rowKey{reconcileAdvertisers, id}] = advertiserRowState(advertiser)
+	}
+	return states
+}
+
+func campaignRowState(campaign *model.Campaign, rules []*model.TargetingRule, refs []model.IndexRef) rowState {
+	state := campaignState{Campaign: campaign, Rules: append([]*model.TargetingRule{}, rules...), Targeting: append([]model.IndexRef{}, refs...)}
+	sort.Slice(state.Rules, func(i, j int) bool { return state.Rules[i].ID.String() < state.Rules[j].ID.String() })
+	sort.Slice(state.Targeting, func(i, j int) bool {
+		if state.Targeting[i].Index != state.Targeting[j].Index {
+			return state.Targeting[i].Index < state.Targeting[j].Index
+		}
+		return state.Targeting[i].Key < state.Targeting[j].Key
+	})
+	versions := campaignVersions{Rules: make(map[uuid.UUID]int64, len(rules))}
+	if campaign != nil {
+		versions.Campaign = campaign.Version
+	}
+	for _, rule := range rules {
+		versions.Rules[rule.ID] = rule.Version
+	}
+	return rowState{versions: digest(versions), digest: digest(state)}
+}
+
+func advertiserRowState(advertiser *model.Advertiser) rowState {
+	return rowState{versions: digest(advertiser.Version), digest: digest(advertiser)}
+}
+
+// rowStateOf computes the state of one row like rowStates, the caller must hold the lock
+func rowStateOf(cache *model.TargetingData, key rowKey) (rowState, bool) {
+	if key.table == reconcileAdvertisers {
+		advertiser, ok := cache.Advertisers[key.id]
+		if !ok {
+			return rowState{}, false
+		}
+		return advertiserRowState(advertiser), true
+	}
+	var rules []*model.TargetingRule
+	for _, rule := range cache.Rules {
+		if rule.CampaignID == key.id {
+			rules = append(rules, rule)
+		}
+	}
+	var refs []model.IndexRef
+	for _, idx := range cacheIndexes(cache) {
+		for indexKey, ids := range idx.index {
+			for _, id := range ids {
+				if id == key.id {
+					refs = append(refs, model.IndexRef{Index: idx.name, Key: indexKey})
+				}
+			}
+		}
+	}
+	campaign := cache.Campaigns[key.id]
+	if campaign == nil && len(rules) == 0 && len(refs) == 0 {
+		return rowState{}, false
+	}
+	return campaignRowState(campaign, rules, refs), true
+}
+
+// rebuildRow copies one row from the snapshot into the cache. seen is the state of the row when it was compared,
+// a row which changed since then was touched by the stream and is left alone, like a row the cache holds in a newer
+// version than the snapshot. the caller must hold the write lock
+func rebuildRow(cache, fresh *model.TargetingData, key rowKey, seen rowState) bool {
+	if current, _ := rowStateOf(cache, key); current != seen || newerInCache(cache, fresh, key) {
+		return false
+	}
+	switch key.table {
+	case reconcileCampaigns:
+		if campaign, ok := fresh.Campaigns[key.id]; ok {
+			cache.Campaigns[key.id] = campaign
+			delete(cache.Tombstones, key.id)
+		} else {
+			delete(cache.Campaigns, key.id)
+		}
+		for id, rule := range cache.Rules {
+			if rule.CampaignID == key.id {
+				delete(cache.Rules, id)
+			}
+		}
+		for id, rule := range fresh.Rules {
+			if rule.CampaignID == key.id {
+				cache.Rules[id] = rule
+				delete(cache.Tombstones, id)
+			}
+		}
+		rebuildCampaignIndexes(cache, key.id)
+	case reconcileAdvertisers:
+		if advertiser, ok := fresh.Advertisers[key.id]; ok {
+			cache.Advertisers[key.id] = advertiser
+			delete(cache.Tombstones, key.id)
+		} else {
+			delete(cache.Advertisers, key.id)
+		}
+	}
+	return true
+}
+
+// newerInCache reports whether the cache holds a newer version of the row, or of a rule of the campaign, than the
+// snapshot. the stream applied a change after the snapshot was loaded, copying the snapshot would take it back.
+// a row missing from the snapshot is deleted in pgsql and does not count. the caller must hold the lock
+func newerInCache(cache, fresh *model.TargetingData, key rowKey) bool {
+	if key.table == reconcileAdvertisers {
+		advertiser, ok := fresh.Advertisers[key.id]
+		return ok && cachedVersion(cache, string(dbpkg.AdvertisersTable), key.id) > advertiser.Version
+	}
+	if campaign, ok := fresh.Campaigns[key.id]; ok && cachedVersion(cache, string(dbpkg.CampaignsTable), key.id) > campaign.Version {
+		return true
+	}
+	for id, rule := range fresh.Rules {
+		if rule.CampaignID == key.id && cachedVersion(cache, string(dbpkg.TargetingRulesTable), id) > rule.Version {
+			return true
+		}
+	}
+	for id, rule := range cache.Rules {
+		if freshRule, ok := fresh.Rules[id]; ok && rule.CampaignID == key.id && rule.Version > freshRule.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneTombstones removes the tombstones which were there on the last run already and whose row is missing from the
+// snapshot. the delete was committed before the snapshot was loaded then, and a change of the row still in flight had
+// a whole run to arrive. previous are the tombstones of the last run, it returns the number of tombstones removed
+func pruneTombstones(cache, fresh *model.TargetingData, previous map[uuid.UUID]int64) int {
+	if len(previous) == 0 {
+		return 0
+	}
+	cache.TargetMutex.Lock()
+	defer cache.TargetMutex.Unlock()
+	pruned := 0
+	for id, version := range previous {
+		if cache.Tombstones[id] != version || fresh.Campaigns[id] != nil || fresh.Advertisers[id] != nil || fresh.Rules[id] != nil {
+			continue
+		}
+		delete(cache.Tombstones, id)
+		pruned++
+	}
+	return pruned
+}
+
+// swapSnapshot replaces the content of the cache by the snapshot and keeps the stream bookkeeping, the caller must
+// hold the write lock
+func swapSnapshot(cache, fresh *model.TargetingData) {
+	cache.Campaigns, cache.Advertisers, cache.Rules = fresh.Campaigns, fresh.Advertisers, fresh.Rules
+	cache.IncludeCountryIndex, cache.ExcludeCountryIndex = fresh.IncludeCountryIndex, fresh.ExcludeCountryIndex
+	cache.IncludeOSIndex, cache.IncludeAppIndex = fresh.IncludeOSIndex, fresh.IncludeAppIndex
+	cache.Tombstones = make(map[uuid.UUID]int64)
+	cache.SnapshotVersion = snapshotCounter.Add(1)
+	cache.LoadedAt = fresh.LoadedAt
+}
+
+func unionKeys(a, b map[rowKey]rowState) map[rowKey]bool {
+	keys := make(map[rowKey]bool, len(a))
+	for key := range a {
+		keys[key] = true
+	}
+	for key := range b {
+		keys[key] = true
+	}
+	return keys
+}
+
+// stateDigest combines the digests of all the rows in a stable order
+func stateDigest(states map[rowKey]rowState) string {
+	keys := make([]rowKey, 0, len(states))
+	for key := range states {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].table != keys[j].table {
+			return keys[i].table < keys[j].table
+		}
+		return keys[i].id.String() < keys[j].id.String()
+	})
+	h := sha256.New()
+	for _, key := range keys {
+		digest := states[key].digest
+		h.Write([]byte(key.table))
+		h.Write(key.id[:])
+		h.Write(digest[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func digest(v any) [sha256.Size]byte {
+	b, _ := json.Marshal(v) // the cache types always marshal
+	return sha256.Sum256(b)
+}
+
+// driftedSample keeps the log line short when a lot of rows drifted
+func driftedSample(rows []model.DriftedRow) []model.DriftedRow {
+	if len(rows) > 10 {
+		return rows[:10]
+	}
+	return rows
+}
+
+func reconcileLogger() log.Logger {
+	return log.With(baseLogger, "component", "reconcile")
+}
@@ -0,0 +1,193 @@
+package target
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"targetad/pkg/target/model"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// useReconcileTestCache replaces the cache with one active campaign targeting the US by rule ruleID, all at version 1
+func useReconcileTestCache() (campaignID, ruleID uuid.UUID) {
+	advertiserID := uuid.New()
+	campaignID, ruleID = uuid.New(), uuid.New()
+	TargetCache = &model.TargetingData{
+		Campaigns: map[uuid.UUID]*model.Campaign{
+			campaignID: {ID: campaignID, CampaignStringID: "spotify", Status: model.CampaignStatusActive, MediaType: model.MediaTypeBanner, AdvertiserID: advertiserID, Version: 1},
+		},
+		Advertisers:         map[uuid.UUID]*model.Advertiser{advertiserID: {ID: advertiserID, Version: 1}},
+		IncludeCountryIndex: map[string][]uuid.UUID{"US": {campaignID}},
+		ExcludeCountryIndex: map[string][]uuid.UUID{},
+		IncludeOSIndex:      map[string][]uuid.UUID{},
+		IncludeAppIndex:     map[string][]uuid.UUID{},
+		Rules: map[uuid.UUID]*model.TargetingRule{
+			ruleID: {ID: ruleID, CampaignID: campaignID, IsIncluded: true, Category: int32(model.TargetCategoryCountry), Value: "US", Version: 1},
+		},
+		Tombstones: map[uuid.UUID]int64{},
+	}
+	reconciler.suspects, reconciler.tombstones = nil, nil
+	return campaignID, ruleID
+}
+
+// reconcileTestSnapshot copies the rows of the cache like a snapshot loaded from pgsql
+func reconcileTestSnapshot() *model.TargetingData {
+	fresh := &model.TargetingData{
+		Campaigns:           map[uuid.UUID]*model.Campaign{},
+		Advertisers:         map[uuid.UUID]*model.Advertiser{},
+		IncludeCountryIndex: map[string][]uuid.UUID{},
+		ExcludeCountryIndex: map[string][]uuid.UUID{},
+		IncludeOSIndex:      map[string][]uuid.UUID{},
+		IncludeAppIndex:     map[string][]uuid.UUID{},
+		Rules:               map[uuid.UUID]*model.TargetingRule{},
+	}
+	for id, campaign := range TargetCache.Campaigns {
+		c := *campaign
+		fresh.Campaigns[id] = &c
+	}
+	for id, advertiser := range TargetCache.Advertisers {
+		a := *advertiser
+		fresh.Advertisers[id] = &a
+	}
+	for id, rule := range TargetCache.Rules {
+		r := *rule
+		fresh.Rules[id] = &r
+		rebuildCampaignIndexes(fresh, r.CampaignID)
+	}
+	return fresh
+}
+
+// TestCacheReconciliation tests that the reconciler repairs a cache which drifted at the same version right away,
+// waits one run before it repairs a row at another version, and can swap in the whole snapshot
+func TestCacheReconciliation(t *testing.T) {
+	campaignID, _ := useReconcileTestCache()
+	ctx := context.Background()
+
+	if report := reconcileSnapshot(ctx, reconcileTestSnapshot(), 0, ReconcileModeRebuild); len(report.Drifted) != 0 || report.PgsqlDigest != report.CacheDigest {
+		t.Fatalf("expected no drift for an identical snapshot, got %+v", report)
+	}
+
+	fresh := reconcileTestSnapshot()
+	delete(TargetCache.IncludeCountryIndex, "US")
+	report := reconcileSnapshot(ctx, fresh, 0, ReconcileModeRebuild)
+	if len(report.Drifted) != 1 || report.Drifted[0] != (model.DriftedRow{Table: "campaigns", ID: campaignID}) || report.Action != ReconcileModeRebuild {
+		t.Fatalf("expected the campaign to drift at the same version, got %+v", report)
+	}
+	if ids := TargetCache.IncludeCountryIndex["US"]; len(ids) != 1 || ids[0] != campaignID {
+		t.Fatalf("expected the index entry to be rebuilt, got %v", ids)
+	}
+
+	fresh = reconcileTestSnapshot()
+	fresh.Campaigns[campaignID].Status, fresh.Campaigns[campaignID].Version = model.CampaignStatusPaused, 2
+	if report := reconcileSnapshot(ctx, fresh, 0, ReconcileModeRebuild); len(report.Drifted) != 0 || report.Suspects != 1 {
+		t.Fatalf("expected a newer row to be a suspect first, got %+v", report)
+	}
+	if report := reconcileSnapshot(ctx, fresh, 0, ReconcileModeRebuild); len(report.Drifted) != 1 {
+		t.Fatalf("expected the suspect to drift on the next run, got %+v", report)
+	}
+	if status := TargetCache.Campaigns[campaignID].Status; status != model.CampaignStatusPaused {
+		t.Fatalf("expected the campaign to be rebuilt as paused, got %q", status)
+	}
+
+	fresh = reconcileTestSnapshot()
+	TargetCache.IncludeAppIndex["app"] = []uuid.UUID{campaignID}
+	before := TargetCache.SnapshotVersion
+	if report := reconcileSnapshot(ctx, fresh, TargetCache.Generation, ReconcileModeSwap); report.Action != ReconcileModeSwap {
+		t.Fatalf("expected the snapshot to be swapped in, got %+v", report)
+	}
+	if _, ok := TargetCache.IncludeAppIndex["app"]; ok || TargetCache.SnapshotVersion == before {
+		t.Fatalf("expected the cache to be replaced by the snapshot")
+	}
+}
+
+// TestReconcileSwapAfterApply tests that a change applied between the snapshot load and the swap, before the stream
+// listener records the message, makes the reconciler rebuild the drifted rows instead of swapping the change away
+func TestReconcileSwapAfterApply(t *testing.T) {
+	campaignID, _ := useReconcileTestCache()
+	ctx := context.Background()
+	advertiserID := TargetCache.Campaigns[campaignID].AdvertiserID
+
+	generation := TargetCache.Generation
+	fresh := reconcileTestSnapshot()
+	TargetCache.Advertisers[advertiserID].Name = "drifted" // at the same version
+	image := json.RawMessage(fmt.Sprintf(`{"id": %q, "campaign_string_id": "spotify", "status": "paused", "advertiser_id": %q, "media_type": "banner", "row_version": 2}`,
+		campaignID, advertiserID))
+	event := &model.ChangeEvent{Version: 2, Operation: model.ChangeOperationUpdate, Table: "campaigns", ID: campaignID.String(), Old: image, New: image}
+	if err := ProcessChangeEvent(ctx, event); err != nil {
+		t.Fatalf("Failed to apply the change: %v", err)
+	}
+
+	if report := reconcileSnapshot(ctx, fresh, generation, ReconcileModeSwap); report.Action != ReconcileModeRebuild {
+		t.Fatalf("expected the drifted rows to be rebuilt instead of a swap, got %+v", report)
+	}
+	if campaign := TargetCache.Campaigns[campaignID]; campaign.Status != model.CampaignStatusPaused || campaign.Version != 2 {
+		t.Fatalf("expected the applied change to be kept, got %+v", campaign)
+	}
+	if name := TargetCache.Advertisers[advertiserID].Name; name != "" {
+		t.Fatalf("expected the drifted advertiser to be rebuilt, got %q", name)
+	}
+}
+
+// TestReconcileKeepsNewerRules tests that a rule change applied by the stream after the snapshot was loaded is neither
+// reported as drift nor taken back by the snapshot, also when the same stale snapshot is compared twice
+func TestReconcileKeepsNewerRules(t *testing.T) {
+	campaignID, ruleID := useReconcileTestCache()
+	ctx := context.Background()
+
+	fresh := reconcileTestSnapshot()
+	// the stream moves the rule to CA after the snapshot was loaded
+	TargetCache.Rules[ruleID] = &model.TargetingRule{ID: ruleID, CampaignID: campaignID, IsIncluded: true, Category: int32(model.TargetCategoryCountry), Value: "CA", Version: 2}
+	rebuildCampaignIndexes(TargetCache, campaignID)
+
+	if report := reconcileSnapshot(ctx, fresh, 0, ReconcileModeRebuild); len(report.Drifted) != 0 || report.Suspects != 1 {
+		t.Fatalf("expected the campaign with a newer rule to be a suspect, got %+v", report)
+	}
+	if report := reconcileSnapshot(ctx, fresh, 0, ReconcileModeRebuild); len(report.Drifted) != 1 {
+		t.Fatalf("expected the unchanged suspect to drift, got %+v", report)
+	}
+	if rule := TargetCache.Rules[ruleID]; rule.Value != "CA" || rule.Version != 2 {
+		t.Fatalf("expected the newer rule to be kept, got %+v", rule)
+	}
+	if ids := TargetCache.IncludeCountryIndex["CA"]; len(ids) != 1 || ids[0] != campaignID {
+		t.Fatalf("expected the campaign to stay under include_country/CA, got %v", TargetCache.IncludeCountryIndex)
+	}
+
+	// a rule deleted by the stream is not brought back either
+	fresh = reconcileTestSnapshot()
+	delete(TargetCache.Rules, ruleID)
+	setTombstone(TargetCache, ruleID, 3)
+	rebuildCampaignIndexes(TargetCache, campaignID)
+	reconcileSnapshot(ctx, fresh, 0, ReconcileModeRebuild)
+	reconcileSnapshot(ctx, fresh, 0, ReconcileModeRebuild)
+	if rule, ok := TargetCache.Rules[ruleID]; ok {
+		t.Fatalf("expected the deleted rule to stay deleted, got %+v", rule)
+	}
+}
+
+// TestTombstonePruning tests that a tombstone is pruned once it was there on the last run and its row is missing from
+// the snapshot, and kept while pgsql still has the row
+func TestTombstonePruning(t *testing.T) {
+	campaignID, ruleID := useReconcileTestCache()
+	ctx := context.Background()
+	fresh := reconcileTestSnapshot()
+	delete(TargetCache.Rules, ruleID)
+	setTombstone(TargetCache, ruleID, 2)
+	rebuildCampaignIndexes(TargetCache, campaignID)
+
+	// pgsql still has the rule, the delete is not confirmed yet
+	reconcileSnapshot(ctx, fresh, 0, ReconcileModeRebuild)
+	if report := reconcileSnapshot(ctx, fresh, 0, ReconcileModeRebuild); report.TombstonesPruned != 0 || TargetCache.Tombstones[ruleID] != 2 {
+		t.Fatalf("expected the tombstone to be kept while pgsql has the rule, got %+v", report)
+	}
+
+	delete(fresh.Rules, ruleID)
+	rebuildCampaignIndexes(fresh, campaignID)
+	if report := reconcileSnapshot(ctx, fresh, 0, ReconcileModeRebuild); report.TombstonesPruned != 1 {
+		t.Fatalf("expected the tombstone to be pruned, got %+v", report)
+	}
+	if _, ok := TargetCache.Tombstones[ruleID]; ok {
+		t.Fatalf("expected no tombstone left, got %v", TargetCache.Tombstones)
+	}
+}
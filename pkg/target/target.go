@@ -2,18 +2,55 @@ package target
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"slices"
+	"targetad/pkg/apperr"
 	dbpkg "targetad/pkg/db"
+	"targetad/pkg/logger"
 	"targetad/pkg/target/model"
+	"targetad/pkg/tracing"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var TargetCache *model.TargetingData // decaring the cache globally
 
-// fetches the data from pgsql db and initializes the cache
-func InitCache(ctx context.Context) (*model.TargetingData, error) {
-	TargetCache = &model.TargetingData{}
+// baseLogger is the logger of the apply paths and the reconciler, InitCache sets it
+var baseLogger = logger.Get()
+
+// ErrCacheNotReady is returned by the delivery services until InitCache has built the cache
+var ErrCacheNotReady = apperr.New(apperr.CodeUnavailable, "targeting cache is not ready")
+
+// ErrMalformedChange is returned for a change message which can never be applied, retrying it is pointless
+var ErrMalformedChange = errors.New("malformed change message")
+
+// fetches the data from pgsql db and initializes the cache. the cache is built aside and only published once
+// everything is loaded, so a failed load leaves TargetCache nil and the instance not ready instead of serving a partial cache.
+// streamOffset is the last id of the change stream taken before the load, every change committed after it is in the
+// stream after that id and is replayed on top of the snapshot
+func InitCache(ctx context.Context, l log.Logger, streamOffset string) (*model.TargetingData, error) {
+	baseLogger = l
+	cache, err := loadSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache.StreamOffset = streamOffset
+	cache.SnapshotVersion = snapshotCounter.Add(1)
+	TargetCache = cache
+	return cache, nil
+}
+
+// loadSnapshot reads every valid campaign, advertiser and targeting rule from pgsql into a new cache
+func loadSnapshot(ctx context.Context) (*model.TargetingData, error) {
+	cache := &model.TargetingData{}
 	conn := dbpkg.GetConn()
 	if conn == nil {
 		return nil, errors.New("database connection is nil")
@@ -23,112 +60,227 @@ func InitCache(ctx context.Context) (*model.TargetingData, error) {
 	if err != nil {
 		return nil, err
 	}
-	TargetCache.TargetMutex.Lock()
 
-	TargetCache.Campaigns = make(map[uuid.UUID]*model.Campaign)
-	TargetCache.ExcludeCountryIndex = make(map[string][]uuid.UUID)
-	TargetCache.IncludeCountryIndex = make(map[string][]uuid.UUID)
-	TargetCache.IncludeOSIndex = make(map[string][]uuid.UUID)
-	TargetCache.IncludeAppIndex = make(map[string][]uuid.UUID)
+	cache.Campaigns = make(map[uuid.UUID]*model.Campaign)
+	cache.Advertisers = make(map[uuid.UUID]*model.Advertiser)
+	cache.ExcludeCountryIndex = make(map[string][]uuid.UUID)
+	cache.IncludeCountryIndex = make(map[string][]uuid.UUID)
+	cache.IncludeOSIndex = make(map[string][]uuid.UUID)
+	cache.IncludeAppIndex = make(map[string][]uuid.UUID)
+	cache.Rules = make(map[uuid.UUID]*model.TargetingRule)
+	cache.Tombstones = make(map[uuid.UUID]int64)
 
 	for _, campaign := range campaigns {
-		TargetCache.Campaigns[campaign.ID.Bytes] = &model.Campaign{
-			ID:               campaign.ID.Bytes,
-			CampaignStringID: campaign.CampaignStringID,
-			Name:             campaign.Name,
-			ImageUrl:         campaign.ImageUrl,
-			CTA:              campaign.Cta,
-			ActivityStatus:   campaign.ActivityStatus,
-			IsDeleted:        campaign.IsDeleted,
-		}
+		cache.Campaigns[campaign.ID.Bytes] = toCacheCampaign(campaign)
+	}
+
+	advertisers, err := conn.ListAllValidAdvertisers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, advertiser := range advertisers {
+		cache.Advertisers[advertiser.ID.Bytes] = toCacheAdvertiser(advertiser)
 	}
-	TargetCache.TargetMutex.Unlock()
 	// get all valid targetting rules from the database
 	dbvals, err := conn.ListValidTargetingRules(ctx)
 	if err != nil {
 		return nil, err
 	}
-	TargetCache.TargetMutex.Lock()
 	for _, val := range dbvals {
-		switch val.Category {
-		case int32(model.TargetCategoryAppID):
-			TargetCache.IncludeAppIndex[val.Value] = append(TargetCache.IncludeAppIndex[val.Value], val.CampaignsID.Bytes)
-		case int32(model.TargetCategoryCountry):
-			if val.IsIncluded {
-				TargetCache.IncludeCountryIndex[val.Value] = append(TargetCache.IncludeCountryIndex[val.Value], val.CampaignsID.Bytes)
-			} else {
-				TargetCache.ExcludeCountryIndex[val.Value] = append(TargetCache.ExcludeCountryIndex[val.Value], val.CampaignsID.Bytes)
-			}
-		case int32(model.TargetCategoryOS):
-			TargetCache.IncludeOSIndex[val.Value] = append(TargetCache.IncludeOSIndex[val.Value], val.CampaignsID.Bytes)
-		}
+		rule := toCacheRule(val)
+		cache.Rules[rule.ID] = rule
+		addToIndex(cache, rule)
 	}
-	TargetCache.TargetMutex.Unlock()
 
-	return TargetCache, nil
+	cache.LoadedAt = time.Now()
+	return cache, nil
+}
+
+// CheckCache is the readiness check of the cache, it fails until InitCache has loaded it
+func CheckCache(ctx context.Context) error {
+	if TargetCache == nil {
+		return ErrCacheNotReady
+	}
+	return nil
 }
 
 // ProcessRedisStreamDataService is a function for processing data from the Redis stream.
-func ProcessRedisStreamDataService(ctx context.Context, tableName string, id string, isDeleted bool) error {
+// the db fetch and the cache apply get their own spans, so a slow change can be pinned to one of them
+func ProcessRedisStreamDataService(ctx context.Context, tableName string, id string, isDeleted bool) (err error) {
+	ctx, span := tracing.Start(ctx, "target.ProcessRedisStreamDataService", trace.WithAttributes(tracing.Table(tableName),
+		attribute.String("targetad.id", id), attribute.Bool("targetad.is_deleted", isDeleted)))
+	defer func() { tracing.End(span, err) }()
 
+	rowID, err := uuid.Parse(id)
+	if err != nil {
+		return fmt.Errorf("%w: invalid id %q: %v", ErrMalformedChange, id, err)
+	}
+	if TargetCache == nil {
+		return ErrCacheNotReady // the message stays pending and is retried
+	}
 	conn := dbpkg.GetConn()
 	if conn == nil {
 		return errors.New("database connection is nil")
 	}
 
+	// every change is applied by reading the current state of the row, so applying a change twice or an old change
+	// after a newer one leaves the cache right. the bootstrap relies on this, it replays the changes which overlap
+	// with the snapshot. a row which is gone (deleted or soft deleted) is removed from the cache and leaves a tombstone
+	// at its cached version, so a late version 2 image of it can not bring it back. a row read back at a version the
+	// cache already has is dropped like a duplicate event, see version.go
 	switch tableName {
 	case string(dbpkg.CampaignsTable):
-		if isDeleted {
-			TargetCache.TargetMutex.Lock()
-			delete(TargetCache.Campaigns, uuid.MustParse(id))
-			TargetCache.TargetMutex.Unlock()
-		} else {
-			campaign, err := conn.GetCampaignByID(ctx, uuid.MustParse(id))
-			if err != nil {
+		var campaign dbpkg.Campaign
+		if !isDeleted {
+			fetchCtx, fetch := startFetch(ctx, tableName)
+			campaign, err = conn.GetCampaignByID(fetchCtx, rowID)
+			tracing.End(fetch, err)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 				return err
 			}
-			TargetCache.TargetMutex.Lock()
-			TargetCache.Campaigns[campaign.ID.Bytes] = &model.Campaign{
-				ID:               campaign.ID.Bytes,
-				CampaignStringID: campaign.CampaignStringID,
-				Name:             campaign.Name,
-				ImageUrl:         campaign.ImageUrl,
-				CTA:              campaign.Cta,
-				ActivityStatus:   campaign.ActivityStatus,
-				IsDeleted:        campaign.IsDeleted,
+		}
+		_, apply := startApply(ctx)
+		TargetCache.TargetMutex.Lock()
+		TargetCache.Generation++
+		if isDeleted || err != nil {
+			removeWithTombstone(TargetCache, tableName, rowID)
+		} else if admitChange(ctx, TargetCache, tableName, rowID, campaign.RowVersion) {
+			TargetCache.Campaigns[rowID] = toCacheCampaign(campaign)
+			delete(TargetCache.Tombstones, rowID)
+		}
+		TargetCache.TargetMutex.Unlock()
+		apply.End()
+	case string(dbpkg.AdvertisersTable):
+		var advertiser dbpkg.Advertiser
+		if !isDeleted {
+			fetchCtx, fetch := startFetch(ctx, tableName)
+			advertiser, err = conn.GetAdvertiserByID(fetchCtx, rowID)
+			tracing.End(fetch, err)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return err
 			}
-			TargetCache.TargetMutex.Unlock()
 		}
+		_, apply := startApply(ctx)
+		TargetCache.TargetMutex.Lock()
+		TargetCache.Generation++
+		if isDeleted || err != nil {
+			removeWithTombstone(TargetCache, tableName, rowID)
+		} else if admitChange(ctx, TargetCache, tableName, rowID, advertiser.RowVersion) {
+			TargetCache.Advertisers[rowID] = toCacheAdvertiser(advertiser)
+			delete(TargetCache.Tombstones, rowID)
+		}
+		TargetCache.TargetMutex.Unlock()
+		apply.End()
 	case string(dbpkg.TargetingRulesTable):
-		targetRule, err := conn.GetTargetRulesByID(ctx, uuid.MustParse(id))
+		// the rules of the whole campaign are reloaded and its index entries rebuilt from them, that covers new,
+		// changed and deleted rules alike and never adds an entry twice
+		fetchCtx, fetch := startFetch(ctx, tableName)
+		row, err := conn.GetTargetRuleCampaignID(fetchCtx, rowID)
+		campaignID := uuid.UUID(row.Bytes)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// hard deleted, the cached rule still knows its campaign
+			TargetCache.TargetMutex.RLock()
+			cached, ok := TargetCache.Rules[rowID]
+			TargetCache.TargetMutex.RUnlock()
+			if !ok {
+				tracing.End(fetch, nil)
+				level.Warn(logger.FromContext(ctx, baseLogger)).Log("msg", "targeting rule row is gone and not cached, skipping the change", "id", id)
+				return nil
+			}
+			campaignID, err = cached.CampaignID, nil
+		}
+		var rules []dbpkg.ListValidTargetingRulesRow
+		if err == nil {
+			rules, err = conn.ListValidTargetingRulesByCampaign(fetchCtx, campaignID)
+		}
+		tracing.End(fetch, err)
 		if err != nil {
 			return err
 		}
+		_, apply := startApply(ctx)
 		TargetCache.TargetMutex.Lock()
-		defer TargetCache.TargetMutex.Unlock()
-		switch targetRule.Category {
-		case int32(model.TargetCategoryAppID):
-			TargetCache.IncludeAppIndex[targetRule.Value] = append(TargetCache.IncludeAppIndex[targetRule.Value], targetRule.CampaignsID.Bytes)
-		case int32(model.TargetCategoryCountry):
-			if targetRule.IsIncluded {
-				TargetCache.IncludeCountryIndex[targetRule.Value] = append(TargetCache.IncludeCountryIndex[targetRule.Value], targetRule.CampaignsID.Bytes)
-			} else {
-				TargetCache.ExcludeCountryIndex[targetRule.Value] = append(TargetCache.ExcludeCountryIndex[targetRule.Value], targetRule.CampaignsID.Bytes)
+		TargetCache.Generation++
+		for ruleID, rule := range TargetCache.Rules {
+			if rule.CampaignID == campaignID {
+				removeWithTombstone(TargetCache, tableName, ruleID) // the rules still valid are added back below
 			}
-		case int32(model.TargetCategoryOS):
-			TargetCache.IncludeOSIndex[targetRule.Value] = append(TargetCache.IncludeOSIndex[targetRule.Value], targetRule.CampaignsID.Bytes)
 		}
-
-		if isDeleted {
-			// TODO: do the same check and remove the campaign from the cache
+		for _, row := range rules {
+			rule := toCacheRule(row)
+			TargetCache.Rules[rule.ID] = rule
+			delete(TargetCache.Tombstones, rule.ID)
 		}
+		rebuildCampaignIndexes(TargetCache, campaignID)
+		TargetCache.TargetMutex.Unlock()
+		apply.End()
 	default:
-		return errors.New("unknown table name")
+		return fmt.Errorf("%w: unknown table %q", ErrMalformedChange, tableName)
 	}
 
 	return nil
 }
 
+// addToIndex adds the campaign of a targeting rule to the index of the rule, the caller must hold the write lock
+func addToIndex(cache *model.TargetingData, rule *model.TargetingRule) {
+	var index map[string][]uuid.UUID
+	switch rule.Category {
+	case int32(model.TargetCategoryAppID):
+		index = cache.IncludeAppIndex
+	case int32(model.TargetCategoryCountry):
+		if rule.IsIncluded {
+			index = cache.IncludeCountryIndex
+		} else {
+			index = cache.ExcludeCountryIndex
+		}
+	case int32(model.TargetCategoryOS):
+		index = cache.IncludeOSIndex
+	default:
+		return
+	}
+	if slices.Contains(index[rule.Value], rule.CampaignID) {
+		return
+	}
+	index[rule.Value] = append(index[rule.Value], rule.CampaignID)
+}
+
+// rebuildCampaignIndexes replaces the index entries of the campaign with the ones of its cached rules, the caller
+// must hold the write lock
+func rebuildCampaignIndexes(cache *model.TargetingData, campaignID uuid.UUID) {
+	removeFromIndexes(cache, campaignID)
+	for _, rule := range cache.Rules {
+		if rule.CampaignID == campaignID {
+			addToIndex(cache, rule)
+		}
+	}
+}
+
+// removeFromIndexes drops the campaign from every index, keys left without campaigns are deleted
+func removeFromIndexes(cache *model.TargetingData, campaignID uuid.UUID) {
+	for _, idx := range cacheIndexes(cache) {
+		for key, ids := range idx.index {
+			if !slices.Contains(ids, campaignID) {
+				continue
+			}
+			ids = slices.DeleteFunc(ids, func(id uuid.UUID) bool { return id == campaignID })
+			if len(ids) == 0 {
+				delete(idx.index, key)
+			} else {
+				idx.index[key] = ids
+			}
+		}
+	}
+}
+
+func startFetch(ctx context.Context, table string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "db.fetch", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system.name", "postgresql"), attribute.String("db.collection.name", table)))
+}
+
+// startApply starts the span of a cache write, it includes the time spent waiting for the write lock
+func startApply(ctx context.Context) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "cache.apply")
+}
+
 // DeliveryService handles the delivery service request and returns the response based on the targeting rules
 // I am trying to use inverted indexing. It checks the cache for the campaigns that match the request criteria and returns them.
 // I am iterating over the cache to find the campaigns that match the request criteria
@@ -136,11 +288,93 @@ func ProcessRedisStreamDataService(ctx context.Context, tableName string, id str
 // the reason behind this approach of iterating is because it is clearly meantioned in the requirements
 // that the number of campaings will be few thousands and the number of requests will be in millions
 // so this approach is efficient enough to handle the load.
+// campaigns of a paused advertiser are skipped and an advertiser can cap how many of its campaigns go out in one response.
+// since map iteration order is random the capped campaigns rotate between requests.
 func DeliveryService(ctx context.Context, req *model.DeliveryServiceRequest) (res []*model.DeliveryServiceResponse, err error) {
+	_, span := tracing.Start(ctx, "target.DeliveryService", trace.WithAttributes(requestAttributes(req)...))
+	defer func() {
+		span.SetAttributes(attribute.Int("targetad.campaigns", len(res)))
+		tracing.End(span, err)
+	}()
+	if TargetCache == nil {
+		return nil, ErrCacheNotReady
+	}
+	TargetCache.TargetMutex.RLock()
+	defer TargetCache.TargetMutex.RUnlock()
+	return deliver(req), nil
+}
 
-	uniqueCampaigns := make(map[uuid.UUID]bool)
+func requestAttributes(req *model.DeliveryServiceRequest) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("targetad.app", req.AppID),
+		attribute.String("targetad.os", req.OS),
+		attribute.String("targetad.country", req.Country),
+	}
+}
+
+// BatchDeliveryService evaluates all the requests against one consistent snapshot of the cache. the read lock is held
+// for the whole batch so a stream update can not land in between two items. nil requests are skipped and get a nil result,
+// the endpoint uses that for the items which failed validation
+func BatchDeliveryService(ctx context.Context, reqs []*model.DeliveryServiceRequest) (_ [][]*model.DeliveryServiceResponse, err error) {
+	_, span := tracing.Start(ctx, "target.BatchDeliveryService", trace.WithAttributes(attribute.Int("targetad.batch_size", len(reqs))))
+	defer func() { tracing.End(span, err) }()
+	if TargetCache == nil {
+		return nil, ErrCacheNotReady
+	}
+	res := make([][]*model.DeliveryServiceResponse, len(reqs))
 	TargetCache.TargetMutex.RLock()
 	defer TargetCache.TargetMutex.RUnlock()
+	for i, req := range reqs {
+		if req == nil {
+			continue
+		}
+		res[i] = deliver(req)
+	}
+	return res, nil
+}
+
+// VideoDeliveryService is the video variant of DeliveryService, it runs the same targeting but only returns
+// video campaigns together with their assets so that the transport can render them as VAST
+func VideoDeliveryService(ctx context.Context, req *model.DeliveryServiceRequest) (res []*model.VideoDeliveryResponse, err error) {
+	_, span := tracing.Start(ctx, "target.VideoDeliveryService", trace.WithAttributes(requestAttributes(req)...))
+	defer func() {
+		span.SetAttributes(attribute.Int("targetad.campaigns", len(res)))
+		tracing.End(span, err)
+	}()
+	if TargetCache == nil {
+		return nil, ErrCacheNotReady
+	}
+	TargetCache.TargetMutex.RLock()
+	defer TargetCache.TargetMutex.RUnlock()
+	for _, campaign := range match(req, model.MediaTypeVideo) {
+		if campaign.Video == nil {
+			continue
+		}
+		res = append(res, &model.VideoDeliveryResponse{
+			CampaignStringID: campaign.CampaignStringID,
+			Name:             campaign.Name,
+			Video:            *campaign.Video,
+		})
+	}
+	return res, nil
+}
+
+// deliver does the banner lookup, the caller must hold the read lock of the cache
+func deliver(req *model.DeliveryServiceRequest) (res []*model.DeliveryServiceResponse) {
+	for _, campaign := range match(req, model.MediaTypeBanner) {
+		res = append(res, &model.DeliveryServiceResponse{
+			CampaignStringID: campaign.CampaignStringID,
+			Image:            campaign.ImageUrl,
+			Cta:              campaign.CTA,
+		})
+	}
+	return res
+}
+
+// match returns the deliverable campaigns of the given media type for the request, the advertiser cap
+// is applied per media type. the caller must hold the read lock of the cache
+func match(req *model.DeliveryServiceRequest, mediaType model.MediaType) (res []*model.Campaign) {
+	uniqueCampaigns := make(map[uuid.UUID]bool)
 	// Check for AppID targeting
 	if appIDs, ok := TargetCache.IncludeAppIndex[req.AppID]; ok {
 		for _, campaignID := range appIDs {
@@ -173,16 +407,71 @@ func DeliveryService(ctx context.Context, req *model.DeliveryServiceRequest) (re
 		}
 	}
 
+	// number of campaigns already picked per advertiser, used for the per advertiser cap
+	perAdvertiser := make(map[uuid.UUID]int)
 	for campaignID := range uniqueCampaigns {
 		campaign, exists := TargetCache.Campaigns[campaignID]
-		if exists && campaign.ActivityStatus && !campaign.IsDeleted {
-			res = append(res, &model.DeliveryServiceResponse{
-				CampaignStringID: campaign.CampaignStringID,
-				Image:            campaign.ImageUrl,
-				Cta:              campaign.CTA,
-			})
+		if exists && campaign.Status == model.CampaignStatusActive && !campaign.IsDeleted && campaign.MediaType == mediaType {
+			advertiser, ok := TargetCache.Advertisers[campaign.AdvertiserID]
+			if !ok || advertiser.IsPaused {
+				continue
+			}
+			if advertiser.MaxCampaignsPerResponse > 0 && perAdvertiser[advertiser.ID] >= advertiser.MaxCampaignsPerResponse {
+				continue
+			}
+			perAdvertiser[advertiser.ID]++
+			res = append(res, campaign)
 		}
 	}
 
-	return res, nil
+	return res
+}
+
+func toCacheCampaign(campaign dbpkg.Campaign) *model.Campaign {
+	c := &model.Campaign{
+		ID:               campaign.ID.Bytes,
+		CampaignStringID: campaign.CampaignStringID,
+		Name:             campaign.Name,
+		ImageUrl:         campaign.ImageUrl,
+		CTA:              campaign.Cta,
+		Status:           model.CampaignStatus(campaign.Status),
+		IsDeleted:        campaign.IsDeleted,
+		AdvertiserID:     campaign.AdvertiserID.Bytes,
+		MediaType:        model.MediaType(campaign.MediaType),
+		Version:          campaign.RowVersion,
+	}
+	if c.MediaType == "" {
+		c.MediaType = model.MediaTypeBanner
+	}
+	if c.MediaType == model.MediaTypeVideo && len(campaign.Video) > 0 {
+		var video model.VideoAsset
+		if err := json.Unmarshal(campaign.Video, &video); err != nil {
+			// the check constraint makes sure the json is there, a broken one only takes this campaign out of delivery
+			level.Error(log.With(baseLogger, "component", "target")).Log("msg", "invalid video assets", "campaign", campaign.CampaignStringID, "err", err)
+		} else {
+			c.Video = &video
+		}
+	}
+	return c
+}
+
+func toCacheRule(rule dbpkg.ListValidTargetingRulesRow) *model.TargetingRule {
+	return &model.TargetingRule{
+		ID:         rule.ID.Bytes,
+		CampaignID: rule.CampaignsID.Bytes,
+		IsIncluded: rule.IsIncluded,
+		Category:   rule.Category,
+		Value:      rule.Value,
+		Version:    rule.RowVersion,
+	}
+}
+
+func toCacheAdvertiser(advertiser dbpkg.Advertiser) *model.Advertiser {
+	return &model.Advertiser{
+		ID:                      advertiser.ID.Bytes,
+		Name:                    advertiser.Name,
+		IsPaused:                advertiser.IsPaused,
+		MaxCampaignsPerResponse: int(advertiser.MaxCampaignsPerResponse),
+		Version:                 advertiser.RowVersion,
+	}
 }
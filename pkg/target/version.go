@@ -0,0 +1,104 @@
+package target
+
+// version.go keeps the cache from going back in time. every campaign, advertiser and rule in the cache carries the
+// row_version it was loaded with and a change is only applied when it is newer. retries, claimed pending entries, the
+// replay after the bootstrap or two leaders during a failover can all deliver a change late or twice, without the
+// check an older image would overwrite a newer one. a removed row leaves a tombstone with its version until the next
+// full load, or until the reconciler found the row missing in pgsql on two runs (see pruneTombstones). a version of 0 is unknown (a row image written before the row_versions migration) and always applied
+
+import (
+	"context"
+	"encoding/json"
+	dbpkg "targetad/pkg/db"
+	"targetad/pkg/logger"
+	"targetad/pkg/target/model"
+
+	"github.com/go-kit/log/level"
+	"github.com/google/uuid"
+)
+
+// the reasons a change is dropped, the reason label of targetad_cache_changes_dropped_total
+const (
+	dropReasonStale     = "stale"     // the cache has a newer version of the row
+	dropReasonDuplicate = "duplicate" // the cache has this version of the row already
+)
+
+// cachedVersion returns the version of the row in the cache, the tombstone of a removed row or 0 when the row is
+// unknown. the caller must hold the lock
+func cachedVersion(cache *model.TargetingData, table string, id uuid.UUID) int64 {
+	switch table {
+	case string(dbpkg.CampaignsTable):
+		if campaign, ok := cache.Campaigns[id]; ok {
+			return campaign.Version
+		}
+	case string(dbpkg.AdvertisersTable):
+		if advertiser, ok := cache.Advertisers[id]; ok {
+			return advertiser.Version
+		}
+	case string(dbpkg.TargetingRulesTable):
+		if rule, ok := cache.Rules[id]; ok {
+			return rule.Version
+		}
+	}
+	return cache.Tombstones[id]
+}
+
+// admitChange reports whether a change which leaves the row at version is newer than the cache, a change which is
+// not is counted and dropped. the caller must hold the write lock
+func admitChange(ctx context.Context, cache *model.TargetingData, table string, id uuid.UUID, version int64) bool {
+	cached := cachedVersion(cache, table, id)
+	if version == 0 || cached == 0 || version > cached {
+		return true
+	}
+	reason := dropReasonStale
+	if version == cached {
+		reason = dropReasonDuplicate
+	}
+	changesDropped.With("table", table, "reason", reason).Add(1)
+	level.Debug(logger.FromContext(ctx, baseLogger)).Log("msg", "dropping change which is not newer than the cache", "table", table, "id", id,
+		"version", version, "cached_version", cached, "reason", reason)
+	return false
+}
+
+// setTombstone remembers the version of a row removed from the cache, the caller must hold the write lock
+func setTombstone(cache *model.TargetingData, id uuid.UUID, version int64) {
+	if version == 0 {
+		return
+	}
+	if cache.Tombstones == nil {
+		cache.Tombstones = make(map[uuid.UUID]int64)
+	}
+	cache.Tombstones[id] = version
+}
+
+// removeWithTombstone removes a row for a version 1 change, which does not carry the version of the delete. the
+// tombstone gets the version of the cached row, or keeps the one already there. the caller must hold the write lock
+func removeWithTombstone(cache *model.TargetingData, table string, id uuid.UUID) {
+	version := cachedVersion(cache, table, id)
+	switch table {
+	case string(dbpkg.CampaignsTable):
+		delete(cache.Campaigns, id)
+	case string(dbpkg.AdvertisersTable):
+		delete(cache.Advertisers, id)
+	case string(dbpkg.TargetingRulesTable):
+		delete(cache.Rules, id)
+	}
+	setTombstone(cache, id, version)
+}
+
+// changeImage returns the image of the row the change leaves behind: the new image, or the old one for a delete
+func changeImage(event *model.ChangeEvent) json.RawMessage {
+	if event.Operation == model.ChangeOperationDelete {
+		return event.Old
+	}
+	return event.New
+}
+
+// changeVersion returns the version of the row after the change, imageVersion is the row_version of changeImage.
+// a delete counts as one version after the deleted row so it wins over the last update of the row
+func changeVersion(event *model.ChangeEvent, imageVersion int64) int64 {
+	if event.Operation == model.ChangeOperationDelete && imageVersion > 0 {
+		return imageVersion + 1
+	}
+	return imageVersion
+}
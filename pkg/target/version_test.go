@@ -0,0 +1,33 @@
+package target
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	dbpkg "targetad/pkg/db"
+	"targetad/pkg/target/model"
+	"testing"
+)
+
+// TestVersionOneDeleteTombstone tests that a row removed by a version 1 change leaves a tombstone at its cached
+// version, so a late version 2 image of the row is dropped instead of bringing it back
+func TestVersionOneDeleteTombstone(t *testing.T) {
+	campaignID, _ := useReconcileTestCache()
+	campaign := TargetCache.Campaigns[campaignID]
+	campaign.Version = 4
+
+	removeWithTombstone(TargetCache, string(dbpkg.CampaignsTable), campaignID)
+	if _, ok := TargetCache.Campaigns[campaignID]; ok || TargetCache.Tombstones[campaignID] != 4 {
+		t.Fatalf("expected the campaign to be removed with a tombstone at version 4, got %v", TargetCache.Tombstones)
+	}
+
+	image := json.RawMessage(fmt.Sprintf(`{"id": %q, "campaign_string_id": "spotify", "status": "active", "advertiser_id": %q, "media_type": "banner", "row_version": 4}`,
+		campaignID, campaign.AdvertiserID))
+	event := &model.ChangeEvent{Version: 2, Operation: model.ChangeOperationUpdate, Table: "campaigns", ID: campaignID.String(), Old: image, New: image}
+	if err := ProcessChangeEvent(context.Background(), event); err != nil {
+		t.Fatalf("Failed to apply the change: %v", err)
+	}
+	if _, ok := TargetCache.Campaigns[campaignID]; ok {
+		t.Fatal("expected the redelivered image to be dropped")
+	}
+}
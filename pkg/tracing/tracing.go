@@ -0,0 +1,148 @@
+package tracing
+
+// tracing.go sets up OpenTelemetry tracing. spans are exported over OTLP/gRPC to a collector, for local runs they can
+// be written to stdout or to a file instead. the trace context of a cache change travels from the pgsql notification
+// through the redis stream to every worker, see InjectStreamFields and ExtractStreamFields.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "targetad"
+
+type Config struct {
+	Exporter    string  `mapstructure:"exporter"`    // otlp, stdout, file or none
+	Endpoint    string  `mapstructure:"endpoint"`    // host:port of the otlp collector
+	Insecure    bool    `mapstructure:"insecure"`    // plaintext grpc to the collector
+	File        string  `mapstructure:"file"`        // output of the file exporter
+	SampleRatio float64 `mapstructure:"sampleRatio"` // fraction of new traces which are recorded, 1 records everything
+	ServiceName string  `mapstructure:"serviceName"`
+}
+
+// Init installs the global tracer provider and the w3c trace context propagator. the returned function flushes
+// the buffered spans and must be called on shutdown. with the none exporter the otel no-op provider stays in place
+func Init(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var (
+		exporter sdktrace.SpanExporter
+		closer   io.Closer
+		err      error
+	)
+	switch cfg.Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		var f *os.File
+		if f, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			return nil, fmt.Errorf("error opening trace file: %w", err)
+		}
+		closer = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceName(cfg.ServiceName)), resource.WithFromEnv(), resource.WithTelemetrySDK())
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// a change which is sampled when it is pushed stays sampled on every worker
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// Start starts a span with the service tracer
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// End records err on the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InjectStreamFields writes the trace context of ctx into the fields of a redis stream message
+func InjectStreamFields(ctx context.Context, fields map[string]interface{}) {
+	otel.GetTextMapPropagator().Inject(ctx, streamCarrier(fields))
+}
+
+// ExtractStreamFields returns ctx with the remote trace context found in the fields of a redis stream message
+func ExtractStreamFields(ctx context.Context, fields map[string]interface{}) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, streamCarrier(fields))
+}
+
+// TraceID returns the trace id of the span in ctx, empty when there is no recording span
+func TraceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// Table is the attribute used on every span of the change path
+func Table(name string) attribute.KeyValue {
+	return attribute.String("targetad.table", name)
+}
+
+// streamCarrier adapts the field map of a redis stream message to a propagation.TextMapCarrier.
+// go-redis hands the fields back as strings, anything else is ignored
+type streamCarrier map[string]interface{}
+
+func (c streamCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c streamCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c streamCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,197 @@
+package vast
+
+// vast.go renders matched video campaigns as an IAB VAST 4.2 document which video players can load directly.
+// only inline linear ads are produced, wrappers, companions and non linear ads are not supported.
+// the impression and tracking urls point to our own tracking host, see the vast section of config.json
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"slices"
+	"targetad/pkg/target/model"
+
+	"github.com/google/uuid"
+)
+
+// Version is the VAST version of the documents we produce
+const Version = "4.2"
+
+// MediaType is the Content-Type of the rendered document
+const MediaType = "application/xml"
+
+// trackingEvents are the linear events every creative reports back
+var trackingEvents = []string{"start", "firstQuartile", "midpoint", "thirdQuartile", "complete"}
+
+// IsTrackingEvent tells if event is one of the linear events our documents report
+func IsTrackingEvent(event string) bool {
+	return slices.Contains(trackingEvents, event)
+}
+
+// TrackingRequest is one call of a player to an impression or event tracking url, see trackingURL
+type TrackingRequest struct {
+	Kind       string `json:"-"` // impression or event, taken from the path
+	CampaignID string `json:"cid" validate:"required"`
+	ServingID  string `json:"sid" validate:"required,uuid"`
+	Event      string `json:"event" validate:"required_if=Kind event,omitempty,vast_event"`
+}
+
+// Config holds the rendering settings, they come from the vast section of config.json
+type Config struct {
+	AdSystem        string // name of our ad server shown in <AdSystem>
+	TrackingBaseURL string // impressions go to <base>/impression and player events to <base>/event
+}
+
+type VAST struct {
+	XMLName xml.Name `xml:"VAST"`
+	Version string   `xml:"version,attr"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Ads     []Ad     `xml:"Ad"`
+}
+
+type Ad struct {
+	ID       string  `xml:"id,attr"`
+	Sequence int     `xml:"sequence,attr,omitempty"`
+	InLine   *InLine `xml:"InLine"`
+}
+
+type InLine struct {
+	AdSystem    string       `xml:"AdSystem"`
+	AdTitle     string       `xml:"AdTitle"`
+	AdServingID string       `xml:"AdServingId"`
+	Impressions []Impression `xml:"Impression"`
+	Creatives   Creatives    `xml:"Creatives"`
+}
+
+type Impression struct {
+	ID  string `xml:"id,attr,omitempty"`
+	URL string `xml:",cdata"`
+}
+
+type Creatives struct {
+	Creative []Creative `xml:"Creative"`
+}
+
+type Creative struct {
+	ID            string        `xml:"id,attr,omitempty"`
+	AdID          string        `xml:"adId,attr,omitempty"`
+	UniversalAdID UniversalAdID `xml:"UniversalAdId"`
+	Linear        Linear        `xml:"Linear"`
+}
+
+type UniversalAdID struct {
+	IDRegistry string `xml:"idRegistry,attr"`
+	Value      string `xml:",chardata"`
+}
+
+type Linear struct {
+	Duration       string         `xml:"Duration"` // HH:MM:SS
+	TrackingEvents TrackingEvents `xml:"TrackingEvents"`
+	VideoClicks    *VideoClicks   `xml:"VideoClicks,omitempty"`
+	MediaFiles     MediaFiles     `xml:"MediaFiles"`
+}
+
+type TrackingEvents struct {
+	Tracking []Tracking `xml:"Tracking"`
+}
+
+type Tracking struct {
+	Event string `xml:"event,attr"`
+	URL   string `xml:",cdata"`
+}
+
+type VideoClicks struct {
+	ClickThrough ClickThrough `xml:"ClickThrough"`
+}
+
+type ClickThrough struct {
+	ID  string `xml:"id,attr,omitempty"`
+	URL string `xml:",cdata"`
+}
+
+type MediaFiles struct {
+	MediaFile []MediaFile `xml:"MediaFile"`
+}
+
+type MediaFile struct {
+	Delivery string `xml:"delivery,attr"`
+	Type     string `xml:"type,attr"`
+	Width    int    `xml:"width,attr"`
+	Height   int    `xml:"height,attr"`
+	Bitrate  int    `xml:"bitrate,attr,omitempty"`
+	URL      string `xml:",cdata"`
+}
+
+// New renders the campaigns as one inline ad each, in the order they were matched.
+// no campaigns gives an empty <VAST> element, which is how VAST says there is no ad
+func New(campaigns []*model.VideoDeliveryResponse, cfg Config) *VAST {
+	doc := &VAST{Version: Version, XMLNS: "http://www.iab.com/VAST"}
+	if len(campaigns) == 0 {
+		return doc
+	}
+	// one serving id per response, the tracking calls use it to tie the events back to this delivery
+	servingID := uuid.NewString()
+	for i, campaign := range campaigns {
+		doc.Ads = append(doc.Ads, Ad{
+			ID:       campaign.CampaignStringID,
+			Sequence: sequence(i, len(campaigns)),
+			InLine: &InLine{
+				AdSystem:    cfg.AdSystem,
+				AdTitle:     campaign.Name,
+				AdServingID: servingID,
+				Impressions: []Impression{{ID: campaign.CampaignStringID, URL: trackingURL(cfg, "impression", campaign.CampaignStringID, servingID, "")}},
+				Creatives:   Creatives{Creative: []Creative{newCreative(campaign, cfg, servingID)}},
+			},
+		})
+	}
+	return doc
+}
+
+func newCreative(campaign *model.VideoDeliveryResponse, cfg Config, servingID string) Creative {
+	linear := Linear{Duration: duration(campaign.Video.DurationSeconds)}
+	for _, event := range trackingEvents {
+		linear.TrackingEvents.Tracking = append(linear.TrackingEvents.Tracking, Tracking{
+			Event: event,
+			URL:   trackingURL(cfg, "event", campaign.CampaignStringID, servingID, event),
+		})
+	}
+	if campaign.Video.ClickThroughURL != "" {
+		linear.VideoClicks = &VideoClicks{ClickThrough: ClickThrough{URL: campaign.Video.ClickThroughURL}}
+	}
+	for _, file := range campaign.Video.MediaFiles {
+		linear.MediaFiles.MediaFile = append(linear.MediaFiles.MediaFile, MediaFile{
+			Delivery: "progressive",
+			Type:     file.MimeType,
+			Width:    file.Width,
+			Height:   file.Height,
+			Bitrate:  file.Bitrate,
+			URL:      file.URL,
+		})
+	}
+	return Creative{
+		ID:            campaign.CampaignStringID,
+		AdID:          campaign.CampaignStringID,
+		UniversalAdID: UniversalAdID{IDRegistry: cfg.AdSystem, Value: campaign.CampaignStringID},
+		Linear:        linear,
+	}
+}
+
+// sequence numbers the ads of a pod, a single ad is not a pod and goes without one
+func sequence(i, total int) int {
+	if total == 1 {
+		return 0
+	}
+	return i + 1
+}
+
+func duration(seconds int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+func trackingURL(cfg Config, path, campaignID, servingID, event string) string {
+	q := url.Values{"cid": {campaignID}, "sid": {servingID}}
+	if event != "" {
+		q.Set("event", event)
+	}
+	return fmt.Sprintf("%s/%s?%s", cfg.TrackingBaseURL, path, q.Encode())
+}
@@ -2,12 +2,54 @@ package main
 
 // this file contains all the tests for this microservice
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"targetad/pb"
+	"targetad/pkg/admin"
+	"targetad/pkg/apperr"
+	"targetad/pkg/auth"
 	dbpkg "targetad/pkg/db"
+	"targetad/pkg/health"
+	"targetad/pkg/logger"
+	"targetad/pkg/openrtb"
+	"targetad/pkg/redisstream"
+	"targetad/pkg/target"
+	"targetad/pkg/target/model"
+	"targetad/pkg/tracing"
+	"targetad/pkg/vast"
+	"targetad/transport"
 	"testing"
+	"time"
 
+	kitlog "github.com/go-kit/log"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
 )
 
 // loadEnvAndConfig loads environment variables and configuration from viper
@@ -44,7 +86,7 @@ func TestCheckPostgresSetup(t *testing.T) {
 		t.Fatalf("Failed to load environment variables: %v", err)
 	}
 
-	conn, err := dbpkg.InitDB()
+	conn, err := dbpkg.InitDB(logger.Get())
 	if err != nil {
 		t.Fatalf("Failed to initialize database connection: %v", err)
 	}
@@ -53,3 +95,759 @@ func TestCheckPostgresSetup(t *testing.T) {
 	}
 	t.Logf("Database connection established test successful: %v", conn)
 }
+
+// TestAdminAuthentication tests that api keys and hmac signed jwts are verified against the locally configured keys
+// and that the roles are enforced in the right order
+func TestAdminAuthentication(t *testing.T) {
+	t.Setenv("TEST_ADMIN_API_KEY", "test-api-key")
+	t.Setenv("TEST_JWT_HMAC_SECRET", "test-jwt-secret")
+	viper.Set("auth.apiKeys", []map[string]interface{}{{"subject": "ops", "role": "admin", "keyEnv": "TEST_ADMIN_API_KEY"}})
+	viper.Set("auth.jwt.issuer", "targetad")
+	viper.Set("auth.jwt.keys", []map[string]interface{}{{"kid": "test", "secretEnv": "TEST_JWT_HMAC_SECRET"}})
+	if err := auth.InitAuth(logger.Get()); err != nil {
+		t.Fatalf("Failed to initialize auth: %v", err)
+	}
+
+	p, err := auth.Authenticate(auth.Credentials{APIKey: "test-api-key"})
+	if err != nil || p.Subject != "ops" || !p.Can(auth.RoleAdmin) {
+		t.Fatalf("expected admin principal for a valid api key, got %v %v", p, err)
+	}
+	if _, err := auth.Authenticate(auth.Credentials{APIKey: "wrong-key"}); err != auth.ErrUnauthenticated {
+		t.Fatalf("expected unauthenticated error for a wrong api key, got %v", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, auth.Claims{
+		Role: "viewer",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "reporting-bot",
+			Issuer:    "targetad",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	})
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString([]byte("test-jwt-secret"))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	p, err = auth.Authenticate(auth.Credentials{BearerToken: signed})
+	if err != nil || p.Subject != "reporting-bot" {
+		t.Fatalf("expected viewer principal for a valid jwt, got %v %v", p, err)
+	}
+	if !p.Can(auth.RoleViewer) || p.Can(auth.RoleEditor) {
+		t.Fatalf("viewer must not be allowed to edit")
+	}
+
+	forged, _ := token.SignedString([]byte("some-other-secret"))
+	if _, err := auth.Authenticate(auth.Credentials{BearerToken: forged}); err != auth.ErrUnauthenticated {
+		t.Fatalf("expected unauthenticated error for a forged jwt, got %v", err)
+	}
+}
+
+// TestDeliveryAdvertiserControls tests that paused advertisers are not served and that the per advertiser cap is applied
+func TestDeliveryAdvertiserControls(t *testing.T) {
+	paused, capped := uuid.New(), uuid.New()
+	cache := &model.TargetingData{
+		Campaigns: map[uuid.UUID]*model.Campaign{},
+		Advertisers: map[uuid.UUID]*model.Advertiser{
+			paused: {ID: paused, IsPaused: true},
+			capped: {ID: capped, MaxCampaignsPerResponse: 2},
+		},
+		IncludeCountryIndex: map[string][]uuid.UUID{},
+		ExcludeCountryIndex: map[string][]uuid.UUID{},
+		IncludeOSIndex:      map[string][]uuid.UUID{},
+		IncludeAppIndex:     map[string][]uuid.UUID{},
+	}
+	for i, advertiserID := range []uuid.UUID{paused, capped, capped, capped} {
+		id := uuid.New()
+		cache.Campaigns[id] = &model.Campaign{ID: id, CampaignStringID: fmt.Sprintf("c%d", i), Status: model.CampaignStatusActive, MediaType: model.MediaTypeBanner, AdvertiserID: advertiserID}
+		cache.IncludeCountryIndex["US"] = append(cache.IncludeCountryIndex["US"], id)
+	}
+	target.TargetCache = cache
+
+	res, err := target.DeliveryService(context.Background(), &model.DeliveryServiceRequest{AppID: "app", OS: "android", Country: "US"})
+	if err != nil {
+		t.Fatalf("DeliveryService failed: %v", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 campaigns after the advertiser cap, got %d", len(res))
+	}
+	for _, r := range res {
+		if r.CampaignStringID == "c0" {
+			t.Fatalf("campaign of a paused advertiser was served")
+		}
+	}
+}
+
+// TestCampaignLifecycleTransitions tests the allowed and the forbidden campaign status transitions
+func TestCampaignLifecycleTransitions(t *testing.T) {
+	allowed := [][2]model.CampaignStatus{
+		{model.CampaignStatusDraft, model.CampaignStatusPendingReview},
+		{model.CampaignStatusPendingReview, model.CampaignStatusActive},
+		{model.CampaignStatusActive, model.CampaignStatusPaused},
+		{model.CampaignStatusPaused, model.CampaignStatusActive},
+		{model.CampaignStatusPaused, model.CampaignStatusCompleted},
+		{model.CampaignStatusActive, model.CampaignStatusArchived},
+	}
+	for _, tr := range allowed {
+		if !admin.CanTransition(tr[0], tr[1]) {
+			t.Errorf("expected %s -> %s to be allowed", tr[0], tr[1])
+		}
+	}
+	forbidden := [][2]model.CampaignStatus{
+		{model.CampaignStatusDraft, model.CampaignStatusActive},
+		{model.CampaignStatusArchived, model.CampaignStatusActive},
+		{model.CampaignStatusCompleted, model.CampaignStatusActive},
+		{model.CampaignStatusActive, model.CampaignStatusActive},
+	}
+	for _, tr := range forbidden {
+		if admin.CanTransition(tr[0], tr[1]) {
+			t.Errorf("expected %s -> %s to be rejected", tr[0], tr[1])
+		}
+	}
+}
+
+// useSpotifyTestCache replaces the cache with a single active campaign (spotify) targeting the US
+func useSpotifyTestCache() {
+	advertiserID, campaignID, ruleID := uuid.New(), uuid.New(), uuid.New()
+	target.TargetCache = &model.TargetingData{
+		Campaigns: map[uuid.UUID]*model.Campaign{
+			campaignID: {ID: campaignID, CampaignStringID: "spotify", ImageUrl: "https://somelink", CTA: "Download", Status: model.CampaignStatusActive, MediaType: model.MediaTypeBanner, AdvertiserID: advertiserID},
+		},
+		Advertisers:         map[uuid.UUID]*model.Advertiser{advertiserID: {ID: advertiserID}},
+		IncludeCountryIndex: map[string][]uuid.UUID{"US": {campaignID}},
+		ExcludeCountryIndex: map[string][]uuid.UUID{},
+		IncludeOSIndex:      map[string][]uuid.UUID{},
+		IncludeAppIndex:     map[string][]uuid.UUID{},
+		Rules: map[uuid.UUID]*model.TargetingRule{
+			ruleID: {ID: ruleID, CampaignID: campaignID, IsIncluded: true, Category: int32(model.TargetCategoryCountry), Value: "US"},
+		},
+		Tombstones: map[uuid.UUID]int64{},
+	}
+}
+
+// TestGRPCDelivery tests the grpc transport end to end over an in memory connection,
+// including the status code of a request which fails validation
+func TestGRPCDelivery(t *testing.T) {
+	useSpotifyTestCache()
+
+	lis := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	pb.RegisterDeliveryServiceServer(server, transport.NewGRPCServer(logger.Get()))
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial grpc server: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewDeliveryServiceClient(conn)
+
+	res, err := client.Delivery(context.Background(), &pb.DeliveryRequest{App: "app", Os: "android", Country: "US"})
+	if err != nil {
+		t.Fatalf("Delivery failed: %v", err)
+	}
+	if len(res.GetCampaigns()) != 1 || res.GetCampaigns()[0].GetCid() != "spotify" {
+		t.Fatalf("unexpected campaigns: %v", res.GetCampaigns())
+	}
+
+	_, err = client.Delivery(context.Background(), &pb.DeliveryRequest{App: "app", Country: "US"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a missing os, got %v", err)
+	}
+}
+
+// TestOpenRTBBidRequest tests that an openrtb bid request is mapped onto the normal targeting and answered
+// with a bid response, or with 204 No Content when nothing matches
+func TestOpenRTBBidRequest(t *testing.T) {
+	useSpotifyTestCache()
+	viper.Set("openrtb.seat", "targetad")
+	viper.Set("openrtb.bidPrice", 1.5)
+	viper.Set("openrtb.currency", "USD")
+	handler := transport.NewHTTPHandler(logger.Get())
+
+	bid := func(country string) *httptest.ResponseRecorder {
+		body := `{"id":"req-1","imp":[{"id":"1","banner":{"w":320,"h":50},"bidfloor":0.5}],
+			"app":{"bundle":"com.example.app"},"device":{"os":"Android","geo":{"country":"` + country + `"}}}`
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/openrtb/bid", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := bid("USA")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a matching bid request, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res openrtb.BidResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Failed to decode bid response: %v", err)
+	}
+	if res.ID != "req-1" || len(res.SeatBid) != 1 || len(res.SeatBid[0].Bid) != 1 {
+		t.Fatalf("unexpected bid response: %+v", res)
+	}
+	if b := res.SeatBid[0].Bid[0]; b.ImpID != "1" || b.CrID != "spotify" || b.Price != 1.5 {
+		t.Fatalf("unexpected bid: %+v", b)
+	}
+
+	if rec := bid("DEU"); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 when nothing matches, got %d", rec.Code)
+	}
+}
+
+// TestBatchDelivery tests that every item of a batch is validated on its own and that the results keep the request order
+func TestBatchDelivery(t *testing.T) {
+	useSpotifyTestCache()
+	viper.Set("delivery.maxBatchSize", 10)
+	handler := transport.NewHTTPHandler(logger.Get())
+
+	body := `{"items":[
+		{"correlation_id":"a","app":"app","os":"android","country":"US"},
+		{"correlation_id":"b","app":"app","country":"US"},
+		{"correlation_id":"c","app":"app","os":"ios","country":"DE"}]}`
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/delivery/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res model.BatchDeliveryServiceResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Failed to decode batch response: %v", err)
+	}
+	if len(res.Items) != 3 || res.Items[0].CorrelationID != "a" || res.Items[1].CorrelationID != "b" || res.Items[2].CorrelationID != "c" {
+		t.Fatalf("unexpected batch items: %+v", res.Items)
+	}
+	if len(res.Items[0].Campaigns) != 1 || res.Items[0].Error != nil {
+		t.Fatalf("expected one campaign for item a, got %+v", res.Items[0])
+	}
+	if res.Items[1].Error == nil || res.Items[1].Error.Fields[0].Field != "os" || res.Items[1].Campaigns != nil {
+		t.Fatalf("expected a validation error for item b, got %+v", res.Items[1])
+	}
+	if len(res.Items[2].Campaigns) != 0 || res.Items[2].Error != nil {
+		t.Fatalf("expected no campaigns for item c, got %+v", res.Items[2])
+	}
+}
+
+// TestStructuredErrorResponses tests the status codes and the json error body of validation and decode failures
+func TestStructuredErrorResponses(t *testing.T) {
+	useSpotifyTestCache()
+	handler := transport.NewHTTPHandler(logger.Get())
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		code        apperr.Code
+	}{
+		{"missing field", "application/json", `{"app":"app","country":"US"}`, http.StatusBadRequest, apperr.CodeValidation},
+		{"malformed json", "application/json", `{"app":`, http.StatusBadRequest, apperr.CodeMalformedRequest},
+		{"wrong content type", "text/plain", `app=app`, http.StatusUnsupportedMediaType, apperr.CodeUnsupportedMediaType},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/v1/delivery", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Fatalf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+		var res struct {
+			Error apperr.Error `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: error body is not json: %s", tc.name, rec.Body.String())
+		}
+		if res.Error.Code != tc.code {
+			t.Fatalf("%s: expected code %s, got %s", tc.name, tc.code, res.Error.Code)
+		}
+		if tc.code == apperr.CodeValidation && (len(res.Error.Fields) != 1 || res.Error.Fields[0].Field != "os" || res.Error.Fields[0].Rule != "required") {
+			t.Fatalf("%s: unexpected fields %+v", tc.name, res.Error.Fields)
+		}
+	}
+}
+
+// TestDeliveryContentNegotiation tests that the delivery endpoint decodes protobuf bodies and encodes
+// the response in the format asked for in the Accept header
+func TestDeliveryContentNegotiation(t *testing.T) {
+	useSpotifyTestCache()
+	handler := transport.NewHTTPHandler(logger.Get())
+
+	body, err := proto.Marshal(&pb.DeliveryRequest{App: "app", Os: "android", Country: "US"})
+	if err != nil {
+		t.Fatalf("Failed to marshal protobuf request: %v", err)
+	}
+	deliver := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/delivery", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := deliver("application/x-protobuf")
+	var pbRes pb.DeliveryResponse
+	if err := proto.Unmarshal(rec.Body.Bytes(), &pbRes); err != nil || len(pbRes.GetCampaigns()) != 1 || pbRes.GetCampaigns()[0].GetCid() != "spotify" {
+		t.Fatalf("unexpected protobuf response (%d): %v %v", rec.Code, pbRes.GetCampaigns(), err)
+	}
+
+	rec = deliver("application/json;q=0.5, application/msgpack")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/msgpack" {
+		t.Fatalf("expected a msgpack response, got %s", ct)
+	}
+	var mpRes []*model.DeliveryServiceResponse
+	dec := msgpack.NewDecoder(rec.Body)
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(&mpRes); err != nil || len(mpRes) != 1 || mpRes[0].CampaignStringID != "spotify" {
+		t.Fatalf("unexpected msgpack response: %v %v", mpRes, err)
+	}
+
+	if rec := deliver("image/png"); rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("expected 406 for an unsupported Accept, got %d", rec.Code)
+	}
+}
+
+// TestVASTDelivery tests that video campaigns are rendered as VAST and never show up in the banner delivery
+func TestVASTDelivery(t *testing.T) {
+	useSpotifyTestCache()
+	videoID := uuid.New()
+	var advertiserID uuid.UUID
+	for id := range target.TargetCache.Advertisers {
+		advertiserID = id
+	}
+	target.TargetCache.Campaigns[videoID] = &model.Campaign{ID: videoID, CampaignStringID: "preroll", Name: "Preroll", Status: model.CampaignStatusActive,
+		AdvertiserID: advertiserID, MediaType: model.MediaTypeVideo, Video: &model.VideoAsset{
+			DurationSeconds: 75,
+			ClickThroughURL: "https://example.com/landing",
+			MediaFiles:      []model.MediaFile{{URL: "https://cdn.example.com/preroll.mp4", MimeType: "video/mp4", Width: 1280, Height: 720}},
+		}}
+	target.TargetCache.IncludeCountryIndex["US"] = append(target.TargetCache.IncludeCountryIndex["US"], videoID)
+	viper.Set("vast.adSystem", "targetad")
+	viper.Set("vast.trackingBaseUrl", "https://track.example.com/v1/tracking")
+	handler := transport.NewHTTPHandler(logger.Get())
+
+	banners, err := target.DeliveryService(context.Background(), &model.DeliveryServiceRequest{AppID: "app", OS: "android", Country: "US"})
+	if err != nil {
+		t.Fatalf("DeliveryService failed: %v", err)
+	}
+	if len(banners) != 1 || banners[0].CampaignStringID != "spotify" {
+		t.Fatalf("expected only the banner campaign, got %+v", banners)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/delivery/vast?app=app&os=android&country=US", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != vast.MediaType {
+		t.Fatalf("expected 200 with xml, got %d %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	var doc vast.VAST
+	if err := xml.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Failed to decode VAST: %v", err)
+	}
+	if doc.Version != vast.Version || len(doc.Ads) != 1 || doc.Ads[0].InLine == nil {
+		t.Fatalf("unexpected VAST document: %s", rec.Body.String())
+	}
+	inline := doc.Ads[0].InLine
+	if len(inline.Impressions) != 1 || !strings.HasPrefix(inline.Impressions[0].URL, "https://track.example.com/v1/tracking/impression?") {
+		t.Fatalf("unexpected impressions: %+v", inline.Impressions)
+	}
+	linear := inline.Creatives.Creative[0].Linear
+	if linear.Duration != "00:01:15" || len(linear.TrackingEvents.Tracking) != 5 {
+		t.Fatalf("unexpected linear creative: %+v", linear)
+	}
+	if f := linear.MediaFiles.MediaFile; len(f) != 1 || f[0].URL != "https://cdn.example.com/preroll.mp4" || f[0].Type != "video/mp4" {
+		t.Fatalf("unexpected media files: %+v", f)
+	}
+
+	// the tracking urls of the document are served by the same handler
+	for _, tracking := range []string{inline.Impressions[0].URL, linear.TrackingEvents.Tracking[0].URL} {
+		u, err := url.Parse(tracking)
+		if err != nil {
+			t.Fatalf("Failed to parse the tracking url %q: %v", tracking, err)
+		}
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u.RequestURI(), nil))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("expected 204 from %s, got %d: %s", u.RequestURI(), rec.Code, rec.Body.String())
+		}
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/tracking/event?cid=preroll&sid="+inline.AdServingID+"&event=pause", nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"field":"event"`) {
+		t.Fatalf("expected an unknown event to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/delivery/vast?app=app&os=android&country=DE", nil))
+	var empty vast.VAST
+	if err := xml.Unmarshal(rec.Body.Bytes(), &empty); err != nil || rec.Code != http.StatusOK || len(empty.Ads) != 0 {
+		t.Fatalf("expected an empty VAST document, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestMetricsEndpoint tests that delivery requests and the cache show up on /metrics
+func TestMetricsEndpoint(t *testing.T) {
+	useSpotifyTestCache()
+	handler := transport.NewHTTPHandler(logger.Get())
+
+	for _, body := range []string{`{"app":"app","os":"android","country":"US"}`, `{"app":"app","os":"android","country":"DE"}`, `{"app":"app"}`} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/delivery", strings.NewReader(body)))
+	}
+	// requests rejected by the decoders never reach the endpoint but are counted as well
+	unsupported := httptest.NewRequest(http.MethodPost, "/v1/delivery", strings.NewReader(`app=app`))
+	unsupported.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(httptest.NewRecorder(), unsupported)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/delivery/batch", strings.NewReader(`{"items":`)))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	for _, want := range []string{
+		`targetad_delivery_requests_total{endpoint="delivery",outcome="ok"}`,
+		`targetad_delivery_requests_total{endpoint="delivery",outcome="validation_failed"}`,
+		`targetad_delivery_requests_total{endpoint="delivery",outcome="unsupported_media_type"}`,
+		`targetad_delivery_requests_total{endpoint="batch",outcome="malformed_request"}`,
+		`targetad_delivery_validation_failures_total{endpoint="delivery",field="os"}`,
+		`targetad_delivery_filled_total{endpoint="delivery"}`,
+		`targetad_delivery_campaigns_returned_bucket{endpoint="delivery",le="1"}`,
+		`targetad_cache_campaigns 1`,
+		`targetad_cache_index_keys{category="country",rule="include"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics output is missing %s", want)
+		}
+	}
+}
+
+// TestRequestIDHeader tests that the caller's request id is echoed back and written to the request log of the handler,
+// and that a new one is generated otherwise
+func TestRequestIDHeader(t *testing.T) {
+	useSpotifyTestCache()
+	var logs bytes.Buffer
+	handler := transport.NewHTTPHandler(kitlog.NewJSONLogger(&logs))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/delivery", strings.NewReader(`{"app":"app","os":"android","country":"US"}`))
+	req.Header.Set("X-Request-ID", "lb-1234")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-ID"); got != "lb-1234" {
+		t.Fatalf("expected the caller's request id to be echoed, got %q", got)
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil || line["request_id"] != "lb-1234" || line["endpoint"] != "delivery" {
+		t.Fatalf("expected the request line in the log of the handler, got %q", logs.String())
+	}
+
+	// error responses carry the id as well
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/delivery", strings.NewReader(`{"app":"app"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if _, err := uuid.Parse(rec.Header().Get("X-Request-ID")); err != nil {
+		t.Fatalf("expected a generated request id, got %q", rec.Header().Get("X-Request-ID"))
+	}
+}
+
+// TestDeliveryTracing tests that the http span continues the caller's trace and that DeliveryService is a child of it,
+// and that the trace context survives the round trip through the stream message fields
+func TestDeliveryTracing(t *testing.T) {
+	useSpotifyTestCache()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	handler := transport.NewHTTPHandler(logger.Get())
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/v1/delivery", strings.NewReader(`{"app":"app","os":"android","country":"US"}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	server, ok := spans["/v1/delivery"]
+	if !ok || server.SpanContext().TraceID().String() != traceID {
+		t.Fatalf("expected a server span in the caller's trace, got %v", spans)
+	}
+	delivery, ok := spans["target.DeliveryService"]
+	if !ok || delivery.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Fatalf("expected DeliveryService to be a child of the server span, got %v", spans)
+	}
+
+	ctx, span := tracing.Start(context.Background(), "redisstream.push")
+	fields := map[string]interface{}{"table": "campaigns"}
+	tracing.InjectStreamFields(ctx, fields)
+	span.End()
+	if got := trace.SpanContextFromContext(tracing.ExtractStreamFields(context.Background(), fields)); got.TraceID() != span.SpanContext().TraceID() {
+		t.Fatalf("expected the stream fields to carry trace %s, got %s", span.SpanContext().TraceID(), got.TraceID())
+	}
+}
+
+// TestHealthEndpoints tests that /healthz is always up and that /readyz reports every check and only passes when all of them do
+func TestHealthEndpoints(t *testing.T) {
+	handler := transport.NewHTTPHandler(logger.Get())
+	target.TargetCache = nil
+	health.Register("cache", target.CheckCache)
+	health.SetReady(true)
+	defer health.SetReady(false)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected /healthz to be 200, got %d", rec.Code)
+	}
+
+	readyz := func() (int, health.Report) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report health.Report
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Failed to decode readiness report: %v", err)
+		}
+		return rec.Code, report
+	}
+
+	code, report := readyz()
+	if code != http.StatusServiceUnavailable || report.Checks["cache"].Status != health.StatusFail || report.Checks["serving"].Status != health.StatusOK {
+		t.Fatalf("expected 503 with a failed cache check, got %d %+v", code, report)
+	}
+
+	useSpotifyTestCache()
+	health.SetInfo("leader", "worker-1")
+	defer health.SetInfo("leader", "")
+	if code, report := readyz(); code != http.StatusOK || report.Status != health.StatusOK || report.Info["leader"] != "worker-1" {
+		t.Fatalf("expected 200 with the leader once the cache is loaded, got %d %+v", code, report)
+	}
+
+	health.SetReady(false)
+	if code, report := readyz(); code != http.StatusServiceUnavailable || report.Checks["serving"].Status != health.StatusFail {
+		t.Fatalf("expected 503 while shutting down, got %d %+v", code, report)
+	}
+}
+
+// TestCacheIntrospection tests the admin view of the cache, including that advertiser scoped keys are refused
+func TestCacheIntrospection(t *testing.T) {
+	t.Setenv("TEST_OPS_API_KEY", "ops-key")
+	t.Setenv("TEST_ADVERTISER_API_KEY", "advertiser-key")
+	viper.Set("auth.apiKeys", []map[string]interface{}{
+		{"subject": "ops", "role": "viewer", "keyEnv": "TEST_OPS_API_KEY"},
+		{"subject": "acme", "role": "admin", "keyEnv": "TEST_ADVERTISER_API_KEY", "advertiserId": uuid.NewString()},
+	})
+	if err := auth.InitAuth(logger.Get()); err != nil {
+		t.Fatalf("Failed to initialize auth: %v", err)
+	}
+	useSpotifyTestCache()
+	target.TargetCache.SnapshotVersion = 3
+	target.TargetCache.StreamOffset = "1699999999999-0"
+	target.RecordAppliedMessage("1700000000000-0")
+	var campaignID uuid.UUID
+	for id := range target.TargetCache.Campaigns {
+		campaignID = id
+	}
+
+	handler := transport.NewHTTPHandler(logger.Get())
+	get := func(path, key string, v interface{}) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if v != nil && rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatalf("Failed to decode %s: %v", path, err)
+			}
+		}
+		return rec.Code
+	}
+
+	var state model.CacheState
+	if code := get("/v1/admin/cache", "ops-key", &state); code != http.StatusOK {
+		t.Fatalf("expected 200 for the cache state, got %d", code)
+	}
+	if state.SnapshotVersion != 3 || state.StreamOffset != "1699999999999-0" || state.LastAppliedMessageID != "1700000000000-0" || state.AppliedMessages != 1 || state.Campaigns != 1 {
+		t.Fatalf("unexpected cache state %+v", state)
+	}
+	for _, idx := range state.Indexes {
+		if idx.Index == target.IndexIncludeCountry && (idx.Keys != 1 || idx.Entries != 1) {
+			t.Fatalf("expected one key and one entry in the country index, got %+v", idx)
+		}
+	}
+
+	var entries model.CacheIndexEntries
+	if code := get("/v1/admin/cache/indexes/include_country/US", "ops-key", &entries); code != http.StatusOK || len(entries.CampaignIDs) != 1 || entries.CampaignIDs[0] != campaignID {
+		t.Fatalf("expected the campaign under include_country/US, got %d %+v", code, entries)
+	}
+	if code := get("/v1/admin/cache/indexes/include_city/US", "ops-key", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown index, got %d", code)
+	}
+
+	var cached model.CachedCampaign
+	if code := get("/v1/admin/cache/campaigns/"+campaignID.String(), "ops-key", &cached); code != http.StatusOK {
+		t.Fatalf("expected 200 for a cached campaign, got %d", code)
+	}
+	if cached.Campaign.CampaignStringID != "spotify" || cached.Advertiser == nil || len(cached.Targeting) != 1 || cached.Targeting[0] != (model.IndexRef{Index: target.IndexIncludeCountry, Key: "US"}) {
+		t.Fatalf("unexpected cached campaign %+v", cached)
+	}
+	if code := get("/v1/admin/cache/campaigns/"+uuid.NewString(), "ops-key", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a campaign which is not cached, got %d", code)
+	}
+	if code := get("/v1/admin/cache", "advertiser-key", nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for an advertiser scoped key, got %d", code)
+	}
+}
+
+// TestMalformedChangeMessage tests that a change with an invalid id is reported as malformed instead of panicking,
+// and that the dead-letter endpoints reject ids which are not stream ids before going to redis
+func TestMalformedChangeMessage(t *testing.T) {
+	useSpotifyTestCache()
+	if err := target.ProcessRedisStreamDataService(context.Background(), "campaigns", "not-a-uuid", false); !errors.Is(err, target.ErrMalformedChange) {
+		t.Fatalf("expected a malformed change error for an invalid id, got %v", err)
+	}
+
+	t.Setenv("TEST_OPS_API_KEY", "ops-key")
+	viper.Set("auth.apiKeys", []map[string]interface{}{{"subject": "ops", "role": "admin", "keyEnv": "TEST_OPS_API_KEY"}})
+	if err := auth.InitAuth(logger.Get()); err != nil {
+		t.Fatalf("Failed to initialize auth: %v", err)
+	}
+	handler := transport.NewHTTPHandler(logger.Get())
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, "/v1/admin/dead-letters/not-an-id"},
+		{http.MethodPost, "/v1/admin/dead-letters/1700000000000/replay"},
+		{http.MethodDelete, "/v1/admin/dead-letters/abc-1"},
+		{http.MethodGet, "/v1/admin/dead-letters?limit=0"},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("X-API-Key", "ops-key")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s %s, got %d", tc.method, tc.path, rec.Code)
+		}
+	}
+}
+
+// TestChangeEventImages tests that version 2 change events are applied from their row images without pgsql,
+// including a hard deleted rule, and that events which do not match the schema are malformed
+func TestChangeEventImages(t *testing.T) {
+	useSpotifyTestCache()
+	var campaignID uuid.UUID
+	for id := range target.TargetCache.Campaigns {
+		campaignID = id
+	}
+	ruleID := uuid.New()
+	rule := fmt.Sprintf(`{"id": %q, "campaigns_id": %q, "is_included": true, "category": 3, "value": "Android", "is_deleted": false, "created_at": "2025-09-01T09:00:00.123456"}`, ruleID, campaignID)
+	apply := func(event *model.ChangeEvent) error {
+		return target.ProcessChangeEvent(context.Background(), event)
+	}
+
+	if err := apply(&model.ChangeEvent{Version: 2, Operation: model.ChangeOperationInsert, Table: "targeting_rules", ID: ruleID.String(), New: json.RawMessage(rule)}); err != nil {
+		t.Fatalf("Failed to apply the rule insert: %v", err)
+	}
+	if ids := target.TargetCache.IncludeOSIndex["Android"]; len(ids) != 1 || ids[0] != campaignID {
+		t.Fatalf("expected the campaign under include_os/Android, got %v", ids)
+	}
+	if err := apply(&model.ChangeEvent{Version: 2, Operation: model.ChangeOperationDelete, Table: "targeting_rules", ID: ruleID.String(), IsDeleted: true, Old: json.RawMessage(rule)}); err != nil {
+		t.Fatalf("Failed to apply the rule delete: %v", err)
+	}
+	if ids, ok := target.TargetCache.IncludeOSIndex["Android"]; ok || target.TargetCache.Rules[ruleID] != nil {
+		t.Fatalf("expected the hard deleted rule to be gone, got %v %v", ids, target.TargetCache.Rules)
+	}
+
+	campaign := fmt.Sprintf(`{"id": %q, "campaign_string_id": "spotify", "name": "Spotify", "image_url": "https://somelink", "cta": "Download", "status": "paused", "is_deleted": false, "advertiser_id": %q, "media_type": "banner", "video": null}`,
+		campaignID, target.TargetCache.Campaigns[campaignID].AdvertiserID)
+	if err := apply(&model.ChangeEvent{Version: 2, Operation: model.ChangeOperationUpdate, Table: "campaigns", ID: campaignID.String(), Old: json.RawMessage(campaign), New: json.RawMessage(campaign)}); err != nil {
+		t.Fatalf("Failed to apply the campaign update: %v", err)
+	}
+	if status := target.TargetCache.Campaigns[campaignID].Status; status != model.CampaignStatusPaused {
+		t.Fatalf("expected the campaign to be paused, got %q", status)
+	}
+
+	for name, event := range map[string]*model.ChangeEvent{
+		"unsupported version": {Version: 3, Operation: model.ChangeOperationInsert, Table: "campaigns", ID: campaignID.String(), New: json.RawMessage(campaign)},
+		"update without old":  {Version: 2, Operation: model.ChangeOperationUpdate, Table: "campaigns", ID: campaignID.String(), New: json.RawMessage(campaign)},
+		"unknown operation":   {Version: 2, Operation: "truncate", Table: "campaigns", ID: campaignID.String()},
+		"image of another id": {Version: 2, Operation: model.ChangeOperationInsert, Table: "campaigns", ID: uuid.NewString(), New: json.RawMessage(campaign)},
+		"invalid image":       {Version: 2, Operation: model.ChangeOperationInsert, Table: "campaigns", ID: campaignID.String(), New: json.RawMessage(`{"id": 1}`)},
+	} {
+		if err := apply(event); !errors.Is(err, target.ErrMalformedChange) {
+			t.Fatalf("%s: expected a malformed change error, got %v", name, err)
+		}
+	}
+}
+
+// TestStaleChangeEvents tests that a change which is not newer than the cached row is dropped, also after the row
+// was deleted, so a late or repeated change can not take the cache back in time
+func TestStaleChangeEvents(t *testing.T) {
+	useSpotifyTestCache()
+	var campaignID, advertiserID uuid.UUID
+	for id, campaign := range target.TargetCache.Campaigns {
+		campaignID, advertiserID = id, campaign.AdvertiserID
+	}
+	image := func(status string, version int) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"id": %q, "campaign_string_id": "spotify", "image_url": "https://somelink", "cta": "Download", "status": %q, "advertiser_id": %q, "media_type": "banner", "row_version": %d}`,
+			campaignID, status, advertiserID, version))
+	}
+	update := func(status string, version int) *model.ChangeEvent {
+		return &model.ChangeEvent{Version: 2, Operation: model.ChangeOperationUpdate, Table: "campaigns", ID: campaignID.String(), Old: image("active", version-1), New: image(status, version)}
+	}
+	apply := func(event *model.ChangeEvent) {
+		t.Helper()
+		if err := target.ProcessChangeEvent(context.Background(), event); err != nil {
+			t.Fatalf("Failed to apply the change: %v", err)
+		}
+	}
+	status := func() model.CampaignStatus {
+		if campaign, ok := target.TargetCache.Campaigns[campaignID]; ok {
+			return campaign.Status
+		}
+		return ""
+	}
+
+	apply(update("paused", 3))
+	apply(update("active", 2)) // stale
+	apply(update("active", 3)) // duplicate
+	if got := status(); got != model.CampaignStatusPaused || target.TargetCache.Campaigns[campaignID].Version != 3 {
+		t.Fatalf("expected version 3 to stay paused, got %q", got)
+	}
+	apply(&model.ChangeEvent{Version: 2, Operation: model.ChangeOperationDelete, Table: "campaigns", ID: campaignID.String(), IsDeleted: true, Old: image("paused", 3)})
+	apply(update("active", 3)) // the last update before the delete, delivered late
+	if got := status(); got != "" || target.TargetCache.Tombstones[campaignID] != 4 {
+		t.Fatalf("expected the deleted campaign to stay deleted, got %q tombstone %d", got, target.TargetCache.Tombstones[campaignID])
+	}
+}
+
+// TestRedisConfigErrors tests that a redis config which can not work fails at startup, before any connection is made
+func TestRedisConfigErrors(t *testing.T) {
+	ca := t.TempDir() + "/ca.pem"
+	if err := os.WriteFile(ca, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("Failed to write the ca file: %v", err)
+	}
+	defer func() {
+		for _, key := range []string{"redis.mode", "redis.addresses", "redis.db", "redis.auth.passwordFile", "redis.tls.enabled", "redis.tls.caFile", "redis.sentinel.masterName"} {
+			viper.Set(key, nil)
+		}
+	}()
+	for name, config := range map[string]map[string]interface{}{
+		"unknown mode":          {"redis.mode": "replicated"},
+		"sentinel without name": {"redis.mode": redisstream.RedisModeSentinel, "redis.addresses": []string{"127.0.0.1:26379"}},
+		"cluster without nodes": {"redis.mode": redisstream.RedisModeCluster},
+		"cluster with a db":     {"redis.mode": redisstream.RedisModeCluster, "redis.addresses": []string{"127.0.0.1:7000"}, "redis.db": 1},
+		"missing password file": {"redis.mode": redisstream.RedisModeStandalone, "redis.auth.passwordFile": t.TempDir() + "/missing"},
+		"invalid ca":            {"redis.mode": redisstream.RedisModeStandalone, "redis.tls.enabled": true, "redis.tls.caFile": ca},
+	} {
+		for key, value := range config {
+			viper.Set(key, value)
+		}
+		if err := redisstream.InitRedis(logger.Get()); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+		for key := range config {
+			viper.Set(key, nil)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"targetad/pkg/auth"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// extractCredentials is a ServerBefore function which pulls the api key or the bearer token out of the
+// request headers. nothing is verified here, verification happens in requireRole so that every endpoint
+// can decide the role it needs
+func extractCredentials(ctx context.Context, r *http.Request) context.Context {
+	creds := auth.Credentials{APIKey: r.Header.Get("X-API-Key")}
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		creds.BearerToken = strings.TrimSpace(h[7:])
+	}
+	return auth.WithCredentials(ctx, creds)
+}
+
+// requireRole is an endpoint middleware which authenticates the caller and rejects the request
+// if the caller does not have at least the given role. the principal is put into the context for the endpoint
+func requireRole(role auth.Role) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			principal, err := auth.Authenticate(auth.CredentialsFromContext(ctx))
+			if err != nil {
+				return nil, err
+			}
+			if !principal.Can(role) {
+				return nil, auth.ErrForbidden
+			}
+			return next(auth.NewContext(ctx, principal), request)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package transport
+
+// codec.go contains the pluggable body encodings of the delivery endpoint. the request is decoded with the codec
+// matching its Content-Type and the response is encoded with the best codec for the Accept header.
+// codecs work on the model types, so adding a format is just another RegisterCodec call here
+// and neither the endpoint nor the targeting logic change.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"targetad/pb"
+	"targetad/pkg/apperr"
+	"targetad/pkg/target/model"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxBodyBytes caps the size of the bodies the binary codecs read into memory
+const maxBodyBytes = 1 << 20
+
+type Codec interface {
+	// MediaType is the canonical media type, it is written into the Content-Type of the response
+	MediaType() string
+	Decode(r io.Reader, v interface{}) error
+	Encode(w io.Writer, v interface{}) error
+}
+
+var (
+	codecs       = map[string]Codec{} // media type (canonical and aliases) -> codec
+	defaultCodec Codec
+)
+
+// RegisterCodec registers the codec for its media type and the given aliases
+func RegisterCodec(c Codec, aliases ...string) {
+	codecs[c.MediaType()] = c
+	for _, alias := range aliases {
+		codecs[alias] = c
+	}
+}
+
+func init() {
+	defaultCodec = jsonCodec{}
+	RegisterCodec(defaultCodec)
+	RegisterCodec(protobufCodec{}, "application/protobuf", "application/vnd.google.protobuf")
+	RegisterCodec(msgpackCodec{}, "application/x-msgpack", "application/vnd.msgpack")
+}
+
+type responseCodecCtxKey struct{}
+
+type negotiatedCodec struct {
+	codec Codec // nil when nothing in the Accept header is registered
+}
+
+// negotiateResponseCodec is a ServerBefore function which picks the response codec from the Accept header.
+// when nothing acceptable is registered the decoder rejects the request with 406
+func negotiateResponseCodec(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, responseCodecCtxKey{}, negotiatedCodec{codec: negotiate(r.Header.Get("Accept"))})
+}
+
+// responseCodec returns the negotiated codec, json when no negotiation happened.
+// ok is false when the Accept header can not be satisfied
+func responseCodec(ctx context.Context) (codec Codec, ok bool) {
+	n, found := ctx.Value(responseCodecCtxKey{}).(negotiatedCodec)
+	if !found {
+		return defaultCodec, true
+	}
+	return n.codec, n.codec != nil
+}
+
+// negotiate returns the registered codec with the highest q value in the Accept header
+func negotiate(accept string) Codec {
+	if strings.TrimSpace(accept) == "" {
+		return defaultCodec
+	}
+	type candidate struct {
+		mediaType string
+		q         float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{mediaType, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	for _, c := range candidates {
+		if c.mediaType == "*/*" || c.mediaType == "application/*" {
+			return defaultCodec
+		}
+		if codec, ok := codecs[c.mediaType]; ok {
+			return codec
+		}
+	}
+	return nil
+}
+
+// decodeBody decodes the request body with the codec of its Content-Type, json when it is not set
+func decodeBody(ctx context.Context, r *http.Request, v interface{}) error {
+	if _, ok := responseCodec(ctx); !ok {
+		return apperr.New(apperr.CodeNotAcceptable, "none of the Accept media types is supported")
+	}
+	codec := defaultCodec
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return apperr.New(apperr.CodeUnsupportedMediaType, "invalid Content-Type")
+		}
+		if codec = codecs[mediaType]; codec == nil {
+			return apperr.New(apperr.CodeUnsupportedMediaType, fmt.Sprintf("Content-Type %s is not supported", mediaType))
+		}
+	}
+	if err := codec.Decode(r.Body, v); err != nil {
+		return apperr.Wrap(apperr.CodeMalformedRequest, "error decoding the request body", err)
+	}
+	return nil
+}
+
+// encodeNegotiatedResponse encodes the response with the codec picked by negotiateResponseCodec
+func encodeNegotiatedResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	codec, _ := responseCodec(ctx)
+	w.Header().Set("Content-Type", codec.MediaType())
+	w.Header().Add("Vary", "Accept")
+	return codec.Encode(w, response)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) MediaType() string { return "application/json" }
+
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// msgpackCodec uses the json struct tags so the field names are the same as in the json api
+type msgpackCodec struct{}
+
+func (msgpackCodec) MediaType() string { return "application/msgpack" }
+
+func (msgpackCodec) Decode(r io.Reader, v interface{}) error {
+	dec := msgpack.NewDecoder(io.LimitReader(r, maxBodyBytes))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+func (msgpackCodec) Encode(w io.Writer, v interface{}) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	return enc.Encode(v)
+}
+
+// protobufCodec uses the messages of pb/delivery.proto. the response is wrapped into DeliveryResponse
+// because protobuf can not encode a bare list
+type protobufCodec struct{}
+
+func (protobufCodec) MediaType() string { return "application/x-protobuf" }
+
+func (protobufCodec) Decode(r io.Reader, v interface{}) error {
+	body, err := io.ReadAll(io.LimitReader(r, maxBodyBytes))
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case *model.DeliveryServiceRequest:
+		var req pb.DeliveryRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			return err
+		}
+		*v = fromPBDeliveryRequest(&req)
+		return nil
+	}
+	return fmt.Errorf("protobuf codec can not decode %T", v)
+}
+
+func (protobufCodec) Encode(w io.Writer, v interface{}) error {
+	switch v := v.(type) {
+	case []*model.DeliveryServiceResponse:
+		body, err := proto.Marshal(toPBDeliveryResponse(v))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(body)
+		return err
+	}
+	return fmt.Errorf("protobuf codec can not encode %T", v)
+}
@@ -0,0 +1,59 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+
+	"targetad/pkg/apperr"
+	"targetad/pkg/logger"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// errorResponse is the body of every error response, see the readme for the list of codes
+type errorResponse struct {
+	Error *apperr.Error `json:"error"`
+}
+
+// errorEncoder returns the go-kit ErrorEncoder of every http endpoint. typed errors keep their code and status,
+// anything else is an internal error whose details are only logged to l and never sent to the client
+func errorEncoder(l log.Logger) httptransport.ErrorEncoder {
+	return func(ctx context.Context, err error, w http.ResponseWriter) {
+		appErr := toAppError(ctx, l, err)
+		if appErr.Code == apperr.CodeUnauthenticated {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="targetad"`)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(appErr.StatusCode())
+		json.NewEncoder(w).Encode(errorResponse{Error: appErr})
+	}
+}
+
+func toAppError(ctx context.Context, l log.Logger, err error) *apperr.Error {
+	var appErr *apperr.Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	level.Error(logger.FromContext(ctx, l)).Log("msg", "internal error", "err", err)
+	return apperr.New(apperr.CodeInternal, "internal error")
+}
+
+// decodeJSONBody decodes the json body into v. a Content-Type other than json is rejected with 415,
+// a body which is not valid json with 400
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType != "application/json" {
+			return apperr.New(apperr.CodeUnsupportedMediaType, "Content-Type must be application/json")
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return apperr.Wrap(apperr.CodeMalformedRequest, "error decoding the request body", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+
+	"targetad/endpoint"
+	"targetad/pb"
+	"targetad/pkg/apperr"
+	"targetad/pkg/logger"
+	"targetad/pkg/target/model"
+
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	"github.com/go-kit/log"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer serves the delivery service over grpc. it wraps the same go-kit endpoint as the http handler,
+// only the decoding/encoding of the request and the response is different
+type grpcServer struct {
+	pb.UnimplementedDeliveryServiceServer
+	logger   log.Logger
+	delivery grpctransport.Handler
+}
+
+func NewGRPCServer(l log.Logger) pb.DeliveryServiceServer {
+	return &grpcServer{
+		logger: l,
+		delivery: grpctransport.NewServer(
+			endpoint.Instrument(l, "delivery_grpc", endpoint.MakeDeliveryServiceEndpoint()),
+			decodeGRPCDeliveryRequest,
+			encodeGRPCDeliveryResponse,
+		),
+	}
+}
+
+func (s *grpcServer) Delivery(ctx context.Context, req *pb.DeliveryRequest) (*pb.DeliveryResponse, error) {
+	ctx = grpcRequestID(ctx, s.logger)
+	_, res, err := s.delivery.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(ctx, s.logger, err)
+	}
+	return res.(*pb.DeliveryResponse), nil
+}
+
+// grpcRequestID is the grpc counterpart of withRequestID, the id travels in the x-request-id metadata
+// and is sent back as a response header
+func grpcRequestID(ctx context.Context, l log.Logger) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(requestIDHeader); len(v) > 0 && validRequestID(v[0]) {
+			id = v[0]
+		}
+	}
+	if id == "" {
+		id = uuid.NewString()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id))
+	return logger.NewRequestContext(ctx, l, id)
+}
+
+func decodeGRPCDeliveryRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	return fromPBDeliveryRequest(grpcReq.(*pb.DeliveryRequest)), nil
+}
+
+func encodeGRPCDeliveryResponse(_ context.Context, response interface{}) (interface{}, error) {
+	return toPBDeliveryResponse(response.([]*model.DeliveryServiceResponse)), nil
+}
+
+// the protobuf conversions are shared by the grpc transport and the protobuf http codec
+
+func fromPBDeliveryRequest(req *pb.DeliveryRequest) model.DeliveryServiceRequest {
+	return model.DeliveryServiceRequest{
+		AppID:   req.GetApp(),
+		OS:      req.GetOs(),
+		Country: req.GetCountry(),
+	}
+}
+
+func toPBDeliveryResponse(campaigns []*model.DeliveryServiceResponse) *pb.DeliveryResponse {
+	res := &pb.DeliveryResponse{Campaigns: make([]*pb.Campaign, 0, len(campaigns))}
+	for _, c := range campaigns {
+		res.Campaigns = append(res.Campaigns, &pb.Campaign{Cid: c.CampaignStringID, Img: c.Image, Cta: c.Cta})
+	}
+	return res
+}
+
+var grpcCodes = map[apperr.Code]codes.Code{
+	apperr.CodeValidation:       codes.InvalidArgument,
+	apperr.CodeMalformedRequest: codes.InvalidArgument,
+	apperr.CodeUnauthenticated:  codes.Unauthenticated,
+	apperr.CodeForbidden:        codes.PermissionDenied,
+	apperr.CodeNotFound:         codes.NotFound,
+	apperr.CodeConflict:         codes.FailedPrecondition,
+	apperr.CodeUnavailable:      codes.Unavailable,
+}
+
+// grpcError maps the typed endpoint errors to grpc status codes. validation failures are the callers fault,
+// everything else is an internal error and the details are not leaked to the client
+func grpcError(ctx context.Context, l log.Logger, err error) error {
+	appErr := toAppError(ctx, l, err)
+	code, ok := grpcCodes[appErr.Code]
+	if !ok {
+		code = codes.Internal
+	}
+	msg := appErr.Message
+	for _, fe := range appErr.Fields {
+		msg += fmt.Sprintf("; %s: %s", fe.Field, fe.Rule)
+	}
+	return status.Error(code, msg)
+}
@@ -0,0 +1,38 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"targetad/pkg/health"
+
+	"github.com/spf13/viper"
+)
+
+// liveness only tells that the process is up and serving http, kubernetes restarts the pod when it fails.
+// dependencies are deliberately not checked here, a postgres outage must not restart every pod
+func liveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, &health.Report{Status: health.StatusOK})
+}
+
+// readiness runs all the registered checks and answers 503 if any of them fails, so traffic only goes to warm instances
+func readiness(w http.ResponseWriter, r *http.Request) {
+	timeout := time.Duration(viper.GetInt("health.checkTimeout")) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	report := health.Readiness(r.Context(), timeout)
+	status := http.StatusOK
+	if !report.OK() {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, report)
+}
+
+func writeHealth(w http.ResponseWriter, status int, report *health.Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
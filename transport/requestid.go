@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"net/http"
+
+	"targetad/pkg/logger"
+
+	"github.com/go-kit/log"
+	"github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// withRequestID gives every http request an id, the one sent by the caller (e.g. the load balancer) or a new one.
+// the id is returned in the X-Request-ID header and every log line of the request, written through the request
+// logger derived from l, carries it
+func withRequestID(l log.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logger.NewRequestContext(r.Context(), l, id)))
+	})
+}
+
+// validRequestID keeps caller supplied ids short and printable so they can not break the log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -3,36 +3,347 @@ package transport
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"encoding/xml"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"targetad/endpoint"
+	adminmodel "targetad/pkg/admin/model"
+	"targetad/pkg/apperr"
+	"targetad/pkg/auth"
+	"targetad/pkg/openrtb"
 	"targetad/pkg/target/model"
+	"targetad/pkg/vast"
 
 	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
-func NewHTTPHandler() http.Handler {
+func NewHTTPHandler(l log.Logger) http.Handler {
 	m := http.NewServeMux()
+	// every route gets a server span named after its pattern, the incoming traceparent header is honoured
+	handle := func(pattern string, h http.Handler) {
+		m.Handle(pattern, otelhttp.NewHandler(h, pattern))
+	}
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(errorEncoder(l))}
+
+	// probes for kubernetes, see health.go
+	m.HandleFunc("GET /healthz", liveness)
+	m.HandleFunc("GET /readyz", readiness)
+
+	// prometheus scrape endpoint, see the metrics section of the readme
+	m.Handle("GET /metrics", promhttp.Handler())
+
+	// delivery supports json, protobuf and msgpack, see codec.go
+	handle("/v1/delivery", httptransport.NewServer(
+		endpoint.Instrument(l, "delivery", endpoint.MakeDeliveryServiceEndpoint()),
+		instrumentDecoder("delivery", decodeDeliveryAdsRequest),
+		encodeNegotiatedResponse,
+		append([]httptransport.ServerOption{httptransport.ServerBefore(negotiateResponseCodec)}, options...)...,
+	))
+
+	handle("POST /v1/delivery/batch", httptransport.NewServer(
+		endpoint.Instrument(l, "batch", endpoint.MakeBatchDeliveryServiceEndpoint()),
+		instrumentDecoder("batch", decodeBatchDeliveryAdsRequest),
+		encodeResponse,
+		options...,
+	))
+
+	// video players load the vast tag with a plain GET, so the request comes in the query string
+	handle("GET /v1/delivery/vast", httptransport.NewServer(
+		endpoint.Instrument(l, "vast", endpoint.MakeVideoDeliveryEndpoint()),
+		instrumentDecoder("vast", decodeVideoDeliveryRequest),
+		encodeVASTResponse,
+		options...,
+	))
 
-	m.Handle("/v1/delivery", httptransport.NewServer(
-		endpoint.MakeDeliveryServiceEndpoint(),
-		decodeDeliveryAdsRequest,
+	// the impression and event urls of the vast documents, players fire them and ignore the answer
+	handle("GET /v1/tracking/impression", httptransport.NewServer(
+		endpoint.LoggingMiddleware(l, "vast_tracking")(endpoint.MakeVASTTrackingEndpoint()),
+		decodeVASTTrackingRequest("impression"),
+		encodeNoContent,
+		options...,
+	))
+	handle("GET /v1/tracking/event", httptransport.NewServer(
+		endpoint.LoggingMiddleware(l, "vast_tracking")(endpoint.MakeVASTTrackingEndpoint()),
+		decodeVASTTrackingRequest("event"),
+		encodeNoContent,
+		options...,
+	))
+
+	handle("POST /v1/openrtb/bid", httptransport.NewServer(
+		endpoint.Instrument(l, "openrtb", endpoint.MakeOpenRTBEndpoint()),
+		instrumentDecoder("openrtb", decodeOpenRTBRequest),
+		encodeOpenRTBResponse,
+		options...,
+	))
+
+	// admin apis, every one of them needs an api key or a jwt with at least the given role
+	adminOptions := append([]httptransport.ServerOption{httptransport.ServerBefore(extractCredentials)}, options...)
+	handle("GET /v1/admin/campaigns", httptransport.NewServer(
+		requireRole(auth.RoleViewer)(endpoint.MakeListCampaignsEndpoint()),
+		decodeListCampaignsRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("POST /v1/admin/campaigns", httptransport.NewServer(
+		requireRole(auth.RoleEditor)(endpoint.MakeCreateCampaignEndpoint()),
+		decodeCreateCampaignRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("DELETE /v1/admin/campaigns/{id}", httptransport.NewServer(
+		requireRole(auth.RoleAdmin)(endpoint.MakeDeleteCampaignEndpoint()),
+		decodeDeleteCampaignRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("POST /v1/admin/campaigns/{id}/status", httptransport.NewServer(
+		requireRole(auth.RoleEditor)(endpoint.MakeTransitionCampaignStatusEndpoint()),
+		decodeTransitionCampaignStatusRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("GET /v1/admin/campaigns/{id}/transitions", httptransport.NewServer(
+		requireRole(auth.RoleViewer)(endpoint.MakeListCampaignTransitionsEndpoint()),
+		decodeListCampaignTransitionsRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("POST /v1/admin/targeting-rules", httptransport.NewServer(
+		requireRole(auth.RoleEditor)(endpoint.MakeCreateTargetingRuleEndpoint()),
+		decodeCreateTargetingRuleRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("GET /v1/admin/advertisers", httptransport.NewServer(
+		requireRole(auth.RoleViewer)(endpoint.MakeListAdvertisersEndpoint()),
+		httptransport.NopRequestDecoder,
 		encodeResponse,
+		adminOptions...,
+	))
+	handle("POST /v1/admin/advertisers", httptransport.NewServer(
+		requireRole(auth.RoleAdmin)(endpoint.MakeCreateAdvertiserEndpoint()),
+		decodeCreateAdvertiserRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("PUT /v1/admin/advertisers/{id}/controls", httptransport.NewServer(
+		requireRole(auth.RoleEditor)(endpoint.MakeUpdateAdvertiserControlsEndpoint()),
+		decodeUpdateAdvertiserControlsRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	// cache introspection, answered from the cache of the instance which serves the request
+	handle("GET /v1/admin/cache", httptransport.NewServer(
+		requireRole(auth.RoleViewer)(endpoint.MakeCacheStateEndpoint()),
+		httptransport.NopRequestDecoder,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("GET /v1/admin/cache/indexes/{index}/{key}", httptransport.NewServer(
+		requireRole(auth.RoleViewer)(endpoint.MakeCacheIndexEndpoint()),
+		decodeCacheIndexRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("GET /v1/admin/cache/campaigns/{id}", httptransport.NewServer(
+		requireRole(auth.RoleViewer)(endpoint.MakeCachedCampaignEndpoint()),
+		decodeCachedCampaignRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("POST /v1/admin/cache/reconcile", httptransport.NewServer(
+		requireRole(auth.RoleEditor)(endpoint.MakeReconcileCacheEndpoint()),
+		httptransport.NopRequestDecoder,
+		encodeResponse,
+		adminOptions...,
+	))
+	// dead letters of the change stream, see pkg/redisstream/deadletter.go
+	handle("GET /v1/admin/dead-letters", httptransport.NewServer(
+		requireRole(auth.RoleViewer)(endpoint.MakeListDeadLettersEndpoint()),
+		decodeListDeadLettersRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("GET /v1/admin/dead-letters/{id}", httptransport.NewServer(
+		requireRole(auth.RoleViewer)(endpoint.MakeGetDeadLetterEndpoint()),
+		decodeDeadLetterRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("POST /v1/admin/dead-letters/{id}/replay", httptransport.NewServer(
+		requireRole(auth.RoleEditor)(endpoint.MakeReplayDeadLetterEndpoint()),
+		decodeDeadLetterRequest,
+		encodeResponse,
+		adminOptions...,
+	))
+	handle("DELETE /v1/admin/dead-letters/{id}", httptransport.NewServer(
+		requireRole(auth.RoleAdmin)(endpoint.MakeDiscardDeadLetterEndpoint()),
+		decodeDeadLetterRequest,
+		encodeResponse,
+		adminOptions...,
 	))
 
-	return m
+	return withRequestID(l, m)
 }
 
-func decodeDeliveryAdsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+// instrumentDecoder counts the requests of a delivery endpoint which fail to decode, they never reach the
+// instrumenting middleware of the endpoint
+func instrumentDecoder(name string, dec httptransport.DecodeRequestFunc) httptransport.DecodeRequestFunc {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		begin := time.Now()
+		req, err := dec(ctx, r)
+		if err != nil {
+			endpoint.ObserveDecodeFailure(name, err, time.Since(begin))
+		}
+		return req, err
+	}
+}
+
+func decodeDeliveryAdsRequest(ctx context.Context, r *http.Request) (interface{}, error) {
 	var req model.DeliveryServiceRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding the input request: %s", err)
+	if err := decodeBody(ctx, r, &req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeBatchDeliveryAdsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req model.BatchDeliveryServiceRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		return nil, err
 	}
 	return req, nil
 }
 
+func decodeVideoDeliveryRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	return model.DeliveryServiceRequest{AppID: q.Get("app"), OS: q.Get("os"), Country: q.Get("country")}, nil
+}
+
+func encodeVASTResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", vast.MediaType)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(response)
+}
+
+func decodeVASTTrackingRequest(kind string) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		q := r.URL.Query()
+		return vast.TrackingRequest{Kind: kind, CampaignID: q.Get("cid"), ServingID: q.Get("sid"), Event: q.Get("event")}, nil
+	}
+}
+
+func encodeNoContent(_ context.Context, w http.ResponseWriter, _ interface{}) error {
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func decodeOpenRTBRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req openrtb.BidRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// encodeOpenRTBResponse answers with 204 No Content when we do not bid, that is what exchanges expect
+func encodeOpenRTBResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("x-openrtb-version", openrtb.Version)
+	res := response.(*openrtb.BidResponse)
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res)
+}
+
+func decodeListCampaignsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return adminmodel.ListCampaignsRequest{AdvertiserID: r.URL.Query().Get("advertiser_id")}, nil
+}
+
+func decodeCreateCampaignRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req adminmodel.CreateCampaignRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeDeleteCampaignRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return adminmodel.DeleteCampaignRequest{ID: r.PathValue("id")}, nil
+}
+
+func decodeTransitionCampaignStatusRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req adminmodel.TransitionCampaignStatusRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		return nil, err
+	}
+	req.ID = r.PathValue("id")
+	return req, nil
+}
+
+func decodeListCampaignTransitionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return adminmodel.ListCampaignTransitionsRequest{ID: r.PathValue("id")}, nil
+}
+
+func decodeCreateTargetingRuleRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req adminmodel.CreateTargetingRuleRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeCreateAdvertiserRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req adminmodel.CreateAdvertiserRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeUpdateAdvertiserControlsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req adminmodel.UpdateAdvertiserControlsRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		return nil, err
+	}
+	req.ID = r.PathValue("id")
+	return req, nil
+}
+
+func decodeCacheIndexRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return adminmodel.CacheIndexRequest{Index: r.PathValue("index"), Key: r.PathValue("key")}, nil
+}
+
+func decodeCachedCampaignRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return adminmodel.CachedCampaignRequest{ID: r.PathValue("id")}, nil
+}
+
+func decodeListDeadLettersRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := adminmodel.ListDeadLettersRequest{After: r.URL.Query().Get("after"), Limit: 100}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			return nil, apperr.Wrap(apperr.CodeMalformedRequest, "limit must be a number", err)
+		}
+		req.Limit = n
+	}
+	return req, nil
+}
+
+func decodeDeadLetterRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return adminmodel.DeadLetterRequest{ID: r.PathValue("id")}, nil
+}
+
 func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
 	return json.NewEncoder(w).Encode(response)
 }